@@ -0,0 +1,128 @@
+package apitest
+
+import (
+	"time"
+
+	"github.com/komunitin/komunitin/notifications/api"
+)
+
+// Resources served by the fake server. Relationships between fixtures only need the id
+// of the related resource, the server fills in the rest when rendering them.
+type Fixtures struct {
+	// Groups with their admin users.
+	Groups []*api.Group
+	// Currency of each group, by group code.
+	Currencies map[string]*api.Currency
+	// Members of each group, by group code, with their account.
+	Members map[string][]*api.Member
+	// Accounts of each group, by group code.
+	Accounts map[string][]*api.Account
+	// Transfers of each group, by group code, with their payer and payee accounts.
+	Transfers map[string][]*api.Transfer
+	// Users with their members and settings.
+	Users []*api.User
+}
+
+// Ids of the default fixtures.
+const (
+	GroupCode  = "GRP0"
+	GroupId    = "a8f6d2e4-0c1b-4e3a-9f7d-5b2c8e1a4d60"
+	CurrencyId = "c3e1b7a9-2d4f-4a6b-8c0e-7f9a1b3d5e71"
+
+	AliceMember  = "1f2e3d4c-5b6a-4798-8a9b-0c1d2e3f4a51"
+	AliceAccount = "2a3b4c5d-6e7f-4809-9a1b-2c3d4e5f6a72"
+	AliceUser    = "3b4c5d6e-7f80-4912-a3b4-c5d6e7f8a983"
+	BobMember    = "4c5d6e7f-8091-4a23-b4c5-d6e7f8a9b094"
+	BobAccount   = "5d6e7f80-91a2-4b34-c5d6-e7f8a9b0c1a5"
+	BobUser      = "6e7f8091-a2b3-4c45-d6e7-f8a9b0c1d2b6"
+	AdminUser    = "7f8091a2-b3c4-4d56-e7f8-a9b0c1d2e3c7"
+
+	TransferId = "8091a2b3-c4d5-4e67-f8a9-b0c1d2e3f4d8"
+)
+
+func userSettings(id string, language string) *api.UserSettings {
+	return &api.UserSettings{
+		Id:        id,
+		Language:  language,
+		Komunitin: true,
+		Emails:    map[string]interface{}{"myAccount": true, "group": "weekly"},
+		Notifications: map[string]interface{}{
+			"myAccount":  true,
+			"newOffers":  true,
+			"newNeeds":   true,
+			"newMembers": true,
+		},
+	}
+}
+
+// Return a new set of fixtures with the group GRP0, whose members are Alice and Bob,
+// and a committed transfer from Alice to Bob. Alice reads her emails in English and
+// Bob in Catalan. The group has an admin user without a member.
+func NewFixtures() *Fixtures {
+	created := time.Date(2024, 4, 16, 23, 5, 0, 0, time.UTC)
+	return &Fixtures{
+		Groups: []*api.Group{{
+			Id:     GroupId,
+			Code:   GroupCode,
+			Name:   "Group Zero",
+			Admins: []*api.User{{Id: AdminUser}},
+		}},
+		Currencies: map[string]*api.Currency{
+			GroupCode: {
+				Id:         CurrencyId,
+				CodeType:   "CEN",
+				Code:       GroupCode,
+				Name:       "hour",
+				NamePlural: "hours",
+				Symbol:     "ℏ",
+				Decimals:   2,
+				Scale:      4,
+				Value:      100000,
+			},
+		},
+		Members: map[string][]*api.Member{
+			GroupCode: {
+				{Id: AliceMember, Code: GroupCode + "0001", Name: "Alice", Account: &api.ExternalAccount{Id: AliceAccount}},
+				{Id: BobMember, Code: GroupCode + "0002", Name: "Bob", Account: &api.ExternalAccount{Id: BobAccount}},
+			},
+		},
+		Accounts: map[string][]*api.Account{
+			GroupCode: {
+				{Id: AliceAccount, Code: GroupCode + "0001", Balance: -120000, CreditLimit: 1000000, DebitLimit: 1000000},
+				{Id: BobAccount, Code: GroupCode + "0002", Balance: 120000, CreditLimit: 1000000, DebitLimit: 1000000},
+			},
+		},
+		Transfers: map[string][]*api.Transfer{
+			GroupCode: {{
+				Id:      TransferId,
+				Amount:  120000,
+				Meta:    "Bike repair",
+				State:   "committed",
+				Created: created,
+				Updated: created,
+				Payer:   &api.Account{Id: AliceAccount},
+				Payee:   &api.Account{Id: BobAccount},
+			}},
+		},
+		Users: []*api.User{
+			{
+				Id:       AliceUser,
+				Email:    "alice@example.com",
+				Members:  []*api.Member{{Id: AliceMember}},
+				Settings: userSettings("9a1b2c3d-4e5f-4607-8182-93a4b5c6d7e9", "en"),
+			},
+			{
+				Id:       BobUser,
+				Email:    "bob@example.com",
+				Members:  []*api.Member{{Id: BobMember}},
+				Settings: userSettings("0b1c2d3e-4f50-4617-8293-a4b5c6d7e8fa", "ca"),
+			},
+			{
+				Id:       AdminUser,
+				Email:    "admin@example.com",
+				Members:  []*api.Member{},
+				Settings: userSettings("1c2d3e4f-5061-4728-93a4-b5c6d7e8f90b", "en"),
+			},
+		},
+	}
+}
@@ -0,0 +1,396 @@
+// Package apitest provides a fake Komunitin social and accounting API server for
+// tests, so the event handlers can be tested end to end without the real services.
+//
+// The server runs on a local httptest server and serves the resources in its fixtures
+// as JSON:API documents, with the endpoints used by the api package:
+//
+//	POST /oauth2/token                            client credentials tokens
+//	GET  /social/users/me                         user of a token from UserToken
+//	GET  /social/users?filter[members]=...        users of the given members
+//	GET  /social/{code}                           group with its admins
+//	GET  /social/{code}/members?filter[account]=  members of the group or of the given accounts
+//	GET  /social/{code}/members/{id}              member
+//	GET  /accounting/{code}/currency              group currency
+//	GET  /accounting/{code}/accounts/{id}         account
+//	GET  /accounting/{code}/transfers/{id}        transfer with its accounts and currency
+//
+// Related resources are always included, regardless of the include parameter. The
+// API endpoints require the access token issued by the token endpoint.
+package apitest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/komunitin/jsonapi"
+	"github.com/komunitin/komunitin/notifications/api"
+	"github.com/komunitin/komunitin/notifications/config"
+)
+
+const (
+	// Client credentials accepted by the token endpoint.
+	ClientId     = "komunitin-notifications"
+	ClientSecret = "notifications-secret"
+	// Access token issued by the token endpoint.
+	AccessToken = "fake-access-token"
+
+	userTokenPrefix = "fake-user-token-"
+)
+
+type Server struct {
+	*httptest.Server
+	// The fixtures must not be modified while the server is handling requests.
+	Fixtures *Fixtures
+
+	mutex    sync.Mutex
+	requests []string
+}
+
+// Start a new server with the given fixtures, or the default ones if nil. The caller
+// must close the server when done.
+func NewServer(fixtures *Fixtures) *Server {
+	if fixtures == nil {
+		fixtures = NewFixtures()
+	}
+	server := &Server{Fixtures: fixtures}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /oauth2/token", server.tokenHandler)
+	mux.HandleFunc("GET /social/users/me", server.userHandler)
+	mux.HandleFunc("GET /social/users", server.authorized(server.usersHandler))
+	mux.HandleFunc("GET /social/{code}", server.authorized(server.groupHandler))
+	mux.HandleFunc("GET /social/{code}/members", server.authorized(server.membersHandler))
+	mux.HandleFunc("GET /social/{code}/members/{id}", server.authorized(server.memberHandler))
+	mux.HandleFunc("GET /accounting/{code}/currency", server.authorized(server.currencyHandler))
+	mux.HandleFunc("GET /accounting/{code}/accounts/{id}", server.authorized(server.accountHandler))
+	mux.HandleFunc("GET /accounting/{code}/transfers/{id}", server.authorized(server.transferHandler))
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.mutex.Lock()
+		server.requests = append(server.requests, r.Method+" "+r.URL.RequestURI())
+		server.mutex.Unlock()
+		mux.ServeHTTP(w, r)
+	}))
+	return server
+}
+
+func (server *Server) AuthUrl() string {
+	return server.URL + "/oauth2"
+}
+
+func (server *Server) SocialUrl() string {
+	return server.URL + "/social"
+}
+
+func (server *Server) AccountingUrl() string {
+	return server.URL + "/accounting"
+}
+
+// Return the access token of the given user, accepted by the /users/me endpoint.
+func (server *Server) UserToken(userId string) string {
+	return userTokenPrefix + userId
+}
+
+// Return the method and URI of the requests received so far.
+func (server *Server) Requests() []string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return slices.Clone(server.requests)
+}
+
+// Point the service configuration to this server, with its client credentials and
+// as the trusted accounting source. Returns a function that restores the previous
+// configuration.
+//
+// The api package reads the auth settings on first use, so Configure has to be called
+// before the first request to the APIs.
+func (server *Server) Configure() (restore func()) {
+	previous := []string{
+		config.KomunitinAuthUrl,
+		config.KomunitinSocialUrl,
+		config.KomunitinAccountingUrl,
+		config.NotificationsClientId,
+		config.NotificationsClientSecret,
+	}
+	config.KomunitinAuthUrl = server.AuthUrl()
+	config.KomunitinSocialUrl = server.SocialUrl()
+	config.KomunitinAccountingUrl = server.AccountingUrl()
+	config.NotificationsClientId = ClientId
+	config.NotificationsClientSecret = ClientSecret
+	return func() {
+		config.KomunitinAuthUrl = previous[0]
+		config.KomunitinSocialUrl = previous[1]
+		config.KomunitinAccountingUrl = previous[2]
+		config.NotificationsClientId = previous[3]
+		config.NotificationsClientSecret = previous[4]
+	}
+}
+
+func (server *Server) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.PostFormValue("grant_type") != "client_credentials" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+	if r.PostFormValue("client_id") != ClientId || r.PostFormValue("client_secret") != ClientSecret {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": AccessToken,
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"scope":        r.PostFormValue("scope"),
+	})
+}
+
+func bearerToken(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// Require the access token issued by the token endpoint.
+func (server *Server) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if bearerToken(r) != AccessToken {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Write the given model or slice of models as a JSON:API document.
+func writePayload(w http.ResponseWriter, models interface{}) {
+	payload, err := jsonapi.Marshal(models)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if many, ok := payload.(*jsonapi.ManyPayload); ok {
+		// All resources fit in a single page.
+		many.Links = &jsonapi.Links{"next": nil}
+	}
+	w.Header().Set("Content-Type", jsonapi.MediaType)
+	json.NewEncoder(w).Encode(payload)
+}
+
+func notFound(w http.ResponseWriter) {
+	http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+}
+
+// Return the values of the given filter query parameter.
+func filter(r *http.Request, name string) ([]string, bool) {
+	value, ok := r.URL.Query()["filter["+name+"]"]
+	if !ok {
+		return nil, false
+	}
+	return strings.Split(strings.Join(value, ","), ","), true
+}
+
+func (server *Server) userHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := strings.CutPrefix(bearerToken(r), userTokenPrefix)
+	user := server.user(id)
+	if !ok || user == nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	writePayload(w, user)
+}
+
+func (server *Server) usersHandler(w http.ResponseWriter, r *http.Request) {
+	members, filtered := filter(r, "members")
+	users := []*api.User{}
+	for _, fixture := range server.Fixtures.Users {
+		matches := !filtered
+		for _, member := range fixture.Members {
+			matches = matches || slices.Contains(members, member.Id)
+		}
+		if matches {
+			users = append(users, server.user(fixture.Id))
+		}
+	}
+	writePayload(w, users)
+}
+
+func (server *Server) groupHandler(w http.ResponseWriter, r *http.Request) {
+	group := server.group(r.PathValue("code"))
+	if group == nil {
+		notFound(w)
+		return
+	}
+	writePayload(w, group)
+}
+
+func (server *Server) membersHandler(w http.ResponseWriter, r *http.Request) {
+	code := r.PathValue("code")
+	accounts, filtered := filter(r, "account")
+	members := []*api.Member{}
+	for _, fixture := range server.Fixtures.Members[code] {
+		if !filtered || (fixture.Account != nil && slices.Contains(accounts, fixture.Account.Id)) {
+			members = append(members, server.member(code, fixture.Id))
+		}
+	}
+	writePayload(w, members)
+}
+
+func (server *Server) memberHandler(w http.ResponseWriter, r *http.Request) {
+	member := server.member(r.PathValue("code"), r.PathValue("id"))
+	if member == nil {
+		notFound(w)
+		return
+	}
+	writePayload(w, member)
+}
+
+func (server *Server) currencyHandler(w http.ResponseWriter, r *http.Request) {
+	currency := server.currency(r.PathValue("code"))
+	if currency == nil {
+		notFound(w)
+		return
+	}
+	writePayload(w, currency)
+}
+
+func (server *Server) accountHandler(w http.ResponseWriter, r *http.Request) {
+	account := server.account(r.PathValue("code"), r.PathValue("id"))
+	if account == nil {
+		notFound(w)
+		return
+	}
+	writePayload(w, account)
+}
+
+func (server *Server) transferHandler(w http.ResponseWriter, r *http.Request) {
+	transfer := server.transfer(r.PathValue("code"), r.PathValue("id"))
+	if transfer == nil {
+		notFound(w)
+		return
+	}
+	writePayload(w, transfer)
+}
+
+// The following functions return copies of the fixtures with their relationships
+// filled in, or nil if they don't exist.
+
+func (server *Server) group(code string) *api.Group {
+	for _, fixture := range server.Fixtures.Groups {
+		if fixture.Code == code {
+			group := *fixture
+			group.Admins = []*api.User{}
+			for _, admin := range fixture.Admins {
+				if user := server.user(admin.Id); user != nil {
+					group.Admins = append(group.Admins, user)
+				}
+			}
+			return &group
+		}
+	}
+	return nil
+}
+
+func (server *Server) user(id string) *api.User {
+	for _, fixture := range server.Fixtures.Users {
+		if fixture.Id == id {
+			user := *fixture
+			user.Members = []*api.Member{}
+			for _, m := range fixture.Members {
+				if member := server.findMember(m.Id); member != nil {
+					user.Members = append(user.Members, member)
+				}
+			}
+			return &user
+		}
+	}
+	return nil
+}
+
+// Return the member with the given id in any group.
+func (server *Server) findMember(id string) *api.Member {
+	for code := range server.Fixtures.Members {
+		if member := server.member(code, id); member != nil {
+			return member
+		}
+	}
+	return nil
+}
+
+func (server *Server) member(code string, id string) *api.Member {
+	for _, fixture := range server.Fixtures.Members[code] {
+		if fixture.Id == id {
+			member := *fixture
+			member.SelfLink = fmt.Sprintf("%s/%s/members/%s", server.SocialUrl(), code, id)
+			if fixture.Account != nil {
+				member.Account = &api.ExternalAccount{
+					Id:   fixture.Account.Id,
+					Href: fmt.Sprintf("%s/%s/accounts/%s", server.AccountingUrl(), code, fixture.Account.Id),
+				}
+			}
+			return &member
+		}
+	}
+	return nil
+}
+
+func (server *Server) currency(code string) *api.Currency {
+	fixture := server.Fixtures.Currencies[code]
+	if fixture == nil {
+		return nil
+	}
+	currency := *fixture
+	return &currency
+}
+
+func (server *Server) account(code string, id string) *api.Account {
+	for _, fixture := range server.Fixtures.Accounts[code] {
+		if fixture.Id == id {
+			account := *fixture
+			account.Currency = server.currency(code)
+			return &account
+		}
+	}
+	return nil
+}
+
+func (server *Server) transfer(code string, id string) *api.Transfer {
+	for _, fixture := range server.Fixtures.Transfers[code] {
+		if fixture.Id == id {
+			transfer := *fixture
+			transfer.Payer = server.account(code, fixture.Payer.Id)
+			transfer.Payee = server.account(code, fixture.Payee.Id)
+			transfer.Currency = server.currency(code)
+			if transfer.Payer == nil || transfer.Payee == nil {
+				return nil
+			}
+			return &transfer
+		}
+	}
+	return nil
+}
+
+// Return a JSON:API document with an event of the given type sent by the accounting
+// API of this server, to be posted to the /events endpoint.
+func (server *Server) Event(name string, code string, user string, data map[string]string) string {
+	document := map[string]interface{}{
+		"data": map[string]interface{}{
+			"type": "events",
+			"attributes": map[string]interface{}{
+				"name":   name,
+				"source": server.AccountingUrl(),
+				"code":   code,
+				"time":   time.Now().UTC().Format(time.RFC3339),
+				"data":   data,
+			},
+			"relationships": map[string]interface{}{
+				"user": map[string]interface{}{"data": map[string]string{"type": "users", "id": user}},
+			},
+		},
+	}
+	body, _ := json.Marshal(document)
+	return string(body)
+}
@@ -0,0 +1,87 @@
+package apitest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/komunitin/komunitin/notifications/api"
+)
+
+func TestServer(t *testing.T) {
+	server := NewServer(nil)
+	defer server.Close()
+	defer server.Configure()()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	group, err := api.GetGroup(ctx, GroupCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group.Name != "Group Zero" || len(group.Admins) != 1 || group.Admins[0].Email != "admin@example.com" || group.Admins[0].Settings.Language != "en" {
+		t.Errorf("Unexpected group %+v", group)
+	}
+
+	members, err := api.GetAccountMembers(ctx, GroupCode, []string{BobAccount})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || members[0].Name != "Bob" || members[0].Account.Id != BobAccount {
+		t.Fatalf("Unexpected members %+v", members)
+	}
+	members, err = api.GetGroupMembers(ctx, GroupCode)
+	if err != nil || len(members) != 2 {
+		t.Errorf("Unexpected group members %v, %v", members, err)
+	}
+
+	users, err := api.GetMemberUsers(ctx, BobMember)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Email != "bob@example.com" || users[0].Settings.Language != "ca" || users[0].Settings.Emails["myAccount"] != true {
+		t.Errorf("Unexpected users %+v", users)
+	}
+
+	ctx, err = api.NewContext(ctx, server.AccountingUrl())
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfer, err := api.GetTransfer(ctx, GroupCode, TransferId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transfer.Amount != 120000 || transfer.Payer.Code != "GRP00001" || transfer.Payee.Id != BobAccount || transfer.Currency.Symbol != "ℏ" {
+		t.Errorf("Unexpected transfer %+v", transfer)
+	}
+	account := new(api.Account)
+	if err := api.GetResourceUrl(ctx, members[0].Account.Href, account); err != nil || account.Currency == nil {
+		t.Errorf("Unexpected account %+v, %v", account, err)
+	}
+	if _, err := api.GetTransfer(ctx, GroupCode, "missing"); !errors.Is(err, api.ErrNotFound) {
+		t.Errorf("Expected not found error, got %v", err)
+	}
+
+	user, err := api.GetUserByToken(ctx, server.UserToken(AliceUser))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Id != AliceUser || len(user.Members) != 1 || user.Members[0].Id != AliceMember {
+		t.Errorf("Unexpected user %+v", user)
+	}
+	if _, err := api.GetUserByToken(ctx, AccessToken); !errors.Is(err, api.ErrUnauthorized) {
+		t.Errorf("Expected unauthorized error, got %v", err)
+	}
+
+	// A single token request is shared by all the API requests.
+	tokens := 0
+	for _, request := range server.Requests() {
+		if request == "POST /oauth2/token" {
+			tokens++
+		}
+	}
+	if tokens != 1 {
+		t.Errorf("Expected 1 token request, got %d", tokens)
+	}
+}
@@ -8,23 +8,23 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/context/ctxhttp"
+	"golang.org/x/sync/singleflight"
 
 	"github.com/komunitin/komunitin/notifications/config"
 )
 
-var (
-	accessToken       string
-	accessTokenExpiry time.Time
-)
-
 type tokenResponse struct {
 	AccessToken string        `json:"access_token"`
 	ExpiresIn   intFromString `json:"expires_in"`
@@ -32,6 +32,12 @@ type tokenResponse struct {
 	Scope       string        `json:"scope"`
 }
 
+// OAuth2 error response.
+type tokenErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
 type intFromString int64
 
 // Unmarshal expires_in both from string and from int.
@@ -51,40 +57,202 @@ func (expires *intFromString) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
-// Return the authorization token to call the social and accounting komunitin API.
-// This functions makes an HTTP call the first time is called, and then returns the
-// same cached results while they're still valid.
-func getAuthorizationToken(ctx context.Context) (string, error) {
-	// Return cached access token if it still has a minute of life.
-	if accessTokenExpiry.After(time.Now().Add(time.Minute)) {
-		return accessToken, nil
+type TokenSourceOptions struct {
+	// URL of the OAuth2 token endpoint.
+	TokenUrl     string
+	ClientId     string
+	ClientSecret string
+	Scopes       []string
+	// Optional audience of the requested tokens.
+	Audience string
+	// Tokens are refreshed in the background when they expire in less than this time.
+	RefreshBefore time.Duration
+}
+
+// Source of access tokens obtained with the client credentials flow. Tokens are
+// cached until they are about to expire and refreshed by a single request even if
+// many goroutines need a token at the same time. After a failed request, new requests
+// wait for refreshRetryDelay so a failing auth server is not flooded.
+type TokenSource struct {
+	options TokenSourceOptions
+	mutex   sync.Mutex
+	token   string
+	expiry  time.Time
+	// Whether a background refresh is in progress.
+	refreshing bool
+	// Error and time of the last failed request.
+	lastErr     error
+	lastFailure time.Time
+	group       singleflight.Group
+}
+
+func NewTokenSource(options TokenSourceOptions) *TokenSource {
+	return &TokenSource{options: options}
+}
+
+const (
+	// Tokens are not used if they expire in less than this time, since they could
+	// expire before reaching the API.
+	minTokenValidity = 10 * time.Second
+	// Timeout of the token requests, which are shared by all the waiting callers.
+	tokenRequestTimeout = time.Minute
+	// Minimum time between a failed token request and the next one.
+	refreshRetryDelay = 10 * time.Second
+)
+
+// Return a valid access token. If the cached token is about to expire, it is still
+// returned while a new one is requested in the background.
+func (source *TokenSource) Token(ctx context.Context) (string, error) {
+	source.mutex.Lock()
+	token, expiry := source.token, source.expiry
+	remaining := time.Until(expiry)
+	valid := token != "" && remaining > minTokenValidity
+	background := valid && remaining < source.options.RefreshBefore && !source.refreshing && source.canRetry()
+	if background {
+		source.refreshing = true
 	}
-	authUrl := fixUrl(config.KomunitinAuthUrl)
-	clientId := config.NotificationsClientId
-	clientSecret := config.NotificationsClientSecret
+	source.mutex.Unlock()
 
-	// Otherwise get a new one using client credentials from environment variables.
-	res, err := ctxhttp.PostForm(ctx, http.DefaultClient, authUrl+"/token", url.Values{
-		"grant_type":    []string{"client_credentials"},
-		"client_id":     []string{clientId},
-		"client_secret": []string{clientSecret},
-		"scope":         []string{"komunitin_social_read_all komunitin_accounting_read_all"},
+	if background {
+		go func() {
+			if _, err := source.refresh(context.Background()); err != nil {
+				log.Printf("Error refreshing access token: %v\n", err)
+			}
+			source.mutex.Lock()
+			source.refreshing = false
+			source.mutex.Unlock()
+		}()
+	}
+	if valid {
+		return token, nil
+	}
+	return source.refresh(ctx)
+}
+
+// Whether enough time has passed since the last failed request. Must be called with
+// the mutex held.
+func (source *TokenSource) canRetry() bool {
+	return time.Since(source.lastFailure) >= refreshRetryDelay
+}
+
+// Request a new token, sharing the request with concurrent callers. The request is
+// not canceled with the context of the caller that started it, since other callers
+// may be waiting for it, but each caller stops waiting when its context is done.
+func (source *TokenSource) refresh(ctx context.Context) (string, error) {
+	result := source.group.DoChan("token", func() (interface{}, error) {
+		source.mutex.Lock()
+		token, expiry := source.token, source.expiry
+		lastErr, retry := source.lastErr, source.canRetry()
+		source.mutex.Unlock()
+		// Another caller may have just refreshed the token.
+		if token != "" && time.Until(expiry) >= source.options.RefreshBefore {
+			return token, nil
+		}
+		if !retry {
+			return "", lastErr
+		}
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), tokenRequestTimeout)
+		defer cancel()
+		response, err := source.request(ctx)
+		source.mutex.Lock()
+		defer source.mutex.Unlock()
+		if err != nil {
+			source.lastErr = err
+			source.lastFailure = time.Now()
+			return "", err
+		}
+		source.lastErr = nil
+		source.lastFailure = time.Time{}
+		source.token = response.AccessToken
+		source.expiry = time.Now().Add(time.Duration(response.ExpiresIn) * time.Second)
+		return source.token, nil
 	})
-	if err != nil {
-		return "", err
+	select {
+	case res := <-result:
+		if res.Err != nil {
+			return "", res.Err
+		}
+		return res.Val.(string), nil
+	case <-ctx.Done():
+		return "", ctx.Err()
 	}
-	if res.StatusCode != http.StatusOK {
+}
 
-		resp, _ := httputil.DumpResponse(res, true)
-		return "", fmt.Errorf("error getting authorization token:%s\n%s\n%s\n%s", authUrl, clientId, clientSecret, resp)
+// Forget the cached token, for example because the API rejected it.
+func (source *TokenSource) Invalidate() {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+	source.token = ""
+	source.expiry = time.Time{}
+}
 
+func (source *TokenSource) request(ctx context.Context) (*tokenResponse, error) {
+	tokenUrl := fixUrl(source.options.TokenUrl)
+	values := url.Values{
+		"grant_type":    []string{"client_credentials"},
+		"client_id":     []string{source.options.ClientId},
+		"client_secret": []string{source.options.ClientSecret},
+		"scope":         []string{strings.Join(source.options.Scopes, " ")},
+	}
+	if source.options.Audience != "" {
+		values.Set("audience", source.options.Audience)
+	}
+	res, err := ctxhttp.PostForm(ctx, getClient().http, tokenUrl, values)
+	if err != nil {
+		// Errors from the http client include the URL but not the form values.
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		// Only report the OAuth2 error fields, never the request or the raw response.
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		oauthErr := tokenErrorResponse{}
+		_ = json.Unmarshal(body, &oauthErr)
+		msg := fmt.Sprintf("error getting authorization token from %s for client %s: %s %s %s",
+			tokenUrl, source.options.ClientId, res.Status, oauthErr.Error, oauthErr.ErrorDescription)
+		return nil, errors.New(source.redact(msg))
 	}
 	response := new(tokenResponse)
 	err = json.NewDecoder(res.Body).Decode(&response)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	accessToken = response.AccessToken
-	accessTokenExpiry = time.Now().Add(time.Duration(response.ExpiresIn) * time.Second)
-	return accessToken, nil
+	if response.AccessToken == "" {
+		return nil, fmt.Errorf("error getting authorization token from %s: empty token", tokenUrl)
+	}
+	return response, nil
+}
+
+// Remove the client secret from the given message, in case the auth server echoes it.
+func (source *TokenSource) redact(msg string) string {
+	if source.options.ClientSecret == "" {
+		return msg
+	}
+	return strings.ReplaceAll(msg, source.options.ClientSecret, "[redacted]")
+}
+
+var (
+	defaultTokenSource     *TokenSource
+	defaultTokenSourceOnce sync.Once
+)
+
+// Return the token source for the social and accounting komunitin API, configured on
+// first use.
+func getTokenSource() *TokenSource {
+	defaultTokenSourceOnce.Do(func() {
+		defaultTokenSource = NewTokenSource(TokenSourceOptions{
+			TokenUrl:      config.KomunitinAuthUrl + "/token",
+			ClientId:      config.NotificationsClientId,
+			ClientSecret:  config.NotificationsClientSecret,
+			Scopes:        strings.Fields(config.NotificationsClientScopes),
+			Audience:      config.NotificationsClientAudience,
+			RefreshBefore: time.Minute,
+		})
+	})
+	return defaultTokenSource
+}
+
+// Return the authorization token to call the social and accounting komunitin API.
+func getAuthorizationToken(ctx context.Context) (string, error) {
+	return getTokenSource().Token(ctx)
 }
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenSource(t *testing.T) {
+	var requests atomic.Int32
+	expiresIn := 3600
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		if r.FormValue("client_secret") != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, `{"error":"invalid_client","error_description":"Bad secret %s"}`, r.FormValue("client_secret"))
+			return
+		}
+		if r.FormValue("scope") != "a b" {
+			t.Errorf("Unexpected scope %q", r.FormValue("scope"))
+		}
+		time.Sleep(10 * time.Millisecond)
+		fmt.Fprintf(w, `{"access_token":"t%d","expires_in":"%d","token_type":"Bearer"}`, n, expiresIn)
+	}))
+	defer server.Close()
+	options := TokenSourceOptions{
+		TokenUrl:      server.URL,
+		ClientId:      "notifications",
+		ClientSecret:  "s3cret",
+		Scopes:        []string{"a", "b"},
+		RefreshBefore: time.Minute,
+	}
+	source := NewTokenSource(options)
+	ctx := context.Background()
+
+	// Concurrent callers share a single request.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if token, err := source.Token(ctx); err != nil || token != "t1" {
+				t.Errorf("Unexpected token %q, %v", token, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if requests.Load() != 1 {
+		t.Errorf("Expected 1 token request, got %d", requests.Load())
+	}
+
+	// Tokens about to expire are returned while refreshed in the background.
+	source.mutex.Lock()
+	source.expiry = time.Now().Add(30 * time.Second)
+	source.mutex.Unlock()
+	if token, _ := source.Token(ctx); token != "t1" {
+		t.Errorf("Expected current token, got %q", token)
+	}
+	deadline := time.Now().Add(time.Second)
+	for token, _ := source.Token(ctx); token != "t2"; token, _ = source.Token(ctx) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Token not refreshed, got %q", token)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Canceling the caller that started the request doesn't cancel it for the others.
+	source.Invalidate()
+	canceled, cancel := context.WithCancel(ctx)
+	go func() {
+		time.Sleep(2 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := source.Token(canceled); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected canceled error, got %v", err)
+	}
+	if token, err := source.Token(ctx); err != nil || token != "t3" {
+		t.Errorf("Unexpected token %q, %v", token, err)
+	}
+
+	// Errors don't include the client secret.
+	options.ClientSecret = "wrong-secret"
+	failing := NewTokenSource(options)
+	_, err := failing.Token(ctx)
+	if err == nil || strings.Contains(err.Error(), "wrong-secret") || !strings.Contains(err.Error(), "invalid_client") {
+		t.Errorf("Unexpected error %v", err)
+	}
+	// Failed requests are not retried right away.
+	before := requests.Load()
+	if _, err := failing.Token(ctx); err == nil || requests.Load() != before {
+		t.Errorf("Expected the last error without a new request, got %v after %d requests", err, requests.Load()-before)
+	}
+}
@@ -0,0 +1,135 @@
+package api
+
+// Opt-in cache of the resources fetched from the Komunitin APIs, enabled by setting
+// API_CACHE_TTL. Responses are kept in the store, so they are shared by all the
+// instances of the service when using Redis.
+//
+// Cached responses are used without revalidation during the TTL. After that, they
+// are revalidated with their ETag, if any, until API_CACHE_MAX_AGE. Events that change
+// resources invalidate the cached responses of the affected group and resource type
+// by calling InvalidateCache when they are received. Events handled again, either
+// because they are retried or replayed, don't invalidate the cache again. User
+// resources, such as the user settings, are not in a group and are never invalidated,
+// so changes to them take up to API_CACHE_TTL to be seen. The index sets used for
+// invalidation expire along with the cached responses.
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/komunitin/komunitin/notifications/config"
+	"github.com/komunitin/komunitin/notifications/store"
+)
+
+const cacheClass = "api-cache"
+
+type cacheEntry struct {
+	Url     string    `json:"url"`
+	Body    string    `json:"body"`
+	ETag    string    `json:"etag"`
+	Fetched time.Time `json:"fetched"`
+}
+
+var (
+	cache     store.Store
+	cacheErr  error
+	cacheOnce sync.Once
+)
+
+func cacheEnabled() bool {
+	return config.ApiCacheTtl > 0
+}
+
+func cacheStore() (store.Store, error) {
+	cacheOnce.Do(func() {
+		cache, cacheErr = store.NewStore()
+	})
+	return cache, cacheErr
+}
+
+// Return the scope of the cached responses for the given group code and resource type,
+// used to invalidate them. Resources not in a group are not invalidated.
+func cacheScope(code string, resourceType string) string {
+	if code == "" {
+		return ""
+	}
+	return code + "/" + resourceType
+}
+
+func fetchCached(ctx context.Context, url string, scope string) ([]byte, error) {
+	cache, err := cacheStore()
+	if err != nil {
+		return nil, err
+	}
+	entry := &cacheEntry{}
+	err = cache.Get(ctx, cacheClass, url, entry)
+	found := err == nil
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		log.Printf("Error reading API cache: %v\n", err)
+	}
+	if found && time.Since(entry.Fetched) < config.ApiCacheTtl {
+		return []byte(entry.Body), nil
+	}
+
+	etag := ""
+	if found {
+		etag = entry.ETag
+	}
+	res, err := fetchUrl(ctx, url, etag)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusNotModified && found:
+		entry.Fetched = time.Now()
+	case res.StatusCode == http.StatusOK:
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		entry = &cacheEntry{Url: url, Body: string(body), ETag: res.Header.Get("ETag"), Fetched: time.Now()}
+	default:
+		return nil, newStatusError(res)
+	}
+
+	var indexes map[string]string
+	if scope != "" {
+		indexes = map[string]string{"scope": scope}
+	}
+	err = cache.Set(ctx, cacheClass, url, entry, indexes, config.ApiCacheMaxAge)
+	if err != nil {
+		log.Printf("Error writing API cache: %v\n", err)
+	}
+	return []byte(entry.Body), nil
+}
+
+// Remove the cached responses for the given resource types of the group. The empty
+// resource type stands for the group itself.
+func InvalidateCache(ctx context.Context, code string, resourceTypes ...string) error {
+	if !cacheEnabled() {
+		return nil
+	}
+	cache, err := cacheStore()
+	if err != nil {
+		return err
+	}
+	for _, resourceType := range resourceTypes {
+		entries, err := cache.GetByIndex(ctx, cacheClass, reflect.TypeOf((*cacheEntry)(nil)), "scope", cacheScope(code, resourceType))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := cache.Delete(ctx, cacheClass, entry.(*cacheEntry).Url); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
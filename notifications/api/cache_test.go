@@ -0,0 +1,70 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/komunitin/komunitin/notifications/config"
+	"github.com/komunitin/komunitin/notifications/store"
+)
+
+func TestCache(t *testing.T) {
+	config.StoreBackend = store.MemoryBackend
+	store.ResetMemory()
+	tokenSource := getTokenSource()
+	tokenSource.token, tokenSource.expiry = "token", time.Now().Add(time.Hour)
+	defer tokenSource.Invalidate()
+	requests, conditional := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			conditional++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`{"data":{"type":"members","id":"m1","attributes":{"code":"GRP00001","name":"Member"}}}`))
+	}))
+	defer server.Close()
+	socialUrl := config.KomunitinSocialUrl
+	config.KomunitinSocialUrl = server.URL
+	defer func() { config.KomunitinSocialUrl = socialUrl }()
+	config.ApiCacheTtl = time.Hour
+	defer func() { config.ApiCacheTtl = 0 }()
+	ctx := context.Background()
+
+	get := func() {
+		member, err := GetMember(ctx, "GRP0", "m1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if member.Name != "Member" {
+			t.Errorf("Unexpected member %+v", member)
+		}
+	}
+	get()
+	get()
+	if requests != 1 {
+		t.Errorf("Expected 1 request, got %d", requests)
+	}
+
+	// Revalidate after the TTL.
+	config.ApiCacheTtl = time.Nanosecond
+	get()
+	if requests != 2 || conditional != 1 {
+		t.Errorf("Expected a conditional request, got %d requests and %d conditional", requests, conditional)
+	}
+
+	// Invalidation removes the cached response.
+	config.ApiCacheTtl = time.Hour
+	if err := InvalidateCache(ctx, "GRP0", "members"); err != nil {
+		t.Fatal(err)
+	}
+	get()
+	if requests != 3 || conditional != 1 {
+		t.Errorf("Expected an unconditional request, got %d requests and %d conditional", requests, conditional)
+	}
+}
@@ -0,0 +1,241 @@
+package api
+
+// HTTP client for the Komunitin social and accounting APIs.
+//
+// Requests time out, and those that fail with network errors, 5xx or 429 responses
+// are retried with exponential backoff and jitter, honoring the Retry-After header.
+// Each host has a circuit breaker, so requests to a host that keeps failing fail fast
+// for a while. Errors wrap ErrNotFound, ErrUnauthorized or ErrUnavailable so callers
+// can decide whether to retry later.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/komunitin/komunitin/notifications/breaker"
+	"github.com/komunitin/komunitin/notifications/config"
+)
+
+var (
+	// The resource doesn't exist.
+	ErrNotFound = errors.New("resource not found")
+	// The service credentials are not valid or not allowed to access the resource.
+	ErrUnauthorized = errors.New("unauthorized")
+	// The API can't be reached or fails, so the request may succeed later.
+	ErrUnavailable = errors.New("api unavailable")
+)
+
+// Error for an unexpected response status.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Url        string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("error fetching resource: %s %s", e.Status, e.Url)
+}
+
+// Return the typed error for the status, if any.
+func (e *StatusError) Unwrap() error {
+	switch {
+	case e.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden:
+		return ErrUnauthorized
+	case retryableStatus(e.StatusCode):
+		return ErrUnavailable
+	}
+	return nil
+}
+
+func newStatusError(res *http.Response) error {
+	return &StatusError{StatusCode: res.StatusCode, Status: res.Status, Url: res.Request.URL.String()}
+}
+
+func retryableStatus(status int) bool {
+	return status >= 500 || status == http.StatusTooManyRequests
+}
+
+type ClientOptions struct {
+	// Timeout of each request attempt.
+	Timeout time.Duration
+	// Number of retries after the first attempt.
+	MaxRetries int
+	// Delay before the first retry. It doubles at each retry up to MaxRetryDelay.
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	// Requests to a host are rejected for BreakerCooldown after BreakerThreshold
+	// consecutive failures.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+type Client struct {
+	http     *http.Client
+	options  ClientOptions
+	mutex    sync.Mutex
+	breakers map[string]*breaker.Breaker
+}
+
+func NewClient(options ClientOptions) *Client {
+	return &Client{
+		http:     &http.Client{Timeout: options.Timeout},
+		options:  options,
+		breakers: map[string]*breaker.Breaker{},
+	}
+}
+
+var (
+	defaultClient     *Client
+	defaultClientOnce sync.Once
+)
+
+// Return the client configured with the API_* settings.
+func getClient() *Client {
+	defaultClientOnce.Do(func() {
+		defaultClient = NewClient(ClientOptions{
+			Timeout:          config.ApiTimeout,
+			MaxRetries:       config.ApiMaxRetries,
+			RetryDelay:       config.ApiRetryDelay,
+			MaxRetryDelay:    config.ApiMaxRetryDelay,
+			BreakerThreshold: config.ApiBreakerThreshold,
+			BreakerCooldown:  config.ApiBreakerCooldown,
+		})
+	})
+	return defaultClient
+}
+
+// Return the circuit breaker health of each API host, for the health endpoint.
+func ClientHealth() map[string]breaker.Health {
+	return getClient().Health()
+}
+
+func (client *Client) breaker(host string) *breaker.Breaker {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	b := client.breakers[host]
+	if b == nil {
+		b = breaker.New(client.options.BreakerThreshold, client.options.BreakerCooldown)
+		client.breakers[host] = b
+	}
+	return b
+}
+
+// Return the circuit breaker health of each host.
+func (client *Client) Health() map[string]breaker.Health {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	health := make(map[string]breaker.Health, len(client.breakers))
+	for host, b := range client.breakers {
+		health[host] = b.Health()
+	}
+	return health
+}
+
+// Send a GET request to the given URL with the given headers. Returns the response if
+// its status is not retryable, otherwise an error. The caller must close the body of
+// the returned response. The retries of a request count as a single success or
+// failure for the circuit breaker of the host.
+func (client *Client) Get(ctx context.Context, url string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	b := client.breaker(req.URL.Host)
+	if !b.Allow() {
+		return nil, fmt.Errorf("%w: %s: %w", ErrUnavailable, req.URL.Host, breaker.ErrOpen)
+	}
+	res, err := client.get(ctx, url, header)
+	var statusErr *StatusError
+	switch {
+	case err == nil || ctx.Err() != nil:
+		// Canceled requests are not the host fault.
+		b.Success()
+	case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusTooManyRequests:
+		// The host is up but throttling us.
+		b.Success()
+	default:
+		b.Failure(err)
+	}
+	return res, err
+}
+
+// Send the request, retrying it if it fails with a retryable error.
+func (client *Client) get(ctx context.Context, url string, header http.Header) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+
+		res, err := client.http.Do(req)
+		retryAfter := time.Duration(0)
+		switch {
+		case err != nil:
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			err = fmt.Errorf("%w: %w", ErrUnavailable, err)
+		case retryableStatus(res.StatusCode):
+			retryAfter = parseRetryAfter(res.Header.Get("Retry-After"))
+			// Drain the body so the connection can be reused.
+			_, _ = io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+			err = newStatusError(res)
+		default:
+			return res, nil
+		}
+
+		if attempt >= client.options.MaxRetries {
+			return nil, err
+		}
+		delay := client.retryDelay(attempt)
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		if delay > client.options.MaxRetryDelay {
+			// Don't wait that long, the caller will retry later.
+			return nil, err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Return the delay before the given retry, with exponential backoff and jitter so
+// clients don't retry at the same time.
+func (client *Client) retryDelay(attempt int) time.Duration {
+	delay := client.options.RetryDelay << attempt
+	if delay <= 0 || delay > client.options.MaxRetryDelay {
+		delay = client.options.MaxRetryDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Parse the Retry-After header, either in seconds or as an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
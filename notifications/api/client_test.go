@@ -0,0 +1,115 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/komunitin/komunitin/notifications/breaker"
+)
+
+func TestClientRetries(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch requests {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer server.Close()
+	client := NewClient(ClientOptions{
+		Timeout:          time.Second,
+		MaxRetries:       2,
+		RetryDelay:       time.Millisecond,
+		MaxRetryDelay:    10 * time.Millisecond,
+		BreakerThreshold: 5,
+		BreakerCooldown:  time.Minute,
+	})
+	res, err := client.Get(context.Background(), server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || requests != 3 {
+		t.Errorf("Expected 200 after 3 requests, got %d after %d", res.StatusCode, requests)
+	}
+}
+
+func TestClientBreaker(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	client := NewClient(ClientOptions{
+		Timeout:          time.Second,
+		MaxRetries:       0,
+		BreakerThreshold: 2,
+		BreakerCooldown:  time.Minute,
+	})
+	for i := 0; i < 3; i++ {
+		_, err := client.Get(context.Background(), server.URL, nil)
+		if !errors.Is(err, ErrUnavailable) {
+			t.Errorf("Expected unavailable error, got %v", err)
+		}
+		if i == 2 && !errors.Is(err, breaker.ErrOpen) {
+			t.Errorf("Expected open breaker error, got %v", err)
+		}
+	}
+	if requests != 2 {
+		t.Errorf("Expected 2 requests, got %d", requests)
+	}
+}
+
+func TestClientBreakerRetries(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+	client := NewClient(ClientOptions{
+		Timeout:          time.Second,
+		MaxRetries:       2,
+		RetryDelay:       time.Millisecond,
+		MaxRetryDelay:    10 * time.Millisecond,
+		BreakerThreshold: 2,
+		BreakerCooldown:  time.Minute,
+	})
+	// The retries of a request count as a single failure.
+	if _, err := client.Get(context.Background(), server.URL, nil); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Expected unavailable error, got %v", err)
+	}
+	for host, health := range client.Health() {
+		if health.Failures != 1 || health.State != breaker.Closed {
+			t.Errorf("Unexpected health of %s: %+v", host, health)
+		}
+	}
+	if requests != 3 {
+		t.Errorf("Expected 3 requests, got %d", requests)
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	for status, expected := range map[int]error{
+		http.StatusNotFound:     ErrNotFound,
+		http.StatusUnauthorized: ErrUnauthorized,
+		http.StatusForbidden:    ErrUnauthorized,
+		http.StatusBadGateway:   ErrUnavailable,
+	} {
+		err := error(&StatusError{StatusCode: status, Status: http.StatusText(status), Url: "http://example.com"})
+		if !errors.Is(err, expected) {
+			t.Errorf("Expected %d to be %v", status, expected)
+		}
+	}
+}
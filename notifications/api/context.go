@@ -9,16 +9,21 @@ import (
 // (for groups in the new Accounting service and groups still in IntegralCES).
 // The idea is to save the URL in the context from the "source" field of the event.
 // The delicate part is that the api method accessing the URL cant be sure that the
-// event indeed originated from the accounting service.
+// event indeed originated from the accounting service, so the URL is checked against
+// the trusted sources both when creating the context and when reading it, since the
+// service access token is sent there.
 
 type key int
 
 var baseUrlKey key
 
 // Create a new context with the baseUrl value from the Source field of the event.
-// This URL is used to fetch related event resources.
+// This URL is used to fetch related event resources. Returns an error wrapping
+// ErrUntrustedSource if it is not a trusted accounting service.
 func NewContext(ctx context.Context, baseUrl string) (context.Context, error) {
-	// Add includes to the user URL
+	if err := CheckSource(baseUrl); err != nil {
+		return nil, err
+	}
 	return context.WithValue(ctx, baseUrlKey, baseUrl), nil
 }
 
@@ -28,5 +33,8 @@ func GetBaseUrlFromContext(ctx context.Context) (string, error) {
 	if !ok {
 		return "", fmt.Errorf("baseUrl not found in context")
 	}
+	if err := CheckSource(baseUrl); err != nil {
+		return "", err
+	}
 	return baseUrl, nil
 }
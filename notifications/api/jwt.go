@@ -0,0 +1,132 @@
+package api
+
+// Local validation of the access tokens issued by the Komunitin auth server, which are
+// JWTs signed with the keys published in its JWKS. It saves a request to the social
+// API for each authenticated request.
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MicahParks/keyfunc"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/komunitin/komunitin/notifications/config"
+)
+
+// Returned by ValidateToken when the token can't be validated locally, either because
+// the JWKS is not configured or not reachable or because the token is not a JWT. The
+// token has then to be checked by the social API.
+var ErrLocalValidationUnavailable = errors.New("local token validation unavailable")
+
+// Claims of the access tokens.
+type TokenClaims struct {
+	jwt.RegisteredClaims
+	Scope string `json:"scope,omitempty"`
+	// Ids of the members of the user. Not all tokens have this claim.
+	Members []string `json:"members,omitempty"`
+}
+
+// Return the user with the id and members in the claims. If the claims don't include
+// the members, the user has no Members.
+func (claims *TokenClaims) User() *User {
+	user := &User{Id: claims.Subject}
+	if claims.Members != nil {
+		user.Members = make([]*Member, len(claims.Members))
+		for i, id := range claims.Members {
+			user.Members[i] = &Member{Id: id}
+		}
+	}
+	return user
+}
+
+var (
+	jwks         *keyfunc.JWKS
+	jwksMutex    sync.Mutex
+	jwksFailedAt time.Time
+)
+
+// Minimum time between attempts to get the JWKS after a failure.
+const jwksRetryInterval = time.Minute
+
+// Return the JWKS from the configured URL, getting it on the first call. The keys are
+// refreshed periodically and when a token is signed with an unknown key, so they can
+// be rotated by the auth server.
+func getJwks() (*keyfunc.JWKS, error) {
+	jwksMutex.Lock()
+	defer jwksMutex.Unlock()
+	if jwks != nil {
+		return jwks, nil
+	}
+	if config.AuthJwksUrl == "" || time.Since(jwksFailedAt) < jwksRetryInterval {
+		return nil, ErrLocalValidationUnavailable
+	}
+	var err error
+	jwks, err = keyfunc.Get(fixUrl(config.AuthJwksUrl), keyfunc.Options{
+		RefreshInterval:   time.Hour,
+		RefreshRateLimit:  5 * time.Minute,
+		RefreshTimeout:    10 * time.Second,
+		RefreshUnknownKID: true,
+		RefreshErrorHandler: func(err error) {
+			log.Printf("Error refreshing JWKS: %v\n", err)
+		},
+	})
+	if err != nil {
+		jwks = nil
+		jwksFailedAt = time.Now()
+		log.Printf("Error getting JWKS from %s: %v\n", config.AuthJwksUrl, err)
+		return nil, ErrLocalValidationUnavailable
+	}
+	return jwks, nil
+}
+
+// Validate the signature, expiration, issuer and audience of the given access token
+// and return its claims.
+func ValidateToken(token string) (*TokenClaims, error) {
+	// Opaque tokens are not JWTs.
+	if strings.Count(token, ".") != 2 {
+		return nil, ErrLocalValidationUnavailable
+	}
+	keys, err := getJwks()
+	if err != nil {
+		return nil, err
+	}
+	claims := &TokenClaims{}
+	_, err = jwt.ParseWithClaims(token, claims, keys.Keyfunc, jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "EdDSA"}))
+	if err != nil {
+		return nil, err
+	}
+	if config.AuthJwtIssuer != "" && !validIssuer(claims.Issuer) {
+		return nil, fmt.Errorf("invalid token issuer %q", claims.Issuer)
+	}
+	audienceOk := false
+	for _, audience := range strings.Split(config.AuthJwtAudience, ",") {
+		if claims.VerifyAudience(strings.TrimSpace(audience), true) {
+			audienceOk = true
+		}
+	}
+	if !audienceOk {
+		return nil, fmt.Errorf("invalid token audience %v", claims.Audience)
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("missing token subject")
+	}
+	return claims, nil
+}
+
+var languagePattern = regexp.MustCompile(`^[a-z]{2,3}([-_][a-zA-Z0-9]+)?$`)
+
+// Check that the issuer is the configured one, optionally followed by "/<lang>" since
+// IntegralCES appends the language code to the issuer claim.
+func validIssuer(issuer string) bool {
+	if issuer == config.AuthJwtIssuer {
+		return true
+	}
+	base := strings.TrimSuffix(config.AuthJwtIssuer, "/") + "/"
+	lang, ok := strings.CutPrefix(issuer, base)
+	return ok && languagePattern.MatchString(lang)
+}
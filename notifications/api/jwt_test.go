@@ -0,0 +1,89 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/komunitin/komunitin/notifications/config"
+)
+
+func TestValidateToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := base64.RawURLEncoding.EncodeToString
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"keys":[{"kty":"RSA","kid":"k1","alg":"RS256","use":"sig","n":%q,"e":%q}]}`,
+			encode(key.N.Bytes()), encode(big.NewInt(int64(key.E)).Bytes()))
+	}))
+	defer server.Close()
+	config.AuthJwksUrl = server.URL
+	config.AuthJwtIssuer = "https://auth.example.com"
+	config.AuthJwtAudience = "komunitin-app,komunitin-notifications"
+
+	sign := func(claims *TokenClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "k1"
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	valid := func() *TokenClaims {
+		return &TokenClaims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Subject:   "u1",
+				Issuer:    "https://auth.example.com/ca",
+				Audience:  jwt.ClaimStrings{"komunitin-app"},
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			},
+			Members: []string{"m1"},
+		}
+	}
+
+	claims, err := ValidateToken(sign(valid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exactIssuer := valid()
+	exactIssuer.Issuer = "https://auth.example.com"
+	if _, err := ValidateToken(sign(exactIssuer)); err != nil {
+		t.Errorf("Expected token without language to be valid, got %v", err)
+	}
+	user := claims.User()
+	if user.Id != "u1" || len(user.Members) != 1 || user.Members[0].Id != "m1" {
+		t.Errorf("Unexpected user %+v", user)
+	}
+
+	expired := valid()
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+	otherAudience := valid()
+	otherAudience.Audience = jwt.ClaimStrings{"other"}
+	otherIssuer := valid()
+	otherIssuer.Issuer = "https://evil.example.com"
+	prefixedIssuer := valid()
+	prefixedIssuer.Issuer = "https://auth.example.com.evil"
+	pathIssuer := valid()
+	pathIssuer.Issuer = "https://auth.example.com/ca/evil"
+	for name, claims := range map[string]*TokenClaims{"expired": expired, "audience": otherAudience, "issuer": otherIssuer,
+		"prefixed issuer": prefixedIssuer, "issuer path": pathIssuer} {
+		if _, err := ValidateToken(sign(claims)); err == nil || errors.Is(err, ErrLocalValidationUnavailable) {
+			t.Errorf("Expected %s token to be rejected, got %v", name, err)
+		}
+	}
+
+	if _, err := ValidateToken("opaque-token"); !errors.Is(err, ErrLocalValidationUnavailable) {
+		t.Errorf("Expected opaque token to be unavailable for local validation, got %v", err)
+	}
+}
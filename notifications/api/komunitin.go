@@ -1,15 +1,15 @@
 package api
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"reflect"
 	"strings"
 
-	"golang.org/x/net/context/ctxhttp"
-
 	"github.com/komunitin/jsonapi"
 	"github.com/komunitin/komunitin/notifications/config"
 )
@@ -20,23 +20,45 @@ func fixUrl(url string) string {
 	return url
 }
 
-// TODO make that check errors and add an opt-in cache layer!
-func fetchUrl(ctx context.Context, url string) (*http.Response, error) {
+// Fetch the given URL with the service access token. If etag is not empty, the
+// request is conditional and the response may be 304 Not Modified.
+func fetchUrl(ctx context.Context, url string, etag string) (*http.Response, error) {
 	token, err := getAuthorizationToken(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return fetchResource(ctx, url, token)
+	res, err := fetchResource(ctx, url, token, etag)
+	if err == nil && res.StatusCode == http.StatusUnauthorized {
+		// The token may have been revoked, get a new one next time.
+		getTokenSource().Invalidate()
+	}
+	return res, err
+}
+
+func fetchResource(ctx context.Context, url string, token string, etag string) (*http.Response, error) {
+	header := http.Header{}
+	header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	if etag != "" {
+		header.Set("If-None-Match", etag)
+	}
+	return getClient().Get(ctx, fixUrl(url), header)
 }
 
-func fetchResource(ctx context.Context, url string, token string) (*http.Response, error) {
-	url = fixUrl(url)
-	req, err := http.NewRequest("GET", url, nil)
+// Return the body of the resource at the given URL, from the cache if it is enabled.
+// The scope identifies the cached resources to invalidate on events (see cache.go).
+func fetchBody(ctx context.Context, url string, scope string) ([]byte, error) {
+	if cacheEnabled() {
+		return fetchCached(ctx, url, scope)
+	}
+	res, err := fetchUrl(ctx, url, "")
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
-	return ctxhttp.Do(ctx, http.DefaultClient, req)
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, newStatusError(res)
+	}
+	return io.ReadAll(res.Body)
 }
 
 // Fetch the user object from the social API using the provided token.
@@ -45,12 +67,13 @@ func fetchResource(ctx context.Context, url string, token string) (*http.Respons
 // Uses the social API url as defined in the configuration.
 func GetUserByToken(ctx context.Context, token string) (*User, error) {
 	url := config.KomunitinSocialUrl + "/users/me"
-	res, err := fetchResource(ctx, url, token)
+	res, err := fetchResource(ctx, url, token, "")
 	if err != nil {
 		return nil, err
 	}
+	defer res.Body.Close()
 	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("error fetching user: %s", res.Status)
+		return nil, fmt.Errorf("error fetching user: %w", newStatusError(res))
 	}
 	user := new(User)
 	err = jsonapi.UnmarshalPayload(res.Body, user)
@@ -112,6 +135,26 @@ func GetMemberUsers(ctx context.Context, memberId string) ([]*User, error) {
 	return users, nil
 }
 
+// Maximum number of ids in a single filter query parameter.
+const maxFilterIds = 50
+
+// Get all users associated with any of the given members, with their members
+// relationship so they can be matched to the members.
+func GetMembersUsers(ctx context.Context, memberIds []string) ([]*User, error) {
+	users := make([]*User, 0)
+	for i := 0; i < len(memberIds); i += maxFilterIds {
+		end := min(i+maxFilterIds, len(memberIds))
+		result, err := getResources(ctx, config.KomunitinSocialUrl, "", "users", reflect.TypeOf((*User)(nil)), nil, map[string][]string{"members": memberIds[i:end]}, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range result {
+			users = append(users, user.(*User))
+		}
+	}
+	return users, nil
+}
+
 // Get a member object
 func GetMember(ctx context.Context, code string, memberId string) (*Member, error) {
 	member := new(Member)
@@ -198,7 +241,7 @@ func getResource(ctx context.Context, baseUrl string, code string, resourceType
 	if len(query) > 0 {
 		url += "?" + strings.Join(query, "&")
 	}
-	return GetResourceUrl(ctx, url, model)
+	return getResourceUrl(ctx, url, cacheScope(code, resourceType), model)
 }
 
 // The model parameter must be a pointer to the struct that will hold the resource data.
@@ -206,14 +249,15 @@ func getResource(ctx context.Context, baseUrl string, code string, resourceType
 //	user := new(User)
 //	err := GetResourceUrl(ctx, "https://social.komunitin.org/users/1", user)
 func GetResourceUrl(ctx context.Context, url string, model any) error {
-	res, err := fetchUrl(ctx, url)
+	return getResourceUrl(ctx, url, "", model)
+}
+
+func getResourceUrl(ctx context.Context, url string, scope string, model any) error {
+	body, err := fetchBody(ctx, url, scope)
 	if err != nil {
 		return err
 	}
-	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("error fetching resource: %s %s", res.Status, url)
-	}
-	return jsonapi.UnmarshalPayload(res.Body, model)
+	return jsonapi.UnmarshalPayload(bytes.NewReader(body), model)
 }
 
 func getResources(ctx context.Context, baseUrl string, code string, resourceType string, modelType reflect.Type, include []string, filter map[string][]string, fields map[string][]string) ([]any, error) {
@@ -233,14 +277,11 @@ func getResources(ctx context.Context, baseUrl string, code string, resourceType
 	resources := make([]any, 0)
 	for url != "" {
 		// Network request
-		res, err := fetchUrl(ctx, url)
+		body, err := fetchBody(ctx, url, cacheScope(code, resourceType))
 		if err != nil {
-			return nil, err
-		}
-		if res.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf("error fetching resources of type %s: %s\nURL: %s", resourceType, res.Status, url)
+			return nil, fmt.Errorf("error fetching resources of type %s: %w", resourceType, err)
 		}
-		page, extras, err := jsonapi.UnmarshalManyPayload(res.Body, modelType)
+		page, extras, err := jsonapi.UnmarshalManyPayload(bytes.NewReader(body), modelType)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,57 @@
+package api
+
+// Accounting services trusted as event sources. The source of each event is used as the
+// base URL of the accounting API to fetch the event resources with the service access
+// token, so it must be one of the configured accounting services: KOMUNITIN_ACCOUNTING_URL
+// and the ones in EVENTS_TRUSTED_SOURCES (for example the IntegralCES accounting API).
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/komunitin/komunitin/notifications/config"
+)
+
+// The event source is not a trusted accounting service.
+var ErrUntrustedSource = errors.New("untrusted event source")
+
+// Return the canonical form of the given base URL, so equivalent URLs can be compared,
+// or false if it is not a valid base URL.
+func normalizeSource(source string) (string, bool) {
+	u, err := url.Parse(strings.TrimSpace(source))
+	if err != nil || u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return "", false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if scheme != "http" && scheme != "https" {
+		return "", false
+	}
+	return scheme + "://" + strings.ToLower(u.Host) + strings.TrimRight(u.EscapedPath(), "/"), true
+}
+
+// Return the base URLs of the trusted accounting services.
+func TrustedSources() []string {
+	sources := []string{}
+	for _, source := range append([]string{config.KomunitinAccountingUrl}, strings.Split(config.EventsTrustedSources, ",")...) {
+		if source = strings.TrimSpace(source); source != "" {
+			sources = append(sources, source)
+		}
+	}
+	return sources
+}
+
+// Return an error wrapping ErrUntrustedSource if the given source is not the base URL
+// of a trusted accounting service.
+func CheckSource(source string) error {
+	normalized, ok := normalizeSource(source)
+	if ok {
+		for _, trusted := range TrustedSources() {
+			if t, valid := normalizeSource(trusted); valid && t == normalized {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: %q", ErrUntrustedSource, source)
+}
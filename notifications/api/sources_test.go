@@ -0,0 +1,61 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/komunitin/komunitin/notifications/config"
+)
+
+func TestCheckSource(t *testing.T) {
+	config.KomunitinAccountingUrl = "http://accounting:2025"
+	config.EventsTrustedSources = "https://IntegralCES.net/ces/api/accounting/ , "
+	defer func() {
+		config.KomunitinAccountingUrl = ""
+		config.EventsTrustedSources = ""
+	}()
+
+	trusted := []string{
+		"http://accounting:2025",
+		"http://accounting:2025/",
+		"https://integralces.net/ces/api/accounting",
+	}
+	for _, source := range trusted {
+		if err := CheckSource(source); err != nil {
+			t.Errorf("Expected %s to be trusted, got %v", source, err)
+		}
+	}
+	untrusted := []string{
+		"",
+		"http://attacker:2025",
+		"https://accounting:2025",
+		"http://accounting:2025.attacker.com",
+		"http://user@accounting:2025",
+		"http://accounting:2025?x=1",
+		"https://integralces.net/ces/api",
+		"https://integralces.net/ces/api/accounting/other",
+	}
+	for _, source := range untrusted {
+		if err := CheckSource(source); !errors.Is(err, ErrUntrustedSource) {
+			t.Errorf("Expected %s to be untrusted, got %v", source, err)
+		}
+	}
+
+	if _, err := NewContext(context.Background(), "http://attacker:2025"); !errors.Is(err, ErrUntrustedSource) {
+		t.Errorf("Expected untrusted source error, got %v", err)
+	}
+	ctx, err := NewContext(context.Background(), "http://accounting:2025")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if baseUrl, err := GetBaseUrlFromContext(ctx); err != nil || baseUrl != "http://accounting:2025" {
+		t.Errorf("Unexpected base URL %s, %v", baseUrl, err)
+	}
+	// Sources are checked when used, so removing one from the configuration stops
+	// requests to it.
+	config.KomunitinAccountingUrl = ""
+	if _, err := GetBaseUrlFromContext(ctx); !errors.Is(err, ErrUntrustedSource) {
+		t.Errorf("Expected untrusted source error, got %v", err)
+	}
+}
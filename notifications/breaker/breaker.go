@@ -0,0 +1,145 @@
+package breaker
+
+// Implements a circuit breaker that stops calling a failing dependency for a while,
+// giving it time to recover and avoiding waiting for requests that will likely fail.
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+type State int
+
+const (
+	// Requests are allowed.
+	Closed State = iota
+	// Requests are rejected until the cooldown period ends.
+	Open
+	// A single trial request is allowed to check whether the dependency recovered.
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+var ErrOpen = errors.New("circuit breaker is open")
+
+// Health statistics of the dependency protected by a breaker.
+type Health struct {
+	State               State
+	Successes           int64
+	Failures            int64
+	ConsecutiveFailures int
+	LastError           error
+	LastFailure         time.Time
+}
+
+// Encode the health as JSON for health endpoints. The last error message is left out
+// since it may contain internal details.
+func (h Health) MarshalJSON() ([]byte, error) {
+	health := struct {
+		State               string     `json:"state"`
+		Successes           int64      `json:"successes"`
+		Failures            int64      `json:"failures"`
+		ConsecutiveFailures int        `json:"consecutiveFailures"`
+		LastFailure         *time.Time `json:"lastFailure,omitempty"`
+	}{
+		State:               h.State.String(),
+		Successes:           h.Successes,
+		Failures:            h.Failures,
+		ConsecutiveFailures: h.ConsecutiveFailures,
+	}
+	if !h.LastFailure.IsZero() {
+		health.LastFailure = &h.LastFailure
+	}
+	return json.Marshal(health)
+}
+
+type Breaker struct {
+	mu sync.Mutex
+	// Number of consecutive failures that open the circuit.
+	threshold int
+	// Time the circuit stays open before allowing a trial request.
+	cooldown time.Duration
+	openedAt time.Time
+	// Whether the trial request of the half-open state is in progress.
+	trial  bool
+	health Health
+}
+
+func New(threshold int, cooldown time.Duration) *Breaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Check whether a request can be done now. If it returns true, the caller must
+// report the result using Success or Failure.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.health.State {
+	case Open:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.health.State = HalfOpen
+		b.trial = true
+		return true
+	case HalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	}
+	return true
+}
+
+// Report a successful request, closing the circuit.
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.health.Successes++
+	b.health.ConsecutiveFailures = 0
+	b.health.State = Closed
+	b.trial = false
+}
+
+// Report a failed request. The circuit opens after too many consecutive failures
+// or if the trial request fails.
+func (b *Breaker) Failure(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.health.Failures++
+	b.health.ConsecutiveFailures++
+	b.health.LastError = err
+	b.health.LastFailure = time.Now()
+	if b.health.State == HalfOpen || b.health.ConsecutiveFailures >= b.threshold {
+		b.health.State = Open
+		b.openedAt = time.Now()
+	}
+	b.trial = false
+}
+
+// Return the current state and statistics.
+func (b *Breaker) Health() Health {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.health
+}
@@ -0,0 +1,62 @@
+package breaker
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	b := New(2, 50*time.Millisecond)
+	fail := errors.New("unavailable")
+
+	if !b.Allow() {
+		t.Fatal("Closed breaker must allow requests")
+	}
+	b.Failure(fail)
+	if !b.Allow() {
+		t.Fatal("Breaker must stay closed below threshold")
+	}
+	b.Failure(fail)
+	if b.Health().State != Open || b.Allow() {
+		t.Fatal("Breaker must open after 2 consecutive failures")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("Breaker must allow a trial request after cooldown")
+	}
+	if b.Allow() {
+		t.Fatal("Breaker must allow a single trial request")
+	}
+	b.Failure(fail)
+	if b.Health().State != Open {
+		t.Fatal("Breaker must open again if the trial request fails")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	b.Allow()
+	b.Success()
+	health := b.Health()
+	if health.State != Closed || health.Successes != 1 || health.Failures != 3 || health.LastError != fail {
+		t.Errorf("Unexpected health %+v", health)
+	}
+}
+
+func TestHealthJSON(t *testing.T) {
+	b := New(1, time.Minute)
+	b.Allow()
+	b.Failure(errors.New("dial tcp 10.0.0.1:587: connection refused"))
+	data, err := json.Marshal(b.Health())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"state":"open","successes":0,"failures":1,"consecutiveFailures":1,"lastFailure":`) {
+		t.Errorf("Unexpected health JSON %s", data)
+	}
+	if strings.Contains(string(data), "10.0.0.1") {
+		t.Errorf("Health JSON must not include the error %s", data)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+// Administrative commands, run as `main <command>` instead of starting the service.
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/komunitin/komunitin/notifications/events"
+	"github.com/komunitin/komunitin/notifications/mails"
+	"github.com/komunitin/komunitin/notifications/store"
+)
+
+func runCommand(ctx context.Context, args []string) error {
+	switch args[0] {
+	case "repair-indexes":
+		s, err := store.NewStore()
+		if err != nil {
+			return err
+		}
+		pruned, err := s.RepairIndexes(ctx)
+		if err != nil {
+			return err
+		}
+		log.Printf("Pruned %d orphaned index members.\n", pruned)
+		return nil
+	case "replay-events":
+		var options events.ReplayOptions
+		flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+		flags.StringVar(&options.From, "from", "", "first event to replay, as stream id or RFC3339 time")
+		flags.StringVar(&options.To, "to", "", "last event to replay, as stream id or RFC3339 time")
+		flags.StringVar(&options.Target, "target", "", "consumer of the replayed events: mailer or notifier (default both)")
+		flags.BoolVar(&options.DryRun, "dry-run", false, "log the notifications instead of sending them")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		stream, err := events.NewEventsStream(ctx, "")
+		if err != nil {
+			return err
+		}
+		replayed, err := stream.Replay(ctx, options)
+		if err != nil {
+			return err
+		}
+		log.Printf("Replayed %d events.\n", replayed)
+		return nil
+	case "email-status":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: %s <email id>", args[0])
+		}
+		outbox, err := mails.NewOutbox(ctx)
+		if err != nil {
+			return err
+		}
+		email, err := outbox.Get(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		log.Printf("Email %s to %s: %s after %d attempts, updated %s. Message id: %q. Error: %q.\n",
+			email.Id, email.Email.To[0].Email, email.Status, email.Attempts, email.Updated.Format(time.RFC3339), email.MessageId, email.Error)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %s", args[0])
+	}
+}
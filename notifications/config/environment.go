@@ -1,6 +1,11 @@
 package config
 
-import "os"
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
 
 // Thes environment variables are set in the docker-compose.yml file.
 var (
@@ -8,9 +13,169 @@ var (
 	NotificationsClientSecret   = os.Getenv("NOTIFICATIONS_CLIENT_SECRET")
 	KomunitinAuthUrl            = os.Getenv("KOMUNITIN_AUTH_URL")
 	KomunitinSocialUrl          = os.Getenv("KOMUNITIN_SOCIAL_URL")
+	KomunitinAccountingUrl      = os.Getenv("KOMUNITIN_ACCOUNTING_URL")
 	KomunitinAppUrl             = os.Getenv("KOMUNITIN_APP_URL")
 	NotificationsEventsUsername = os.Getenv("NOTIFICATIONS_EVENTS_USERNAME")
 	NotificationsEventsPassword = os.Getenv("NOTIFICATIONS_EVENTS_PASSWORD")
 	MailersendApiKey            = os.Getenv("MAILERSEND_API_KEY")
 	SendMails                   = os.Getenv("SEND_MAILS")
+	// Mail provider used when SendMails is true: "mailersend" (default) or "smtp". It
+	// may be a comma-separated list of providers to be tried in order.
+	MailSender = os.Getenv("MAIL_SENDER")
+	// SMTP server settings.
+	SmtpHost     = os.Getenv("SMTP_HOST")
+	SmtpUsername = os.Getenv("SMTP_USERNAME")
+	SmtpPassword = os.Getenv("SMTP_PASSWORD")
+	// "plain" or "login".
+	SmtpAuth = os.Getenv("SMTP_AUTH")
+	// "starttls", "tls" or "none".
+	SmtpSecurity = os.Getenv("SMTP_SECURITY")
+	// Optional DKIM signing with the PEM private key in the given file.
+	DkimDomain         = os.Getenv("DKIM_DOMAIN")
+	DkimSelector       = os.Getenv("DKIM_SELECTOR")
+	DkimPrivateKeyFile = os.Getenv("DKIM_PRIVATE_KEY_FILE")
+	// VAPID key pair for Web Push. The public key must be configured in the app.
+	VapidPrivateKey = os.Getenv("VAPID_PRIVATE_KEY")
+	VapidSubject    = os.Getenv("VAPID_SUBJECT")
+	// Storage backend: "redis" (default) or "memory" to keep all data in the process,
+	// for tests and single-node development.
+	StoreBackend = os.Getenv("STORE_BACKEND")
+	// Redis credentials. They override the ones in RedisUrl, if any.
+	RedisUsername = os.Getenv("REDIS_USERNAME")
+	RedisPassword = os.Getenv("REDIS_PASSWORD")
+	// Comma-separated Sentinel addresses and master name to use Redis Sentinel.
+	RedisSentinelAddrs    = os.Getenv("REDIS_SENTINEL_ADDRS")
+	RedisSentinelMaster   = os.Getenv("REDIS_SENTINEL_MASTER")
+	RedisSentinelPassword = os.Getenv("REDIS_SENTINEL_PASSWORD")
+	// Comma-separated seed node addresses to use Redis Cluster.
+	RedisClusterAddrs = os.Getenv("REDIS_CLUSTER_ADDRS")
+	// Optional PEM file with the CA certificates to verify the Redis server.
+	RedisTlsCaFile = os.Getenv("REDIS_TLS_CA_FILE")
+	// JWKS of the auth server used to validate access tokens locally. If empty, tokens
+	// are validated by the social API.
+	AuthJwksUrl = os.Getenv("AUTH_JWKS_URL")
+	// Expected issuer of the access tokens, if set. It may be followed by "/<lang>".
+	AuthJwtIssuer = os.Getenv("AUTH_JWT_ISSUER")
+	// Comma-separated producer:secret pairs used to verify the signatures of the events
+	// sent by each producer. A producer may have several secrets while rotating them.
+	EventsProducers = os.Getenv("EVENTS_PRODUCERS")
+	// Comma-separated names of event types accepted by the events endpoint besides the
+	// known ones, or "*" to accept any name. Their data is not validated.
+	EventsExtraNames = os.Getenv("EVENTS_EXTRA_NAMES")
+	// Comma-separated base URLs of the accounting services trusted as event sources
+	// besides KomunitinAccountingUrl, such as the IntegralCES accounting API.
+	EventsTrustedSources = os.Getenv("EVENTS_TRUSTED_SOURCES")
+	// Basic auth credentials required by the /events/replay endpoint, which is disabled
+	// if they are not set. Event producers can't replay events.
+	EventsAdminUsername = os.Getenv("EVENTS_ADMIN_USERNAME")
+	EventsAdminPassword = os.Getenv("EVENTS_ADMIN_PASSWORD")
+)
+
+// Optional settings with sensible defaults.
+var (
+	// Number of times an event is handled before moving it to the dead-letter stream.
+	EventsMaxAttempts = getInt("EVENTS_MAX_ATTEMPTS", 5)
+	// Delay before retrying a failed event. It doubles at each attempt up to EventsMaxRetryDelay.
+	EventsRetryDelay    = getDuration("EVENTS_RETRY_DELAY", 30*time.Second)
+	EventsMaxRetryDelay = getDuration("EVENTS_MAX_RETRY_DELAY", time.Hour)
+	// Events pending for longer than this time, for example because the process handling
+	// them crashed, are reclaimed by another consumer of the same group.
+	EventsClaimIdle     = getDuration("EVENTS_CLAIM_IDLE", 5*time.Minute)
+	EventsClaimInterval = getDuration("EVENTS_CLAIM_INTERVAL", time.Minute)
+	SmtpPort            = getInt("SMTP_PORT", 587)
+	// Maximum difference between the timestamp of a signed event request and the
+	// current time.
+	EventsSignatureTolerance = getDuration("EVENTS_SIGNATURE_TOLERANCE", 5*time.Minute)
+	// Time the idempotency keys of the received events are kept to detect duplicates.
+	EventsIdempotencyTtl = getDuration("EVENTS_IDEMPOTENCY_TTL", 24*time.Hour)
+	// Number of goroutines handling events in the notifier, for each kind of event.
+	NotifierWorkers = getInt("NOTIFIER_WORKERS", 4)
+	// Time notifications are kept in the users inbox.
+	NotificationsRetention = getDuration("NOTIFICATIONS_RETENTION", 90*24*time.Hour)
+	// A mail provider is skipped for MailSenderCooldown after this number of consecutive failures.
+	MailSenderFailureThreshold = getInt("MAIL_SENDER_FAILURE_THRESHOLD", 3)
+	MailSenderCooldown         = getDuration("MAIL_SENDER_COOLDOWN", time.Minute)
+	// Retry policy for the outgoing emails queue, analogous to the events one.
+	EmailsMaxAttempts   = getInt("EMAILS_MAX_ATTEMPTS", 8)
+	EmailsRetryDelay    = getDuration("EMAILS_RETRY_DELAY", time.Minute)
+	EmailsMaxRetryDelay = getDuration("EMAILS_MAX_RETRY_DELAY", 2*time.Hour)
+	// Time the delivery status of sent emails is kept.
+	EmailsRetention = getDuration("EMAILS_RETENTION", 30*24*time.Hour)
+	// Retention of the events and emails streams: maximum number of items and maximum
+	// age. Zero means no limit. Items pending in any consumer group are never removed.
+	EventsStreamMaxLen = getInt("EVENTS_STREAM_MAX_LEN", 0)
+	EventsStreamMaxAge = getDuration("EVENTS_STREAM_MAX_AGE", 30*24*time.Hour)
+	EmailsStreamMaxLen = getInt("EMAILS_STREAM_MAX_LEN", 0)
+	EmailsStreamMaxAge = getDuration("EMAILS_STREAM_MAX_AGE", 30*24*time.Hour)
+	// Interval between applications of the stream retention policies.
+	StreamTrimInterval = getDuration("STREAM_TRIM_INTERVAL", 10*time.Minute)
+	// Timeout of the requests to the Komunitin APIs. Failed requests are retried up to
+	// ApiMaxRetries times with a delay that doubles at each retry up to ApiMaxRetryDelay.
+	ApiTimeout       = getDuration("API_TIMEOUT", 10*time.Second)
+	ApiMaxRetries    = getInt("API_MAX_RETRIES", 3)
+	ApiRetryDelay    = getDuration("API_RETRY_DELAY", 500*time.Millisecond)
+	ApiMaxRetryDelay = getDuration("API_MAX_RETRY_DELAY", 30*time.Second)
+	// Requests to an API host are rejected for ApiBreakerCooldown after this number of
+	// consecutive failures.
+	ApiBreakerThreshold = getInt("API_BREAKER_THRESHOLD", 5)
+	ApiBreakerCooldown  = getDuration("API_BREAKER_COOLDOWN", 30*time.Second)
+	// Space-separated scopes requested for the service access token, and optional audience.
+	NotificationsClientScopes   = getString("NOTIFICATIONS_CLIENT_SCOPES", "komunitin_social_read_all komunitin_accounting_read_all")
+	NotificationsClientAudience = getString("NOTIFICATIONS_CLIENT_AUDIENCE", "")
+	// Time the responses of the Komunitin APIs are cached without revalidation. Zero
+	// disables the cache.
+	ApiCacheTtl = getDuration("API_CACHE_TTL", 0)
+	// Time cached responses are kept to be revalidated with their ETag.
+	ApiCacheMaxAge = getDuration("API_CACHE_MAX_AGE", 24*time.Hour)
+	// Comma-separated accepted audiences of the access tokens.
+	AuthJwtAudience = getString("AUTH_JWT_AUDIENCE", "komunitin-app")
+	// Redis connection URL, as redis://[user:password@]host:port/db. Use the rediss://
+	// scheme for TLS. With Sentinel or Cluster, only the credentials, database and TLS
+	// settings of the URL are used.
+	RedisUrl = getString("REDIS_URL", "redis://redis:6379/0")
+	// Redis connection pool. Zero pool size means 10 connections per CPU.
+	RedisPoolSize     = getInt("REDIS_POOL_SIZE", 0)
+	RedisMinIdleConns = getInt("REDIS_MIN_IDLE_CONNS", 0)
+	RedisDialTimeout  = getDuration("REDIS_DIAL_TIMEOUT", 5*time.Second)
+	RedisReadTimeout  = getDuration("REDIS_READ_TIMEOUT", 3*time.Second)
+	RedisWriteTimeout = getDuration("REDIS_WRITE_TIMEOUT", 3*time.Second)
 )
+
+// Return the value of the given environment variable or the default value if it is
+// not set.
+func getString(name string, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// Return the integer value of the given environment variable or the default value
+// if it is not set.
+func getInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid integer value %q for %s, using default %d\n", value, name, def)
+		return def
+	}
+	return i
+}
+
+// Return the duration value (such as "30s" or "5m") of the given environment variable
+// or the default value if it is not set.
+func getDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid duration value %q for %s, using default %v\n", value, name, def)
+		return def
+	}
+	return d
+}
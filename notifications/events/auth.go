@@ -0,0 +1,143 @@
+package events
+
+// Authentication of the event producers.
+//
+// Each producer (for example the accounting service or IntegralCES) has its own
+// secrets and signs its requests with HMAC-SHA256 over the timestamp and the body:
+//
+//	X-Komunitin-Producer: accounting
+//	X-Komunitin-Timestamp: 1717171717
+//	X-Komunitin-Signature: sha256=hex(HMAC-SHA256(secret, timestamp + "." + body))
+//
+// Requests with timestamps out of the replay window are rejected, and so are requests
+// repeating the signature of a previous one within the window. A producer may have
+// several secrets at once so they can be rotated without downtime. Producers that
+// don't sign their requests can still use the shared basic auth credentials.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/komunitin/komunitin/notifications/config"
+	"github.com/komunitin/komunitin/notifications/store"
+)
+
+const (
+	ProducerHeader  = "X-Komunitin-Producer"
+	TimestampHeader = "X-Komunitin-Timestamp"
+	SignatureHeader = "X-Komunitin-Signature"
+	signaturePrefix = "sha256="
+	signatureClass  = "signatures"
+	// Maximum size of the signed request bodies.
+	maxSignedBody = 1024 * 1024
+)
+
+// Return the secrets of the given producer from the EVENTS_PRODUCERS setting.
+func producerSecrets(producer string) [][]byte {
+	secrets := [][]byte{}
+	for _, entry := range strings.Split(config.EventsProducers, ",") {
+		name, secret, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if ok && name == producer && secret != "" {
+			secrets = append(secrets, []byte(secret))
+		}
+	}
+	return secrets
+}
+
+// Return the signature of the request body with the given timestamp and secret, as
+// expected in the signature header.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Check the signature of the request. The body is read and replaced so handlers can
+// read it again.
+func checkSignature(r *http.Request, producer string) bool {
+	timestamp := r.Header.Get(TimestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	skew := time.Since(time.Unix(seconds, 0))
+	if skew > config.EventsSignatureTolerance || skew < -config.EventsSignatureTolerance {
+		return false
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBody+1))
+	if err != nil || len(body) > maxSignedBody {
+		return false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	signature := []byte(r.Header.Get(SignatureHeader))
+	for _, secret := range producerSecrets(producer) {
+		if hmac.Equal(signature, []byte(Sign(secret, timestamp, body))) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkBasicAuth(r *http.Request, username string, password string) bool {
+	user, pass, ok := r.BasicAuth()
+	if !ok || username == "" {
+		return false
+	}
+	usermatch := subtle.ConstantTimeCompare([]byte(user), []byte(username)) == 1
+	passmatch := subtle.ConstantTimeCompare([]byte(pass), []byte(password)) == 1
+	return usermatch && passmatch
+}
+
+// Record the signature of a request so it can't be used again while its timestamp is
+// within the replay window. Returns false if the signature was already used.
+func checkSignatureReplay(r *http.Request, signatures store.Store) (bool, error) {
+	signature := r.Header.Get(SignatureHeader)
+	return signatures.SetIfAbsent(r.Context(), signatureClass, signature, true, 2*config.EventsSignatureTolerance)
+}
+
+// Authenticate the producer of the request, either by its signature or by basic auth.
+// Returns the producer name, or writes an error response and returns false.
+func authenticateProducer(w http.ResponseWriter, r *http.Request, signatures store.Store) (string, bool) {
+	if producer := r.Header.Get(ProducerHeader); producer != "" {
+		if checkSignature(r, producer) {
+			fresh, err := checkSignatureReplay(r, signatures)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				log.Println(err)
+				return "", false
+			}
+			if fresh {
+				return producer, true
+			}
+			log.Printf("Replayed signature from producer %q\n", producer)
+		} else {
+			log.Printf("Invalid signature from producer %q\n", producer)
+		}
+	} else if checkBasicAuth(r, config.NotificationsEventsUsername, config.NotificationsEventsPassword) {
+		return config.NotificationsEventsUsername, true
+	}
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	return "", false
+}
+
+// Authenticate an administrator with the EVENTS_ADMIN_* basic auth credentials. Writes
+// a 401 response and returns false otherwise.
+func authenticateAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if config.EventsAdminPassword != "" && checkBasicAuth(r, config.EventsAdminUsername, config.EventsAdminPassword) {
+		return true
+	}
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	return false
+}
@@ -0,0 +1,83 @@
+package events
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/komunitin/jsonapi"
+	"github.com/komunitin/komunitin/notifications/config"
+	"github.com/komunitin/komunitin/notifications/store"
+)
+
+func TestEventsHandlerSignature(t *testing.T) {
+	config.StoreBackend = store.MemoryBackend
+	config.NotificationsEventsUsername = "events"
+	config.NotificationsEventsPassword = "secret"
+	config.KomunitinAccountingUrl = "https://accounting.example.com"
+	config.EventsProducers = "accounting:old, accounting:new, ices:other"
+	defer func() { config.EventsProducers = "" }()
+	store.ResetMemory()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := NewEventsStream(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	consumer, _ := NewEventsStream(ctx, "test")
+	handler := eventsHandler(stream, store.NewMemoryStore())
+
+	post := func(producer string, secret string, timestamp time.Time) int {
+		ts := strconv.FormatInt(timestamp.Unix(), 10)
+		req := httptest.NewRequest(http.MethodPost, "/events", strings.NewReader(testEvent))
+		req.Header.Set("Content-Type", jsonapi.MediaType)
+		req.Header.Set(ProducerHeader, producer)
+		req.Header.Set(TimestampHeader, ts)
+		req.Header.Set(SignatureHeader, Sign([]byte(secret), ts, []byte(testEvent)))
+		res := httptest.NewRecorder()
+		handler(res, req)
+		return res.Code
+	}
+
+	if code := post("accounting", "new", time.Now()); code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", code)
+	}
+	event, err := consumer.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Producer != "accounting" {
+		t.Errorf("Expected producer accounting, got %q", event.Producer)
+	}
+	if code := post("accounting", "old", time.Now()); code != http.StatusCreated {
+		t.Errorf("Expected 201 with previous secret, got %d", code)
+	}
+	if code := post("accounting", "other", time.Now()); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with the secret of another producer, got %d", code)
+	}
+	if code := post("accounting", "new", time.Now().Add(-10*time.Minute)); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 out of the replay window, got %d", code)
+	}
+	// Signed requests can't be sent twice.
+	now := time.Now()
+	if code := post("ices", "other", now); code != http.StatusCreated {
+		t.Errorf("Expected 201, got %d", code)
+	}
+	if code := post("ices", "other", now); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 repeating a signature, got %d", code)
+	}
+
+	// Requests without credentials are rejected with a single response.
+	req := httptest.NewRequest(http.MethodPost, "/events", strings.NewReader(testEvent))
+	req.Header.Set("Content-Type", jsonapi.MediaType)
+	res := httptest.NewRecorder()
+	handler(res, req)
+	if res.Code != http.StatusUnauthorized || strings.Count(res.Body.String(), "Unauthorized") != 1 {
+		t.Errorf("Expected a single 401 response, got %d: %s", res.Code, res.Body)
+	}
+}
@@ -0,0 +1,83 @@
+package events
+
+// Deduplication of the events submitted more than once, for example when a producer
+// retries a request after a timeout. Producers identify each event with an idempotency
+// key, given as the Idempotency-Key header or as the JSON:API id of the event. The
+// stream id of the enqueued event is kept for each key, so duplicates are not enqueued
+// again and get the original stream id.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/komunitin/komunitin/notifications/config"
+	"github.com/komunitin/komunitin/notifications/store"
+)
+
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	idempotencyClass     = "idempotency"
+	// Time a key is reserved while its event is enqueued, so a crash doesn't block
+	// the retries for long.
+	idempotencyReservation = time.Minute
+)
+
+type idempotencyRecord struct {
+	// Empty while the event is being enqueued.
+	StreamId string `json:"streamId"`
+}
+
+// Return the idempotency key of the event, or an empty string if it has none. Keys
+// are scoped by the authenticated producer, so a producer can't collide with or probe
+// the keys of another one by sending events with its source.
+func idempotencyKey(r *http.Request, producer string, eventData *EventData) string {
+	key := eventData.Id
+	if r != nil && r.Header.Get(IdempotencyKeyHeader) != "" {
+		key = r.Header.Get(IdempotencyKeyHeader)
+	}
+	if key == "" {
+		return ""
+	}
+	hash := sha256.Sum256([]byte(producer + "\n" + key))
+	return hex.EncodeToString(hash[:])
+}
+
+// Reserve the key for an event about to be enqueued. Returns true if the key has been
+// reserved. Otherwise, returns the stream id of the event previously enqueued with the
+// same key, or an empty string if it is still being enqueued.
+func reserveIdempotencyKey(ctx context.Context, keys store.Store, key string) (string, bool, error) {
+	for {
+		reserved, err := keys.SetIfAbsent(ctx, idempotencyClass, key, &idempotencyRecord{}, idempotencyReservation)
+		if err != nil || reserved {
+			return "", reserved, err
+		}
+		record := &idempotencyRecord{}
+		err = keys.Get(ctx, idempotencyClass, key, record)
+		if errors.Is(err, store.ErrNotFound) {
+			// Just expired or released, so try again.
+			continue
+		}
+		return record.StreamId, false, err
+	}
+}
+
+// Save the stream id of the event enqueued with the reserved key.
+func completeIdempotencyKey(ctx context.Context, keys store.Store, key string, streamId string) {
+	err := keys.Set(ctx, idempotencyClass, key, &idempotencyRecord{StreamId: streamId}, nil, config.EventsIdempotencyTtl)
+	if err != nil {
+		log.Printf("Error saving idempotency key for event %s: %v\n", streamId, err)
+	}
+}
+
+// Release the reserved key of an event that could not be enqueued, so it can be retried.
+func releaseIdempotencyKey(ctx context.Context, keys store.Store, key string) {
+	err := keys.Delete(ctx, idempotencyClass, key)
+	if err != nil {
+		log.Printf("Error releasing idempotency key: %v\n", err)
+	}
+}
@@ -0,0 +1,88 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/komunitin/jsonapi"
+	"github.com/komunitin/komunitin/notifications/config"
+	"github.com/komunitin/komunitin/notifications/store"
+)
+
+func TestEventsHandlerIdempotency(t *testing.T) {
+	config.StoreBackend = store.MemoryBackend
+	config.NotificationsEventsUsername = "events"
+	config.NotificationsEventsPassword = "secret"
+	config.KomunitinAccountingUrl = "https://accounting.example.com"
+	config.EventsProducers = "ices:other"
+	defer func() { config.EventsProducers = "" }()
+	store.ResetMemory()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := NewEventsStream(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := eventsHandler(stream, store.NewMemoryStore())
+
+	post := func(body string, key string) (int, string) {
+		req := httptest.NewRequest(http.MethodPost, "/events", strings.NewReader(body))
+		req.Header.Set("Content-Type", jsonapi.MediaType)
+		if key != "" {
+			req.Header.Set(IdempotencyKeyHeader, key)
+		}
+		req.SetBasicAuth("events", "secret")
+		res := httptest.NewRecorder()
+		handler(res, req)
+		var doc struct {
+			Data struct{ Id string }
+		}
+		_ = json.NewDecoder(res.Body).Decode(&doc)
+		return res.Code, doc.Data.Id
+	}
+
+	withId := strings.Replace(testEvent, `"type": "events",`, `"type": "events", "id": "e1",`, 1)
+	code, first := post(withId, "")
+	if code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", code)
+	}
+	code, second := post(withId, "")
+	if code != http.StatusOK || second != first {
+		t.Errorf("Expected 200 with id %s, got %d with id %s", first, code, second)
+	}
+
+	code, third := post(testEvent, "k1")
+	if code != http.StatusCreated || third == first {
+		t.Fatalf("Expected 201 with a new id, got %d with id %s", code, third)
+	}
+	code, fourth := post(testEvent, "k1")
+	if code != http.StatusOK || fourth != third {
+		t.Errorf("Expected 200 with id %s, got %d with id %s", third, code, fourth)
+	}
+
+	// Keys are scoped by producer.
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req := httptest.NewRequest(http.MethodPost, "/events", strings.NewReader(testEvent))
+	req.Header.Set("Content-Type", jsonapi.MediaType)
+	req.Header.Set(IdempotencyKeyHeader, "k1")
+	req.Header.Set(ProducerHeader, "ices")
+	req.Header.Set(TimestampHeader, ts)
+	req.Header.Set(SignatureHeader, Sign([]byte("other"), ts, []byte(testEvent)))
+	res := httptest.NewRecorder()
+	handler(res, req)
+	if res.Code != http.StatusCreated {
+		t.Errorf("Expected 201 for the same key from another producer, got %d", res.Code)
+	}
+
+	items, _ := stream.stream.Range(ctx, "-", "+", 0)
+	if len(items) != 3 {
+		t.Errorf("Expected 3 events in the stream, got %d", len(items))
+	}
+}
@@ -0,0 +1,163 @@
+package events
+
+// Implements the replay of past events, for example to send again the notifications
+// affected by a bug. Replayed events are copies of the original ones added at the end
+// of the events stream, and they can be targeted to a single consumer. Only original
+// events are replayed, so overlapping replays don't multiply the copies.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/komunitin/jsonapi"
+	"github.com/komunitin/komunitin/notifications/service"
+	"github.com/komunitin/komunitin/notifications/store"
+)
+
+// Consumers of the events stream that can be targeted by replays.
+const (
+	MailerConsumer   = "mailer"
+	NotifierConsumer = "notifier"
+)
+
+// Number of events read from the stream at once while replaying.
+const replayBatch = 100
+
+var streamIdPattern = regexp.MustCompile(`^\d+-\d+$`)
+
+// Returned by Replay if the options are not valid.
+var ErrInvalidReplay = errors.New("invalid replay")
+
+type ReplayOptions struct {
+	// First and last events to replay, both included, as stream ids or RFC3339 times.
+	// Empty values stand for the beginning and the end of the stream.
+	From string
+	To   string
+	// Consumer that handles the replayed events: MailerConsumer, NotifierConsumer or
+	// empty for both.
+	Target string
+	// If set, consumers only log what they would send.
+	DryRun bool
+}
+
+// Add copies of the events in the given range at the end of the stream, skipping the
+// copies of previous replays. Returns the number of replayed events.
+func (stream *EventStream) Replay(ctx context.Context, options ReplayOptions) (int, error) {
+	if options.Target != "" && options.Target != MailerConsumer && options.Target != NotifierConsumer {
+		return 0, fmt.Errorf("%w: unknown target %q", ErrInvalidReplay, options.Target)
+	}
+	start, err := replayBound(options.From, false)
+	if err != nil {
+		return 0, err
+	}
+	end, err := replayBound(options.To, true)
+	if err != nil {
+		return 0, err
+	}
+	if end == "+" {
+		// Don't replay the events added by this replay.
+		end, err = stream.stream.LastId(ctx)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	replayed := 0
+	for {
+		items, err := stream.stream.Range(ctx, start, end, replayBatch)
+		if err != nil {
+			return replayed, err
+		}
+		for _, item := range items {
+			event, err := parseEvent(item.Id, item.Value)
+			if err != nil {
+				log.Printf("Skipping invalid event %s: %v\n", item.Id, err)
+				continue
+			}
+			if event.ReplayOf != "" {
+				// Copy added by a previous replay.
+				continue
+			}
+			event.ReplayOf = event.Id
+			event.Target = options.Target
+			event.DryRun = options.DryRun
+			id, err := stream.Add(ctx, event)
+			if err != nil {
+				return replayed, err
+			}
+			log.Printf("Replayed event %s (%s) as %s.\n", item.Id, event.Name, id)
+			replayed++
+		}
+		if len(items) < replayBatch {
+			return replayed, nil
+		}
+		start = store.NextId(items[len(items)-1].Id)
+	}
+}
+
+// Convert the given stream id or RFC3339 time into a stream id for the start or the
+// end of a range.
+func replayBound(value string, end bool) (string, error) {
+	if value == "" {
+		if end {
+			return "+", nil
+		}
+		return "-", nil
+	}
+	if streamIdPattern.MatchString(value) {
+		return value, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid event id or time %q", ErrInvalidReplay, value)
+	}
+	ms := strconv.FormatInt(t.UnixMilli(), 10)
+	if end {
+		return ms + "-" + strconv.FormatUint(math.MaxUint64, 10), nil
+	}
+	return ms + "-0", nil
+}
+
+// Handler for POST /events/replay. The range, target and dry run mode are given by
+// the from, to, target and dryRun query parameters. Requires the admin credentials.
+func replayHandler(stream *EventStream) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authenticateAdmin(w, r) {
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		replayed, err := stream.Replay(r.Context(), ReplayOptions{
+			From:   query.Get("from"),
+			To:     query.Get("to"),
+			Target: query.Get("target"),
+			DryRun: query.Get("dryRun") == "true",
+		})
+		if errors.Is(err, ErrInvalidReplay) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil && replayed == 0 {
+			log.Printf("Error replaying events: %v\n", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if err != nil {
+			// Partial replay.
+			log.Printf("Error replaying events: %v\n", err)
+		}
+		w.Header().Set(service.ContentType, jsonapi.MediaType)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"meta":{"replayed":%d}}`+"\n", replayed)
+	}
+}
@@ -0,0 +1,138 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/komunitin/komunitin/notifications/config"
+	"github.com/komunitin/komunitin/notifications/store"
+)
+
+func TestReplay(t *testing.T) {
+	config.StoreBackend = store.MemoryBackend
+	store.ResetMemory()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := NewEventsStream(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, code := range []string{"GRP0", "GRP1", "GRP2"} {
+		id, err := stream.Add(ctx, &Event{Name: TransferCommitted, Code: code, Time: time.Now(), Data: map[string]string{}, User: "u1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	mailer, _ := NewEventsStream(ctx, MailerConsumer)
+	notifier, _ := NewEventsStream(ctx, NotifierConsumer)
+
+	if _, err := stream.Replay(ctx, ReplayOptions{Target: "other"}); err == nil {
+		t.Error("Expected error for invalid target")
+	}
+	replayed, err := stream.Replay(ctx, ReplayOptions{From: ids[1], Target: MailerConsumer, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed != 2 {
+		t.Fatalf("Expected 2 replayed events, got %d", replayed)
+	}
+
+	for i, code := range []string{"GRP1", "GRP2"} {
+		event, err := mailer.Get(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.Code != code || event.ReplayOf != ids[i+1] || event.Target != MailerConsumer || !event.DryRun {
+			t.Errorf("Unexpected replayed event %+v", event)
+		}
+	}
+
+	// The notifier skips the events targeted to the mailer.
+	short, cancelShort := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancelShort()
+	if event, err := notifier.Get(short); err == nil {
+		t.Errorf("Unexpected event for notifier %+v", event)
+	}
+
+	// Copies of previous replays are not replayed again.
+	replayed, err = stream.Replay(ctx, ReplayOptions{DryRun: true})
+	if err != nil || replayed != 3 {
+		t.Errorf("Expected 3 replayed events, got %d, %v", replayed, err)
+	}
+}
+
+func TestReplayHandler(t *testing.T) {
+	config.StoreBackend = store.MemoryBackend
+	store.ResetMemory()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer func(username, password, admin, adminPassword string) {
+		config.NotificationsEventsUsername, config.NotificationsEventsPassword = username, password
+		config.EventsAdminUsername, config.EventsAdminPassword = admin, adminPassword
+	}(config.NotificationsEventsUsername, config.NotificationsEventsPassword, config.EventsAdminUsername, config.EventsAdminPassword)
+	config.NotificationsEventsUsername, config.NotificationsEventsPassword = "events", "secret"
+	config.EventsAdminUsername, config.EventsAdminPassword = "", ""
+
+	stream, err := NewEventsStream(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Add(ctx, &Event{Name: TransferCommitted, Code: "GRP0", Time: time.Now(), Data: map[string]string{}, User: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+	handler := replayHandler(stream)
+	replay := func(username, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/events/replay?dryRun=true", nil)
+		req.SetBasicAuth(username, password)
+		res := httptest.NewRecorder()
+		handler(res, req)
+		return res
+	}
+
+	// Disabled without admin credentials.
+	if res := replay("", ""); res.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without admin credentials, got %d", res.Code)
+	}
+	config.EventsAdminUsername, config.EventsAdminPassword = "admin", "admin-secret"
+	if res := replay("events", "secret"); res.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with producer credentials, got %d", res.Code)
+	}
+	res := replay("admin", "admin-secret")
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), `"replayed":1`) {
+		t.Errorf("Unexpected response %d: %s", res.Code, res.Body)
+	}
+
+	// Invalid options are client errors, store errors are server errors.
+	req := httptest.NewRequest(http.MethodPost, "/events/replay?from=yesterday", nil)
+	req.SetBasicAuth("admin", "admin-secret")
+	res = httptest.NewRecorder()
+	handler(res, req)
+	if res.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid range, got %d", res.Code)
+	}
+	handler = replayHandler(&EventStream{stream: failingStream{stream.stream}})
+	if res := replay("admin", "admin-secret"); res.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 for store error, got %d", res.Code)
+	}
+}
+
+// Stream whose reads fail.
+type failingStream struct {
+	store.Stream
+}
+
+func (failingStream) LastId(ctx context.Context) (string, error) {
+	return "", errors.New("connection refused")
+}
+
+func (failingStream) Range(ctx context.Context, start string, end string, count int64) ([]store.StreamItem, error) {
+	return nil, errors.New("connection refused")
+}
@@ -0,0 +1,150 @@
+package events
+
+// Registry of the known event types and validation of the events received at the
+// /events endpoint, so invalid events are rejected to the producer instead of failing
+// later in the consumers.
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/komunitin/komunitin/notifications/api"
+	"github.com/komunitin/komunitin/notifications/config"
+	"github.com/komunitin/komunitin/notifications/service"
+)
+
+// Format of an event data value.
+type dataFormat int
+
+const (
+	formatText dataFormat = iota
+	formatUuid
+	formatUrl
+)
+
+// Data keys of an event type and their formats.
+type eventSchema struct {
+	Required map[string]dataFormat
+	Optional map[string]dataFormat
+}
+
+var transferSchema = eventSchema{
+	Required: map[string]dataFormat{"transfer": formatUuid, "payer": formatUuid, "payee": formatUuid},
+}
+
+var memberSchema = eventSchema{
+	Required: map[string]dataFormat{"member": formatUuid},
+}
+
+var eventSchemas = map[string]eventSchema{
+	TransferCommitted: transferSchema,
+	TransferPending:   transferSchema,
+	TransferRejected:  transferSchema,
+	NeedPublished:     {Required: map[string]dataFormat{"need": formatUuid}},
+	NeedExpired:       {Required: map[string]dataFormat{"need": formatUuid, "member": formatUuid}},
+	OfferPublished:    {Required: map[string]dataFormat{"offer": formatUuid}},
+	OfferExpired:      {Required: map[string]dataFormat{"offer": formatUuid, "member": formatUuid}},
+	MemberJoined:      memberSchema,
+	MemberRequested:   memberSchema,
+	GroupActivated:    {},
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// Whether events with the given name not in the registry are accepted.
+func isExtraName(name string) bool {
+	for _, extra := range strings.Split(config.EventsExtraNames, ",") {
+		extra = strings.TrimSpace(extra)
+		if extra == "*" || extra == name {
+			return true
+		}
+	}
+	return false
+}
+
+func checkFormat(value string, format dataFormat) string {
+	switch format {
+	case formatUuid:
+		if !uuidPattern.MatchString(value) {
+			return "must be a UUID"
+		}
+	case formatUrl:
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "must be an absolute http(s) URL"
+		}
+	}
+	return ""
+}
+
+// Return the validation errors of the given event, or an empty list if it is valid.
+// The base is the JSON pointer to the event resource in the request document.
+func validateEvent(eventData *EventData, base string) []*service.ValidationError {
+	errs := []*service.ValidationError{}
+	invalid := func(pointer string, detail string) {
+		errs = append(errs, service.NewValidationError(base+pointer, "Invalid event", detail))
+	}
+
+	schema, known := eventSchemas[eventData.Name]
+	if eventData.Name == "" {
+		invalid("/attributes/name", "Missing event name")
+	} else if !known && !isExtraName(eventData.Name) {
+		invalid("/attributes/name", fmt.Sprintf("Unknown event name %q", eventData.Name))
+	}
+	if problem := checkFormat(eventData.Source, formatUrl); problem != "" {
+		invalid("/attributes/source", "Source "+problem)
+	} else if err := api.CheckSource(eventData.Source); err != nil {
+		invalid("/attributes/source", fmt.Sprintf("Source %q is not a trusted accounting service", eventData.Source))
+	}
+	if eventData.Code == "" {
+		invalid("/attributes/code", "Missing group code")
+	}
+	if eventData.Time.IsZero() {
+		invalid("/attributes/time", "Missing event time")
+	}
+	if eventData.User == nil || eventData.User.Id == "" {
+		invalid("/relationships/user", "Missing 'user' relationship")
+	}
+
+	keys := make([]string, 0, len(eventData.Data))
+	for key := range eventData.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		pointer := "/attributes/data/" + key
+		value, ok := eventData.Data[key].(string)
+		if !ok {
+			invalid(pointer, "Data values must be strings")
+			continue
+		}
+		if !known {
+			continue
+		}
+		format, required := schema.Required[key]
+		if !required {
+			var optional bool
+			if format, optional = schema.Optional[key]; !optional {
+				invalid(pointer, fmt.Sprintf("Unexpected data key %q for %s events", key, eventData.Name))
+				continue
+			}
+		}
+		if problem := checkFormat(value, format); problem != "" {
+			invalid(pointer, fmt.Sprintf("Data value %q %s", key, problem))
+		}
+	}
+	required := make([]string, 0, len(schema.Required))
+	for key := range schema.Required {
+		if _, ok := eventData.Data[key]; !ok {
+			required = append(required, key)
+		}
+	}
+	sort.Strings(required)
+	for _, key := range required {
+		invalid("/attributes/data", fmt.Sprintf("Missing data value %q for %s events", key, eventData.Name))
+	}
+	return errs
+}
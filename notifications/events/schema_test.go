@@ -0,0 +1,82 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/komunitin/jsonapi"
+	"github.com/komunitin/komunitin/notifications/config"
+	"github.com/komunitin/komunitin/notifications/store"
+)
+
+func postEvent(handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/events", strings.NewReader(body))
+	req.Header.Set("Content-Type", jsonapi.MediaType)
+	req.SetBasicAuth("events", "secret")
+	res := httptest.NewRecorder()
+	handler(res, req)
+	return res
+}
+
+func TestEventsHandlerValidation(t *testing.T) {
+	config.StoreBackend = store.MemoryBackend
+	config.NotificationsEventsUsername = "events"
+	config.NotificationsEventsPassword = "secret"
+	config.KomunitinAccountingUrl = "https://accounting.example.com"
+	config.EventsExtraNames = ""
+	store.ResetMemory()
+	stream, err := NewEventsStream(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := eventsHandler(stream, store.NewMemoryStore())
+
+	invalid := strings.NewReplacer(
+		`"payer": "0b1c2d3e-4f50-4617-8293-a4b5c6d7e8f9",`, ``,
+		`"f9e8d7c6-b5a4-4938-8271-6f5e4d3c2b1a"`, `"a2"`,
+		`"https://accounting.example.com"`, `"accounting"`,
+	).Replace(testEvent)
+	res := postEvent(handler, invalid)
+	if res.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected 422, got %d: %s", res.Code, res.Body)
+	}
+	var doc struct {
+		Errors []struct {
+			Status string
+			Source struct{ Pointer string }
+		}
+	}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	pointers := []string{}
+	for _, e := range doc.Errors {
+		if e.Status != "422" {
+			t.Errorf("Unexpected error status %s", e.Status)
+		}
+		pointers = append(pointers, e.Source.Pointer)
+	}
+	expected := "/data/attributes/source,/data/attributes/data/payee,/data/attributes/data"
+	if strings.Join(pointers, ",") != expected {
+		t.Errorf("Expected pointers %s, got %v", expected, pointers)
+	}
+
+	untrusted := strings.Replace(testEvent, "https://accounting.example.com", "https://attacker.example.com", 1)
+	if res := postEvent(handler, untrusted); res.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for untrusted source, got %d", res.Code)
+	}
+
+	unknown := strings.Replace(testEvent, TransferCommitted, "TransferArchived", 1)
+	if res := postEvent(handler, unknown); res.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for unknown name, got %d", res.Code)
+	}
+	config.EventsExtraNames = "GroupArchived, TransferArchived"
+	defer func() { config.EventsExtraNames = "" }()
+	if res := postEvent(handler, unknown); res.Code != http.StatusCreated {
+		t.Errorf("Expected 201 for allowed name, got %d: %s", res.Code, res.Body)
+	}
+}
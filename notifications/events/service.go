@@ -7,15 +7,18 @@ package events
 
 import (
 	"context"
-	"crypto/subtle"
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"reflect"
+	"strconv"
 	"time"
 
 	"github.com/komunitin/jsonapi"
 	"github.com/komunitin/komunitin/notifications/api"
-	"github.com/komunitin/komunitin/notifications/config"
 	"github.com/komunitin/komunitin/notifications/service"
+	"github.com/komunitin/komunitin/notifications/store"
 )
 
 // EventData object as reveived from JSON:API request.
@@ -30,26 +33,51 @@ type EventData struct {
 	User   *api.ExternalUser      `jsonapi:"relation,user"`
 }
 
-func checkBasicAuth(w http.ResponseWriter, r *http.Request) bool {
-	user, pass, ok := r.BasicAuth()
-	if !ok {
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+// Create the internal Event object from a validated event sent by the given producer.
+func newEvent(eventData *EventData, producer string) *Event {
+	// Data values have been validated to be strings.
+	data := make(map[string]string, len(eventData.Data))
+	for k, v := range eventData.Data {
+		data[k] = v.(string)
 	}
-	usermatch := subtle.ConstantTimeCompare([]byte(user), []byte(config.NotificationsEventsUsername)) == 1
-	passmatch := subtle.ConstantTimeCompare([]byte(pass), []byte(config.NotificationsEventsPassword)) == 1
-	if usermatch && passmatch {
-		return true
-	} else {
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-		return false
+	return &Event{
+		Name:     eventData.Name,
+		Source:   eventData.Source,
+		Code:     eventData.Code,
+		Time:     eventData.Time,
+		Data:     data,
+		User:     eventData.User.Id,
+		Producer: producer,
 	}
 }
 
-// Return the handler for requests to /events
-func eventsHandler(stream *EventStream) http.HandlerFunc {
+// Resource types cached by the api package that change with each event type. The
+// empty type stands for the group itself.
+var cacheInvalidations = map[string][]string{
+	TransferCommitted: {"accounts", "transfers"},
+	TransferPending:   {"accounts", "transfers"},
+	TransferRejected:  {"accounts", "transfers"},
+	MemberJoined:      {"members", "accounts"},
+	MemberRequested:   {"members"},
+	GroupActivated:    {""},
+}
+
+// Remove the cached API resources changed by the event, before consumers handle it.
+func invalidateCache(ctx context.Context, event *Event) {
+	if types, ok := cacheInvalidations[event.Name]; ok {
+		if err := api.InvalidateCache(ctx, event.Code, types...); err != nil {
+			log.Printf("Error invalidating API cache for event %s: %v\n", event.Name, err)
+		}
+	}
+}
+
+// Return the handler for requests to /events. Events with an idempotency key already
+// seen are not enqueued again and get the stream id of the original event.
+func eventsHandler(stream *EventStream, keys store.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Check authentication by asking the caller to use notification client_id/client_secret pair as basic auth.
-		if !checkBasicAuth(w, r) {
+		// Check authentication by signature or basic auth.
+		producer, ok := authenticateProducer(w, r, keys)
+		if !ok {
 			return
 		}
 		// Validate request and get event.
@@ -62,45 +90,56 @@ func eventsHandler(stream *EventStream) http.HandlerFunc {
 		if err != nil {
 			return
 		}
-		// Validate provided data.
-		if eventData.User == nil {
-			http.Error(w, "Missing 'user' relationship", http.StatusBadRequest)
+		// Validate provided data against the event type schema.
+		if errs := validateEvent(eventData, "/data"); len(errs) > 0 {
+			service.WriteValidationErrors(w, errs)
 			return
 		}
 
-		// convert Data from map[string]interface{} to map[string]string
-		data := make(map[string]string, len(eventData.Data))
-		for k, v := range eventData.Data {
-			if s, ok := v.(string); ok {
-				data[k] = s
-			} else {
-				http.Error(w, "Data field must be a map of strings", http.StatusBadRequest)
+		// Check for duplicates.
+		status := http.StatusCreated
+		key := idempotencyKey(r, producer, eventData)
+		id := ""
+		if key != "" {
+			original, reserved, err := reserveIdempotencyKey(r.Context(), keys, key)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				log.Println(err.Error())
 				return
 			}
+			if !reserved && original == "" {
+				http.Error(w, "An event with the same idempotency key is being processed", http.StatusConflict)
+				return
+			}
+			if !reserved {
+				// Duplicate event, already enqueued.
+				status = http.StatusOK
+				id = original
+			}
 		}
 
-		// Create internal Event object.
-		event := &Event{
-			Name:   eventData.Name,
-			Source: eventData.Source,
-			Code:   eventData.Code,
-			Time:   eventData.Time,
-			Data:   data,
-			User:   eventData.User.Id,
-		}
-
-		// Enqueue event to the stream.
-		id, err := stream.Add(r.Context(), event)
-		if err != nil {
-			// Unexpected error
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			log.Println(err.Error())
-			return
+		if id == "" {
+			// Enqueue event to the stream.
+			event := newEvent(eventData, producer)
+			invalidateCache(r.Context(), event)
+			id, err = stream.Add(r.Context(), event)
+			if err != nil {
+				// Unexpected error
+				if key != "" {
+					releaseIdempotencyKey(r.Context(), keys, key)
+				}
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				log.Println(err.Error())
+				return
+			}
+			if key != "" {
+				completeIdempotencyKey(r.Context(), keys, key, id)
+			}
 		}
 
 		// Return success following JSON:API spec https://jsonapi.org/format/#crud-creating-responses.
 		w.Header().Set(service.ContentType, jsonapi.MediaType)
-		w.WriteHeader(http.StatusCreated)
+		w.WriteHeader(status)
 
 		// Not adding Location header since events are not accessible (by the moment).
 		// Send response, which is the same as the request but with the id.
@@ -114,12 +153,126 @@ func eventsHandler(stream *EventStream) http.HandlerFunc {
 	}
 }
 
+// Maximum number of events in a batch request.
+const maxBatchSize = 500
+
+// Result of each event of a batch request.
+type batchResult struct {
+	Status string                     `json:"status"`
+	Id     string                     `json:"id,omitempty"`
+	Errors []*service.ValidationError `json:"errors,omitempty"`
+}
+
+// Return the handler for requests to /events/batch. The request is a JSON:API document
+// with an array of events as primary data. Valid events are enqueued and invalid ones
+// are reported, so the response contains the result of each event in the same order.
+// Events with a JSON:API id are deduplicated as in the /events endpoint, but the
+// Idempotency-Key header is ignored since it can't identify each event of the batch.
+func batchEventsHandler(stream *EventStream, keys store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		producer, ok := authenticateProducer(w, r, keys)
+		if !ok {
+			return
+		}
+		err := service.ValidatePost(w, r)
+		if err != nil {
+			return
+		}
+		items, err := service.ValidateJsonMany(w, r, reflect.TypeOf(new(EventData)))
+		if err != nil {
+			return
+		}
+		if len(items) == 0 {
+			http.Error(w, "Request must contain at least one event", http.StatusBadRequest)
+			return
+		}
+		if len(items) > maxBatchSize {
+			http.Error(w, fmt.Sprintf("Request must not contain more than %d events", maxBatchSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		results := make([]*batchResult, len(items))
+		valid := []*Event{}
+		positions := []int{}
+		idempotencyKeys := []string{}
+		for i, item := range items {
+			eventData := item.(*EventData)
+			if errs := validateEvent(eventData, fmt.Sprintf("/data/%d", i)); len(errs) > 0 {
+				results[i] = &batchResult{Status: strconv.Itoa(http.StatusUnprocessableEntity), Errors: errs}
+				continue
+			}
+			// The Idempotency-Key header doesn't apply to the items of the batch.
+			key := idempotencyKey(nil, producer, eventData)
+			if key != "" {
+				original, reserved, err := reserveIdempotencyKey(r.Context(), keys, key)
+				if err != nil {
+					log.Println(err.Error())
+					results[i] = &batchResult{Status: strconv.Itoa(http.StatusInternalServerError)}
+					continue
+				}
+				if !reserved && original == "" {
+					results[i] = &batchResult{Status: strconv.Itoa(http.StatusConflict)}
+					continue
+				}
+				if !reserved {
+					results[i] = &batchResult{Status: strconv.Itoa(http.StatusOK), Id: original}
+					continue
+				}
+			}
+			valid = append(valid, newEvent(eventData, producer))
+			positions = append(positions, i)
+			idempotencyKeys = append(idempotencyKeys, key)
+		}
+
+		// Enqueue all valid events at once.
+		if len(valid) > 0 {
+			for _, event := range valid {
+				invalidateCache(r.Context(), event)
+			}
+			ids, err := stream.AddAll(r.Context(), valid)
+			if err != nil {
+				log.Println(err.Error())
+			}
+			for j, i := range positions {
+				key := idempotencyKeys[j]
+				if j < len(ids) && ids[j] != "" {
+					results[i] = &batchResult{Status: strconv.Itoa(http.StatusCreated), Id: ids[j]}
+					if key != "" {
+						completeIdempotencyKey(r.Context(), keys, key, ids[j])
+					}
+				} else {
+					results[i] = &batchResult{Status: strconv.Itoa(http.StatusInternalServerError)}
+					if key != "" {
+						releaseIdempotencyKey(r.Context(), keys, key)
+					}
+				}
+			}
+		}
+
+		w.Header().Set(service.ContentType, jsonapi.MediaType)
+		w.WriteHeader(http.StatusOK)
+		err = json.NewEncoder(w).Encode(map[string]interface{}{
+			"meta": map[string]interface{}{"results": results},
+		})
+		if err != nil {
+			log.Println(err.Error())
+		}
+	}
+}
+
 // Starts the events server.
 func InitService() {
 	// Create store connection.
-	stream, err := NewEventsStream(context.Background(), "service")
+	stream, err := NewEventsStream(context.Background(), "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	go stream.RunTrimmer(context.Background())
+	keys, err := store.NewStore()
 	if err != nil {
 		log.Fatal(err)
 	}
-	http.HandleFunc("/events", eventsHandler(stream))
+	http.HandleFunc("/events", eventsHandler(stream, keys))
+	http.HandleFunc("/events/batch", batchEventsHandler(stream, keys))
+	http.HandleFunc("/events/replay", replayHandler(stream))
 }
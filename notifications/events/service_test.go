@@ -0,0 +1,133 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/komunitin/jsonapi"
+	"github.com/komunitin/komunitin/notifications/config"
+	"github.com/komunitin/komunitin/notifications/store"
+)
+
+const testEvent = `{"data": {
+	"type": "events",
+	"attributes": {
+		"name": "TransferCommitted",
+		"source": "https://accounting.example.com",
+		"code": "GRP0",
+		"time": "2024-01-01T10:00:00Z",
+		"data": {
+			"transfer": "6d3a2c1e-3f4b-4c7a-9e2d-1a2b3c4d5e6f",
+			"payer": "0b1c2d3e-4f50-4617-8293-a4b5c6d7e8f9",
+			"payee": "f9e8d7c6-b5a4-4938-8271-6f5e4d3c2b1a"
+		}
+	},
+	"relationships": {"user": {"data": {"type": "users", "id": "u1"}}}
+}}`
+
+func TestEventsHandler(t *testing.T) {
+	config.StoreBackend = store.MemoryBackend
+	config.NotificationsEventsUsername = "events"
+	config.NotificationsEventsPassword = "secret"
+	config.KomunitinAccountingUrl = "https://accounting.example.com"
+	store.ResetMemory()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := NewEventsStream(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	consumer, _ := NewEventsStream(ctx, "test")
+	handler := eventsHandler(stream, store.NewMemoryStore())
+
+	req := httptest.NewRequest(http.MethodPost, "/events", strings.NewReader(testEvent))
+	req.Header.Set("Content-Type", jsonapi.MediaType)
+	req.SetBasicAuth("events", "wrong")
+	res := httptest.NewRecorder()
+	handler(res, req)
+	if res.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401, got %d", res.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/events", strings.NewReader(testEvent))
+	req.Header.Set("Content-Type", jsonapi.MediaType)
+	req.SetBasicAuth("events", "secret")
+	res = httptest.NewRecorder()
+	handler(res, req)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", res.Code, res.Body)
+	}
+
+	event, err := consumer.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Name != TransferCommitted || event.Code != "GRP0" || event.User != "u1" || event.Data["payee"] != "f9e8d7c6-b5a4-4938-8271-6f5e4d3c2b1a" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+	if !event.Time.Equal(time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected event time %v", event.Time)
+	}
+}
+
+func TestBatchEventsHandler(t *testing.T) {
+	config.StoreBackend = store.MemoryBackend
+	config.NotificationsEventsUsername = "events"
+	config.NotificationsEventsPassword = "secret"
+	config.KomunitinAccountingUrl = "https://accounting.example.com"
+	store.ResetMemory()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := NewEventsStream(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	consumer, _ := NewEventsStream(ctx, "test")
+	handler := batchEventsHandler(stream, store.NewMemoryStore())
+
+	event := strings.TrimSuffix(strings.TrimPrefix(testEvent, `{"data": `), `}`)
+	invalid := strings.Replace(event, `"code": "GRP0"`, `"code": ""`, 1)
+	other := strings.Replace(event, `"code": "GRP0"`, `"code": "GRP1"`, 1)
+	body := `{"data": [` + event + `,` + invalid + `,` + other + `]}`
+
+	req := httptest.NewRequest(http.MethodPost, "/events/batch", strings.NewReader(body))
+	req.Header.Set("Content-Type", jsonapi.MediaType)
+	req.SetBasicAuth("events", "secret")
+	res := httptest.NewRecorder()
+	handler(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body)
+	}
+	var doc struct {
+		Meta struct {
+			Results []batchResult
+		}
+	}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	results := doc.Meta.Results
+	if len(results) != 3 || results[0].Status != "201" || results[1].Status != "422" || results[2].Status != "201" {
+		t.Fatalf("Unexpected results %+v", results)
+	}
+	if results[1].Errors[0].Source.Pointer != "/data/1/attributes/code" {
+		t.Errorf("Unexpected error pointer %s", results[1].Errors[0].Source.Pointer)
+	}
+
+	for i, code := range []string{"GRP0", "GRP1"} {
+		event, err := consumer.Get(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.Code != code || event.Id != results[i*2].Id {
+			t.Errorf("Unexpected event %+v", event)
+		}
+	}
+}
@@ -3,8 +3,11 @@ package events
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"log"
 	"time"
 
+	"github.com/komunitin/komunitin/notifications/config"
 	"github.com/komunitin/komunitin/notifications/store"
 )
 
@@ -30,6 +33,14 @@ type Event struct {
 	Data map[string]string
 	// The uuid of the user that triggered the event.
 	User string
+	// The name of the authenticated producer that sent the event.
+	Producer string
+	// Set in replayed events: the id of the original event, the consumer that has to
+	// handle it (all consumers if empty) and whether the consumer has to only log
+	// what it would send.
+	ReplayOf string
+	Target   string
+	DryRun   bool
 }
 
 // Event names
@@ -48,69 +59,186 @@ const (
 
 // Abstracts the events stream.
 type EventStream struct {
-	stream *store.Stream
+	stream   store.Stream
+	consumer string
 }
 
 const (
 	EventStreamName = "events"
 )
 
-// Create a new events stream.
+// Create a new events stream. The consumer is the name of the consumer group used
+// by Get. It must be empty if the stream is only used to add events, since groups
+// that are not read prevent trimming the stream.
 func NewEventsStream(ctx context.Context, consumer string) (*EventStream, error) {
-	stream, err := store.NewStream(ctx, EventStreamName, consumer)
+	stream, err := store.NewStream(ctx, EventStreamName, consumer, store.StreamOptions{
+		MaxAttempts:   config.EventsMaxAttempts,
+		RetryDelay:    config.EventsRetryDelay,
+		MaxRetryDelay: config.EventsMaxRetryDelay,
+		ClaimIdle:     config.EventsClaimIdle,
+		ClaimInterval: config.EventsClaimInterval,
+		MaxLen:        int64(config.EventsStreamMaxLen),
+		MaxAge:        config.EventsStreamMaxAge,
+	})
 	if err != nil {
 		return nil, err
 	}
-	return &EventStream{stream: stream}, nil
+	return &EventStream{stream: stream, consumer: consumer}, nil
 }
 
-// Get Event from stream. This function is blocking.
+// Get Event from stream. This function blocks until there is an event or the
+// context is done. Read errors are retried with backoff, and malformed items are
+// failed until they are moved to the dead-letter stream. Replayed events targeted
+// to other consumers are skipped.
 func (stream *EventStream) Get(ctx context.Context) (*Event, error) {
-	id, value, err := stream.stream.Get(ctx)
-	if err != nil {
-		return nil, err
+	failures := 0
+	for {
+		id, value, err := stream.stream.Get(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			failures++
+			log.Printf("Error reading %s stream: %v\n", EventStreamName, err)
+			if err := store.WaitReadRetry(ctx, failures); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		failures = 0
+		event, err := parseEvent(id, value)
+		if err != nil {
+			// Retrying won't fix the item, but failing it eventually moves it to
+			// the dead-letter stream where it can be inspected.
+			log.Printf("Invalid event %s: %v\n", id, err)
+			dead, err := stream.Fail(ctx, id, err)
+			if err != nil {
+				log.Printf("Error failing event %s: %v\n", id, err)
+			} else if dead {
+				log.Printf("Event %s moved to %s stream after too many attempts.\n", id, EventStreamName+store.DeadStreamSuffix)
+			}
+			continue
+		}
+		if event.Target != "" && event.Target != stream.consumer {
+			if err := stream.Ack(ctx, id); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return event, nil
+	}
+}
+
+// Build the Event from the stream item.
+func parseEvent(id string, value map[string]interface{}) (*Event, error) {
+	fields := make(map[string]string)
+	for _, field := range []string{"name", "source", "code", "time", "data", "user"} {
+		v, ok := value[field].(string)
+		if !ok {
+			return nil, fmt.Errorf("missing event field %q", field)
+		}
+		fields[field] = v
 	}
 
 	// parse time
-	eventTime, err := time.Parse(time.RFC3339, value["time"].(string))
+	eventTime, err := time.Parse(time.RFC3339, fields["time"])
 	if err != nil {
 		return nil, err
 	}
 
 	// data is a json-encoded key-value map.
 	data := make(map[string]string)
-	err = json.Unmarshal([]byte(value["data"].(string)), &data)
+	err = json.Unmarshal([]byte(fields["data"]), &data)
 	if err != nil {
 		return nil, err
 	}
 
+	// Replay fields are only present in replayed events.
+	replayOf, _ := value["replayOf"].(string)
+	target, _ := value["target"].(string)
+	dryRun, _ := value["dryRun"].(string)
+	// Events added before producers were identified don't have it.
+	producer, _ := value["producer"].(string)
+
 	return &Event{
-		Id:     id,
-		Name:   value["name"].(string),
-		Source: value["source"].(string),
-		Code:   value["code"].(string),
-		Time:   eventTime,
-		Data:   data,
-		User:   value["user"].(string),
+		Id:       id,
+		Name:     fields["name"],
+		Source:   fields["source"],
+		Code:     fields["code"],
+		Time:     eventTime,
+		Data:     data,
+		User:     fields["user"],
+		Producer: producer,
+		ReplayOf: replayOf,
+		Target:   target,
+		DryRun:   dryRun == "true",
 	}, nil
 }
 
+// Periodically remove old events according to the retention policy until the
+// context is done.
+func (stream *EventStream) RunTrimmer(ctx context.Context) {
+	store.RunTrimmer(ctx, stream.stream, config.StreamTrimInterval)
+}
+
 // Acknowledge event.
 func (stream *EventStream) Ack(ctx context.Context, id string) error {
 	return stream.stream.Ack(ctx, id)
 }
 
+// Report that the event could not be handled so it is retried later. Returns true
+// if the event has been moved to the dead-letter stream after too many attempts.
+func (stream *EventStream) Fail(ctx context.Context, id string, err error) (bool, error) {
+	return stream.stream.Fail(ctx, id, err)
+}
+
+// Acknowledge the event if it was successfully handled (err is nil) or schedule
+// it for retry otherwise.
+func (stream *EventStream) Done(ctx context.Context, event *Event, err error) error {
+	if err == nil {
+		return stream.Ack(ctx, event.Id)
+	}
+	dead, err := stream.Fail(ctx, event.Id, err)
+	if dead {
+		log.Printf("Event %s (%s) moved to %s stream after too many attempts.\n", event.Id, event.Name, EventStreamName+store.DeadStreamSuffix)
+	}
+	return err
+}
+
 // Add event to stream.
 func (stream *EventStream) Add(ctx context.Context, event *Event) (string, error) {
+	value, err := eventValue(event)
+	if err != nil {
+		return "", err
+	}
+	return stream.stream.Add(ctx, value)
+}
+
+// Add several events to the stream at once. If some events can't be added, their ids
+// are empty and the first error is returned.
+func (stream *EventStream) AddAll(ctx context.Context, events []*Event) ([]string, error) {
+	values := make([]map[string]interface{}, len(events))
+	for i, event := range events {
+		value, err := eventValue(event)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return stream.stream.AddAll(ctx, values)
+}
+
+// Build the stream item value of the event.
+func eventValue(event *Event) (map[string]interface{}, error) {
 	// Converts time to string using RFC3339 format.
 	time, err := event.Time.MarshalText()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	data, err := json.Marshal(event.Data)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	value := map[string]interface{}{
@@ -121,6 +249,13 @@ func (stream *EventStream) Add(ctx context.Context, event *Event) (string, error
 		"code":   event.Code,
 		"data":   data,
 	}
-
-	return stream.stream.Add(ctx, value)
+	if event.Producer != "" {
+		value["producer"] = event.Producer
+	}
+	if event.ReplayOf != "" {
+		value["replayOf"] = event.ReplayOf
+		value["target"] = event.Target
+		value["dryRun"] = fmt.Sprint(event.DryRun)
+	}
+	return value, nil
 }
@@ -0,0 +1,49 @@
+package events
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/komunitin/komunitin/notifications/config"
+	"github.com/komunitin/komunitin/notifications/store"
+)
+
+func TestEventStreamInvalidItem(t *testing.T) {
+	config.StoreBackend = store.MemoryBackend
+	store.ResetMemory()
+	maxAttempts := config.EventsMaxAttempts
+	defer func() { config.EventsMaxAttempts = maxAttempts }()
+	config.EventsMaxAttempts = 1
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := NewEventsStream(ctx, MailerConsumer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := store.NewMemoryStream(EventStreamName, "", store.StreamOptions{})
+	if _, err := raw.Add(ctx, map[string]interface{}{"name": TransferCommitted, "time": "yesterday"}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := stream.Add(ctx, &Event{Name: TransferCommitted, Code: "GRP0", Time: time.Now(), Data: map[string]string{}, User: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The invalid item is skipped and moved to the dead-letter stream.
+	event, err := stream.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Id != id {
+		t.Errorf("Expected event %s, got %s", id, event.Id)
+	}
+	dead, err := store.NewMemoryStream(EventStreamName+store.DeadStreamSuffix, "", store.StreamOptions{}).Range(ctx, "-", "+", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].Value["error"] != `missing event field "source"` {
+		t.Errorf("Expected the invalid item in the dead-letter stream, got %v", dead)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+// Health endpoint with the state of the circuit breakers protecting the external
+// services, so operators can see which ones are failing.
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/komunitin/komunitin/notifications/api"
+	"github.com/komunitin/komunitin/notifications/mails"
+)
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	health := map[string]interface{}{
+		"apiHosts":    api.ClientHealth(),
+		"mailSenders": mails.SenderHealth(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(health); err != nil {
+		log.Printf("Error writing health: %v\n", err)
+	}
+}
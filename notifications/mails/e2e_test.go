@@ -0,0 +1,112 @@
+package mails
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/komunitin/jsonapi"
+	"github.com/komunitin/komunitin/notifications/api/apitest"
+	"github.com/komunitin/komunitin/notifications/config"
+	"github.com/komunitin/komunitin/notifications/events"
+	"github.com/komunitin/komunitin/notifications/store"
+)
+
+// Post events to the /events endpoint and check the emails sent by the mailer, with
+// the resources served by the fake Komunitin API.
+func TestMailerEndToEnd(t *testing.T) {
+	config.StoreBackend = store.MemoryBackend
+	config.NotificationsEventsUsername = "events"
+	config.NotificationsEventsPassword = "secret"
+	store.ResetMemory()
+	server := apitest.NewServer(nil)
+	defer server.Close()
+	defer server.Configure()()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Create the mailer consumer group before posting the events.
+	if _, err := events.NewEventsStream(ctx, events.MailerConsumer); err != nil {
+		t.Fatal(err)
+	}
+	events.InitService()
+	sender := NewMockMailSender()
+	done := make(chan error)
+	go func() { done <- runMailer(ctx, sender) }()
+	defer func() {
+		cancel()
+		<-done
+		mailSender = nil
+		emailQueue = directQueue{}
+	}()
+
+	post := func(name string, data map[string]string) {
+		req := httptest.NewRequest(http.MethodPost, "/events", strings.NewReader(server.Event(name, apitest.GroupCode, apitest.AdminUser, data)))
+		req.Header.Set("Content-Type", jsonapi.MediaType)
+		req.SetBasicAuth("events", "secret")
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != http.StatusCreated {
+			t.Fatalf("Expected 201 posting %s, got %d: %s", name, res.Code, res.Body)
+		}
+	}
+	// Wait until the given number of emails have been sent and return them sorted
+	// by recipient and subject.
+	wait := func(count int) []Email {
+		for {
+			sent := sender.Sent()
+			if len(sent) >= count {
+				sort.Slice(sent, func(i, j int) bool {
+					if sent[i].To[0].Email != sent[j].To[0].Email {
+						return sent[i].To[0].Email < sent[j].To[0].Email
+					}
+					return sent[i].Subject < sent[j].Subject
+				})
+				return sent
+			}
+			select {
+			case <-ctx.Done():
+				t.Fatalf("Expected %d emails, got %d", count, len(sent))
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+
+	post(events.TransferCommitted, map[string]string{
+		"transfer": apitest.TransferId,
+		"payer":    apitest.AliceAccount,
+		"payee":    apitest.BobAccount,
+	})
+	sent := wait(2)
+	if sent[0].To[0].Email != "alice@example.com" || sent[0].Subject != "Payment sent" {
+		t.Errorf("Unexpected email to %s: %s", sent[0].To[0].Email, sent[0].Subject)
+	}
+	if !strings.Contains(sent[0].BodyText, "You have paid") || !strings.Contains(sent[0].BodyText, "Bob") {
+		t.Errorf("Unexpected email text %s", sent[0].BodyText)
+	}
+	if sent[1].To[0].Email != "bob@example.com" || sent[1].Subject != "Pagament rebut" {
+		t.Errorf("Unexpected email to %s: %s", sent[1].To[0].Email, sent[1].Subject)
+	}
+
+	post(events.MemberJoined, map[string]string{"member": apitest.BobMember})
+	post(events.GroupActivated, map[string]string{})
+	sent = wait(4)
+	expected := []string{
+		"admin@example.com: Your group Group Zero has been activated",
+		"alice@example.com: Payment sent",
+		"bob@example.com: Benvingut/da a Group Zero",
+		"bob@example.com: Pagament rebut",
+	}
+	for i, email := range sent {
+		if got := email.To[0].Email + ": " + email.Subject; i >= len(expected) || got != expected[i] {
+			t.Errorf("Unexpected email %s", got)
+		}
+	}
+	if !strings.Contains(sent[2].BodyText, "GRP00002") {
+		t.Errorf("Expected account code in welcome email, got %s", sent[2].BodyText)
+	}
+}
@@ -7,10 +7,14 @@ package mails
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
+	"sync/atomic"
 
 	"github.com/komunitin/komunitin/notifications/api"
+	"github.com/komunitin/komunitin/notifications/breaker"
 	"github.com/komunitin/komunitin/notifications/config"
 	"github.com/komunitin/komunitin/notifications/events"
 	"github.com/komunitin/komunitin/notifications/i18n"
@@ -38,33 +42,131 @@ const (
 var mailSender MailSender
 
 func Mailer(ctx context.Context) error {
+	var sender MailSender
+	if config.SendMails == "true" {
+		var err error
+		sender, err = newMailSenders(config.MailSender)
+		if err != nil {
+			return err
+		}
+	} else {
+		sender = NewMockMailSender()
+	}
+	return runMailer(ctx, sender)
+}
+
+// Handle the events of the mailer consumer, sending the emails with the given sender.
+func runMailer(ctx context.Context, sender MailSender) error {
 	// Open the events stream.
-	stream, err := events.NewEventsStream(ctx, "mailer")
+	stream, err := events.NewEventsStream(ctx, events.MailerConsumer)
 	if err != nil {
 		return err
 	}
+	mailSender = sender
 
-	if config.SendMails == "true" {
-		mailSender = NewMailerSend(config.MailersendApiKey)
-	} else {
-		mailSender = NewMockMailSender()
+	// Emails are queued in the outbox and delivered by a separate loop.
+	outbox, err := NewOutbox(ctx)
+	if err != nil {
+		return err
 	}
+	emailQueue = outbox
+	go func() {
+		if err := outbox.Run(ctx); err != nil {
+			log.Printf("email outbox stopped: %v\n", err)
+		}
+	}()
 
 	// Infinite loop
 	for {
 		// Blocking call to get next event in stream
 		event, err := stream.Get(ctx)
 		if err != nil {
-			// Unexpected error, terminating.
+			// The context is done.
 			return err
 		}
 		err = handleEvent(ctx, event)
-		if err != nil {
-			// Error handling event. Just print and ignore event.
+		if errors.Is(err, api.ErrNotFound) || errors.Is(err, api.ErrUntrustedSource) {
+			// The resources of the event have been deleted or can't be fetched from its
+			// source, so retrying won't help.
+			log.Printf("skipping event %s (%s) in mailer: %v\n", event.Id, event.Name, err)
+			err = nil
+		} else if err != nil {
+			// Error handling event. The event will be retried later.
 			log.Printf("error handling event from mailer: %v\n", err)
 		}
-		// Acknowledge event handled
-		stream.Ack(ctx, event.Id)
+		// Acknowledge event handled or schedule it for retry.
+		if err = stream.Done(ctx, event, err); err != nil {
+			log.Printf("error acknowledging event from mailer: %v\n", err)
+		}
+	}
+}
+
+// The failover sender in use, if several providers are configured.
+var failoverSender atomic.Pointer[FailoverMailSender]
+
+// Return the health of each mail provider by name, or nil if there is a single one.
+func SenderHealth() map[string]breaker.Health {
+	if failover := failoverSender.Load(); failover != nil {
+		return failover.Health()
+	}
+	return nil
+}
+
+// Create the mail sender for the given comma-separated list of provider names.
+// If there are several providers, they are tried in order until one succeeds.
+func newMailSenders(providers string) (MailSender, error) {
+	names := strings.Split(providers, ",")
+	if len(names) == 1 {
+		return newMailSender(strings.TrimSpace(names[0]))
+	}
+	failover := NewFailoverMailSender(config.MailSenderFailureThreshold, config.MailSenderCooldown)
+	failoverSender.Store(failover)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		sender, err := newMailSender(name)
+		if err != nil {
+			return nil, err
+		}
+		failover.Add(name, sender)
+	}
+	return failover, nil
+}
+
+// Create the mail sender for the given provider name.
+func newMailSender(provider string) (MailSender, error) {
+	switch provider {
+	case "", "mailersend":
+		return NewMailerSend(config.MailersendApiKey), nil
+	case "smtp":
+		smtpConfig := SmtpConfig{
+			Host:         config.SmtpHost,
+			Port:         config.SmtpPort,
+			Username:     config.SmtpUsername,
+			Password:     config.SmtpPassword,
+			Auth:         config.SmtpAuth,
+			Security:     config.SmtpSecurity,
+			DkimDomain:   config.DkimDomain,
+			DkimSelector: config.DkimSelector,
+		}
+		if smtpConfig.Security == "" {
+			smtpConfig.Security = SmtpStartTls
+		}
+		if smtpConfig.Auth == "" {
+			smtpConfig.Auth = SmtpAuthPlain
+		}
+		if err := smtpConfig.Validate(); err != nil {
+			return nil, err
+		}
+		if config.DkimPrivateKeyFile != "" {
+			signer, err := LoadDkimSigner(config.DkimPrivateKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("error loading DKIM key: %v", err)
+			}
+			smtpConfig.DkimSigner = signer
+		}
+		return NewSmtpSender(smtpConfig), nil
+	default:
+		return nil, fmt.Errorf("unknown mail sender %s", provider)
 	}
 }
 
@@ -77,6 +179,10 @@ func handleEvent(ctx context.Context, event *events.Event) error {
 	if err != nil {
 		return err
 	}
+	if event.DryRun {
+		ctx = context.WithValue(ctx, dryRunKey{}, true)
+	}
+	ctx = context.WithValue(ctx, eventIdKey{}, event.Id)
 
 	// Handle event depending on its type
 	switch event.Name {
@@ -292,12 +398,29 @@ func handleGroupActivated(ctx context.Context, event *events.Event) error {
 	return err
 }
 
+// Context key set when handling dry run replayed events.
+type dryRunKey struct{}
+
+// Context key with the id of the event being handled.
+type eventIdKey struct{}
+
 func sendEmail(ctx context.Context, message *Email, name string, email string) error {
 	message.From.Name = "Komunitin"
 	message.From.Email = "noreply@komunitin.org"
 
 	message.AddRecipient(name, email)
-	return mailSender.SendMail(ctx, *message)
+	if dryRun, _ := ctx.Value(dryRunKey{}).(bool); dryRun {
+		log.Printf("Dry run: email %q to %s not sent.\n", message.Subject, email)
+		return nil
+	}
+	// Emails are keyed by event, recipient and subject so they are not sent twice
+	// when the event is retried.
+	key := ""
+	if eventId, _ := ctx.Value(eventIdKey{}).(string); eventId != "" {
+		key = eventId + "\n" + email + "\n" + message.Subject
+	}
+	_, err := emailQueue.Enqueue(ctx, key, *message)
+	return err
 }
 
 func sendTransferEmail(ctx context.Context, user *api.User, payer *api.Member, payee *api.Member, transfer *api.Transfer, emailType TransferEmailType) error {
@@ -1,6 +1,9 @@
 package mails
 
-import "context"
+import (
+	"context"
+	"errors"
+)
 
 type Recipient struct {
 	Name  string
@@ -20,6 +23,12 @@ func (e *Email) AddRecipient(name, email string) {
 	e.To = append(e.To, Recipient{Name: name, Email: email})
 }
 
+// Wrapped by the errors of senders when the provider rejects the message itself, for
+// example because of an invalid recipient. The provider works, so it doesn't count as
+// a provider failure, and sending the same message again won't help.
+var ErrRejected = errors.New("email rejected")
+
 type MailSender interface {
-	SendMail(ctx context.Context, message Email) error
+	// Send the email and return the message id assigned by the provider.
+	SendMail(ctx context.Context, message Email) (string, error)
 }
@@ -0,0 +1,85 @@
+package mails
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/komunitin/komunitin/notifications/breaker"
+)
+
+// Mail sender that tries an ordered list of senders until one succeeds. Senders
+// that fail repeatedly are skipped for a while by means of a circuit breaker. Only
+// connection and transient errors count as failures: messages rejected by a sender
+// are not sent with the next one.
+type FailoverMailSender struct {
+	senders   []*failoverEntry
+	threshold int
+	cooldown  time.Duration
+}
+
+type failoverEntry struct {
+	name    string
+	sender  MailSender
+	breaker *breaker.Breaker
+}
+
+// Create an empty failover sender. Senders are skipped after threshold consecutive
+// failures and tried again after the cooldown period.
+func NewFailoverMailSender(threshold int, cooldown time.Duration) *FailoverMailSender {
+	return &FailoverMailSender{
+		senders:   []*failoverEntry{},
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Add a sender to the end of the list.
+func (f *FailoverMailSender) Add(name string, sender MailSender) {
+	f.senders = append(f.senders, &failoverEntry{
+		name:    name,
+		sender:  sender,
+		breaker: breaker.New(f.threshold, f.cooldown),
+	})
+}
+
+func (f *FailoverMailSender) SendMail(ctx context.Context, message Email) (string, error) {
+	var errs []error
+	for _, entry := range f.senders {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		if !entry.breaker.Allow() {
+			errs = append(errs, fmt.Errorf("%s: %w", entry.name, breaker.ErrOpen))
+			continue
+		}
+		id, err := entry.sender.SendMail(ctx, message)
+		if err == nil || errors.Is(err, ErrRejected) {
+			// The provider works even if it rejects the message.
+			if entry.breaker.Health().State != breaker.Closed {
+				log.Printf("Mail sender %s recovered\n", entry.name)
+			}
+			entry.breaker.Success()
+			return id, err
+		}
+		entry.breaker.Failure(err)
+		if entry.breaker.Health().State == breaker.Open {
+			log.Printf("Mail sender %s disabled for %v after error: %v\n", entry.name, f.cooldown, err)
+		} else {
+			log.Printf("Mail sender %s failed, trying next one: %v\n", entry.name, err)
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", entry.name, err))
+	}
+	return "", fmt.Errorf("all mail senders failed: %w", errors.Join(errs...))
+}
+
+// Return the health of each sender by name.
+func (f *FailoverMailSender) Health() map[string]breaker.Health {
+	health := make(map[string]breaker.Health, len(f.senders))
+	for _, entry := range f.senders {
+		health[entry.name] = entry.breaker.Health()
+	}
+	return health
+}
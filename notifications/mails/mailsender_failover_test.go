@@ -0,0 +1,82 @@
+package mails
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Mail sender that fails while fail is true, or rejects the messages if reject is true.
+type flakyMailSender struct {
+	fail   bool
+	reject bool
+	calls  int
+}
+
+func (s *flakyMailSender) SendMail(ctx context.Context, message Email) (string, error) {
+	s.calls++
+	if s.reject {
+		return "", fmt.Errorf("%w: 550 No such user", ErrRejected)
+	}
+	if s.fail {
+		return "", errors.New("503 Service Unavailable")
+	}
+	return "id", nil
+}
+
+func TestFailoverMailSender(t *testing.T) {
+	primary := &flakyMailSender{fail: true}
+	secondary := &flakyMailSender{}
+	failover := NewFailoverMailSender(2, 50*time.Millisecond)
+	failover.Add("primary", primary)
+	failover.Add("secondary", secondary)
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if _, err := failover.SendMail(ctx, testEmail()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Primary is skipped after 2 failures.
+	if primary.calls != 2 || secondary.calls != 3 {
+		t.Errorf("Expected 2 and 3 calls, got %d and %d", primary.calls, secondary.calls)
+	}
+	health := failover.Health()
+	if health["primary"].Failures != 2 || health["secondary"].Successes != 3 {
+		t.Errorf("Unexpected health %+v", health)
+	}
+
+	// Primary is used again once it recovers.
+	primary.fail = false
+	time.Sleep(60 * time.Millisecond)
+	if _, err := failover.SendMail(ctx, testEmail()); err != nil {
+		t.Fatal(err)
+	}
+	if primary.calls != 3 || secondary.calls != 3 {
+		t.Errorf("Expected 3 and 3 calls, got %d and %d", primary.calls, secondary.calls)
+	}
+
+	// All senders failing.
+	primary.fail = true
+	secondary.fail = true
+	if _, err := failover.SendMail(ctx, testEmail()); err == nil {
+		t.Error("Expected error when all senders fail")
+	}
+
+	// Rejected messages are not provider failures and are not sent by the next one.
+	primary = &flakyMailSender{reject: true}
+	secondary = &flakyMailSender{}
+	failover = NewFailoverMailSender(1, time.Minute)
+	failover.Add("primary", primary)
+	failover.Add("secondary", secondary)
+	for i := 0; i < 2; i++ {
+		if _, err := failover.SendMail(ctx, testEmail()); !errors.Is(err, ErrRejected) {
+			t.Errorf("Expected rejected error, got %v", err)
+		}
+	}
+	if health := failover.Health(); primary.calls != 2 || secondary.calls != 0 || health["primary"].Failures != 0 {
+		t.Errorf("Unexpected calls %d and %d with health %+v", primary.calls, secondary.calls, health)
+	}
+}
@@ -3,9 +3,14 @@ package mails
 import (
 	"context"
 	"log"
+	"slices"
+	"sync"
+
+	"github.com/rs/xid"
 )
 
 type MailSenderMock struct {
+	mu         sync.Mutex
 	SentEmails []Email
 }
 
@@ -15,7 +20,9 @@ func NewMockMailSender() *MailSenderMock {
 	}
 }
 
-func (ms *MailSenderMock) SendMail(ctx context.Context, message Email) error {
+func (ms *MailSenderMock) SendMail(ctx context.Context, message Email) (string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
 	ms.SentEmails = append(ms.SentEmails, message)
 	log.Printf(`==============EMAIL==============
 	From: %s <%s>
@@ -24,5 +31,12 @@ func (ms *MailSenderMock) SendMail(ctx context.Context, message Email) error {
 	Text: %s
 	=================================
 	`, message.From.Name, message.From.Email, message.To[0].Name, message.To[0].Email, message.Subject, message.BodyText)
-	return nil
+	return xid.New().String(), nil
+}
+
+// Return a copy of the emails sent so far, safe to call while sending.
+func (ms *MailSenderMock) Sent() []Email {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return slices.Clone(ms.SentEmails)
 }
@@ -2,6 +2,7 @@ package mails
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -20,7 +21,7 @@ func NewMailerSend(apiKey string) *MailerSend {
 	}
 }
 
-func (ms *MailerSend) SendMail(ctx context.Context, message Email) error {
+func (ms *MailerSend) SendMail(ctx context.Context, message Email) (string, error) {
 	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
@@ -42,17 +43,33 @@ func (ms *MailerSend) SendMail(ctx context.Context, message Email) error {
 	m.SetText(message.BodyText)
 
 	res, err := ms.ms.Email.Send(ctx, m)
+	var errRes *mailersend.ErrorResponse
+	if errors.As(err, &errRes) && rejectedStatus(errRes.Response.StatusCode) {
+		return "", fmt.Errorf("%w: %w", ErrRejected, err)
+	}
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	if res.StatusCode >= http.StatusBadRequest {
-		return fmt.Errorf("error sending email: %s", res.Status)
+		err := fmt.Errorf("error sending email: %s", res.Status)
+		if rejectedStatus(res.StatusCode) {
+			return "", fmt.Errorf("%w: %w", ErrRejected, err)
+		}
+		return "", err
 	}
 
 	for _, recipient := range recipients {
 		log.Printf("Email sent to %s <%s>\n", recipient.Name, recipient.Email)
 	}
 
-	return nil
+	return res.Header.Get("X-Message-Id"), nil
+}
+
+// Whether the status means that the message is invalid, for example because of a wrong
+// recipient address, rather than a problem with the account or the service.
+func rejectedStatus(status int) bool {
+	return status >= http.StatusBadRequest && status < http.StatusInternalServerError &&
+		status != http.StatusUnauthorized && status != http.StatusForbidden &&
+		status != http.StatusRequestTimeout && status != http.StatusTooManyRequests
 }
@@ -0,0 +1,350 @@
+package mails
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/rs/xid"
+)
+
+// Connection security for SMTP servers.
+const (
+	// Upgrade plain connection to TLS with the STARTTLS command.
+	SmtpStartTls = "starttls"
+	// Connect using TLS from the beginning (usually port 465).
+	SmtpTls = "tls"
+	// Don't use TLS. Only for local servers.
+	SmtpNone = "none"
+)
+
+// SMTP authentication mechanisms.
+const (
+	SmtpAuthPlain = "plain"
+	SmtpAuthLogin = "login"
+)
+
+type SmtpConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	// One of SmtpAuthPlain or SmtpAuthLogin. Only used if Username is set.
+	Auth string
+	// One of SmtpStartTls, SmtpTls or SmtpNone.
+	Security string
+	// Optional DKIM signing. Messages are signed if DkimSigner is set.
+	DkimDomain   string
+	DkimSelector string
+	DkimSigner   crypto.Signer
+}
+
+// Check that the security and auth settings are supported ones, so a typo doesn't
+// silently send credentials over a plain connection.
+func (config *SmtpConfig) Validate() error {
+	switch config.Security {
+	case SmtpStartTls, SmtpTls, SmtpNone:
+	default:
+		return fmt.Errorf("unknown SMTP security %q, expected %s, %s or %s", config.Security, SmtpStartTls, SmtpTls, SmtpNone)
+	}
+	switch config.Auth {
+	case SmtpAuthPlain, SmtpAuthLogin:
+	default:
+		if config.Username == "" {
+			// No authentication.
+			return nil
+		}
+		return fmt.Errorf("unknown SMTP auth %q, expected %s or %s", config.Auth, SmtpAuthPlain, SmtpAuthLogin)
+	}
+	return nil
+}
+
+type SmtpSender struct {
+	config SmtpConfig
+}
+
+func NewSmtpSender(config SmtpConfig) *SmtpSender {
+	return &SmtpSender{
+		config: config,
+	}
+}
+
+// Load a PEM encoded RSA or Ed25519 private key from the given file to be used
+// as DKIM signer.
+func LoadDkimSigner(file string) (crypto.Signer, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", file)
+	}
+	var key any
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported DKIM key type %T", key)
+	}
+	return signer, nil
+}
+
+func (s *SmtpSender) SendMail(ctx context.Context, message Email) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	messageId := "<" + xid.New().String() + "@" + domain(message.From.Email) + ">"
+	data, err := s.buildMessage(message, messageId)
+	if err != nil {
+		return "", err
+	}
+	if s.config.DkimSigner != nil {
+		data, err = s.sign(data)
+		if err != nil {
+			return "", fmt.Errorf("error signing email: %v", err)
+		}
+	}
+
+	client, err := s.connect(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	if err := client.Mail(message.From.Email); err != nil {
+		return "", rejected(err)
+	}
+	for _, to := range message.To {
+		if err := client.Rcpt(to.Email); err != nil {
+			return "", rejected(err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return "", rejected(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", rejected(err)
+	}
+	if err := client.Quit(); err != nil {
+		return "", err
+	}
+
+	for _, recipient := range message.To {
+		log.Printf("Email sent to %s <%s>\n", recipient.Name, recipient.Email)
+	}
+	return messageId, nil
+}
+
+// Wrap permanent (5xx) replies to the message commands with ErrRejected. Transient
+// (4xx) replies and connection errors are returned as they are.
+func rejected(err error) error {
+	var reply *textproto.Error
+	if errors.As(err, &reply) && reply.Code >= 500 {
+		return fmt.Errorf("%w: %w", ErrRejected, err)
+	}
+	return err
+}
+
+// Open the connection to the SMTP server, set up TLS and authenticate.
+func (s *SmtpSender) connect(ctx context.Context) (*smtp.Client, error) {
+	if err := s.config.Validate(); err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(s.config.Host, strconv.Itoa(s.config.Port))
+	tlsConfig := &tls.Config{ServerName: s.config.Host}
+
+	var conn net.Conn
+	var err error
+	if s.config.Security == SmtpTls {
+		dialer := &tls.Dialer{Config: tlsConfig}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	} else {
+		dialer := &net.Dialer{}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Apply the context deadline to the whole SMTP conversation.
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, s.config.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if s.config.Security == SmtpStartTls {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			client.Close()
+			return nil, errors.New("SMTP server does not support STARTTLS")
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	if s.config.Username != "" {
+		var auth smtp.Auth
+		switch s.config.Auth {
+		case SmtpAuthLogin:
+			auth = &loginAuth{username: s.config.Username, password: s.config.Password, host: s.config.Host}
+		case SmtpAuthPlain:
+			auth = smtp.PlainAuth("", s.config.Username, s.config.Password, s.config.Host)
+		}
+		if err := client.Auth(auth); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// Build the RFC 5322 message with a multipart/alternative body with the text and
+// HTML versions of the email.
+func (s *SmtpSender) buildMessage(message Email, messageId string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	to := make([]string, 0, len(message.To))
+	for _, recipient := range message.To {
+		to = append(to, address(recipient))
+	}
+	writeHeader(&buf, "From", address(message.From))
+	writeHeader(&buf, "To", strings.Join(to, ", "))
+	if message.ReplyTo.Email != "" {
+		writeHeader(&buf, "Reply-To", address(message.ReplyTo))
+	}
+	writeHeader(&buf, "Subject", mime.QEncoding.Encode("utf-8", message.Subject))
+	writeHeader(&buf, "Date", time.Now().Format(time.RFC1123Z))
+	writeHeader(&buf, "Message-ID", messageId)
+	writeHeader(&buf, "MIME-Version", "1.0")
+
+	mw := multipart.NewWriter(&buf)
+	writeHeader(&buf, "Content-Type", mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": mw.Boundary()}))
+	buf.WriteString("\r\n")
+
+	// Parts are ordered by preference, the last one being the preferred.
+	parts := []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", message.BodyText},
+		{"text/html; charset=utf-8", message.BodyHtml},
+	}
+	for _, part := range parts {
+		if part.body == "" {
+			continue
+		}
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := io.WriteString(qp, part.body); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Add the DKIM-Signature header to the message.
+func (s *SmtpSender) sign(data []byte) ([]byte, error) {
+	var signed bytes.Buffer
+	err := dkim.Sign(&signed, bytes.NewReader(data), &dkim.SignOptions{
+		Domain:                 s.config.DkimDomain,
+		Selector:               s.config.DkimSelector,
+		Signer:                 s.config.DkimSigner,
+		HeaderCanonicalization: dkim.CanonicalizationRelaxed,
+		BodyCanonicalization:   dkim.CanonicalizationRelaxed,
+		HeaderKeys:             []string{"From", "To", "Reply-To", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return signed.Bytes(), nil
+}
+
+func writeHeader(buf *bytes.Buffer, key string, value string) {
+	buf.WriteString(key + ": " + value + "\r\n")
+}
+
+func address(recipient Recipient) string {
+	return (&mail.Address{Name: recipient.Name, Address: recipient.Email}).String()
+}
+
+func domain(email string) string {
+	if i := strings.LastIndex(email, "@"); i >= 0 {
+		return email[i+1:]
+	}
+	return "localhost"
+}
+
+// Implements the LOGIN authentication mechanism, not provided by net/smtp but
+// still required by some servers.
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// Same restriction as smtp.PlainAuth: don't send passwords over plain connections.
+	if !server.TLS && server.Name != "localhost" && server.Name != "127.0.0.1" && server.Name != "::1" {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected server challenge: %s", fromServer)
+	}
+}
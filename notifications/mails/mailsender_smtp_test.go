@@ -0,0 +1,266 @@
+package mails
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/komunitin/komunitin/notifications/config"
+)
+
+// Local SMTP sink that accepts a single message and records the conversation.
+type smtpSink struct {
+	listener net.Listener
+	auth     string
+	from     string
+	rcpt     []string
+	data     []byte
+	done     chan bool
+}
+
+func newSmtpSink(t *testing.T) *smtpSink {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &smtpSink{listener: listener, done: make(chan bool)}
+	go sink.serve()
+	return sink
+}
+
+func (sink *smtpSink) port() int {
+	return sink.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (sink *smtpSink) serve() {
+	defer close(sink.done)
+	conn, err := sink.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+
+	reply("220 localhost ESMTP sink")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO":
+			reply("250-localhost")
+			reply("250-AUTH PLAIN LOGIN")
+			reply("250 8BITMIME")
+		case "AUTH":
+			args := strings.Fields(line)
+			if strings.ToUpper(args[1]) == "PLAIN" {
+				decoded, _ := base64.StdEncoding.DecodeString(args[2])
+				sink.auth = "PLAIN " + strings.ReplaceAll(string(decoded), "\x00", " ")
+			} else {
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte("Username:")))
+				user, _ := r.ReadString('\n')
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte("Password:")))
+				pass, _ := r.ReadString('\n')
+				u, _ := base64.StdEncoding.DecodeString(strings.TrimSpace(user))
+				p, _ := base64.StdEncoding.DecodeString(strings.TrimSpace(pass))
+				sink.auth = "LOGIN " + string(u) + " " + string(p)
+			}
+			reply("235 Authentication successful")
+		case "MAIL":
+			sink.from = line
+			reply("250 OK")
+		case "RCPT":
+			sink.rcpt = append(sink.rcpt, line)
+			reply("250 OK")
+		case "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data bytes.Buffer
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(l, "."))
+			}
+			sink.data = data.Bytes()
+			reply("250 OK")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+func testEmail() Email {
+	message := Email{
+		Subject:  "Pagament rebut ✓",
+		BodyText: "Hello Payee,\nYou have received 1.00€.",
+		BodyHtml: "<p>Hello Payee,</p><p>You have received <b>1.00€</b>.</p>",
+		From:     Recipient{Name: "Komunitin", Email: "noreply@komunitin.org"},
+	}
+	message.AddRecipient("Payee", "payee@example.com")
+	return message
+}
+
+func TestSmtpSender(t *testing.T) {
+	for _, auth := range []string{SmtpAuthPlain, SmtpAuthLogin} {
+		sink := newSmtpSink(t)
+		sender := NewSmtpSender(SmtpConfig{
+			Host:     "127.0.0.1",
+			Port:     sink.port(),
+			Username: "user",
+			Password: "secret",
+			Auth:     auth,
+			Security: SmtpNone,
+		})
+		_, err := sender.SendMail(context.Background(), testEmail())
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-sink.done
+		sink.listener.Close()
+
+		if !strings.HasSuffix(sink.auth, "user secret") {
+			t.Errorf("Unexpected %s authentication: %s", auth, sink.auth)
+		}
+		if sink.from != "MAIL FROM:<noreply@komunitin.org> BODY=8BITMIME" && sink.from != "MAIL FROM:<noreply@komunitin.org>" {
+			t.Errorf("Unexpected MAIL command: %s", sink.from)
+		}
+		if len(sink.rcpt) != 1 || sink.rcpt[0] != "RCPT TO:<payee@example.com>" {
+			t.Errorf("Unexpected RCPT commands: %v", sink.rcpt)
+		}
+
+		msg, err := mail.ReadMessage(bytes.NewReader(sink.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+		if subject != "Pagament rebut ✓" {
+			t.Errorf("Unexpected subject %s", subject)
+		}
+		mediaType, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		if mediaType != "multipart/alternative" {
+			t.Fatalf("Unexpected content type %s", mediaType)
+		}
+		parts := map[string]string{}
+		mr := multipart.NewReader(msg.Body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(quotedprintable.NewReader(part))
+			partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			// Line breaks are sent as CRLF.
+			parts[partType] = strings.ReplaceAll(string(body), "\r\n", "\n")
+		}
+		if parts["text/plain"] != testEmail().BodyText {
+			t.Errorf("Unexpected text part %q", parts["text/plain"])
+		}
+		if parts["text/html"] != testEmail().BodyHtml {
+			t.Errorf("Unexpected html part %q", parts["text/html"])
+		}
+	}
+}
+
+func TestSmtpSenderDkim(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := newSmtpSink(t)
+	defer sink.listener.Close()
+	sender := NewSmtpSender(SmtpConfig{
+		Host:         "127.0.0.1",
+		Port:         sink.port(),
+		Security:     SmtpNone,
+		DkimDomain:   "komunitin.org",
+		DkimSelector: "mail",
+		DkimSigner:   key,
+	})
+	if _, err := sender.SendMail(context.Background(), testEmail()); err != nil {
+		t.Fatal(err)
+	}
+	<-sink.done
+
+	public, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(sink.data), &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			if domain != "mail._domainkey.komunitin.org" {
+				t.Errorf("Unexpected DKIM lookup %s", domain)
+			}
+			return []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(public)}, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verifications) != 1 || verifications[0].Err != nil {
+		t.Fatalf("DKIM verification failed: %v", verifications)
+	}
+	if verifications[0].Domain != "komunitin.org" {
+		t.Errorf("Unexpected DKIM domain %s", verifications[0].Domain)
+	}
+}
+
+func TestNewSmtpMailSender(t *testing.T) {
+	defer func(security string, auth string) {
+		config.SmtpSecurity, config.SmtpAuth = security, auth
+	}(config.SmtpSecurity, config.SmtpAuth)
+	config.SmtpUsername = "user"
+	defer func() { config.SmtpUsername = "" }()
+
+	for _, settings := range [][2]string{{"", ""}, {SmtpTls, SmtpAuthLogin}, {SmtpNone, SmtpAuthPlain}} {
+		config.SmtpSecurity, config.SmtpAuth = settings[0], settings[1]
+		if _, err := newMailSender("smtp"); err != nil {
+			t.Errorf("Unexpected error for %v: %v", settings, err)
+		}
+	}
+	// Typos must not fall back to plain connections or another mechanism.
+	for _, settings := range [][2]string{{"ssl", ""}, {"", "cram-md5"}} {
+		config.SmtpSecurity, config.SmtpAuth = settings[0], settings[1]
+		if _, err := newMailSender("smtp"); err == nil {
+			t.Errorf("Expected error for %v", settings)
+		}
+	}
+	sender := NewSmtpSender(SmtpConfig{Host: "127.0.0.1", Port: 1, Security: "ssl"})
+	if _, err := sender.SendMail(context.Background(), testEmail()); err == nil || !strings.Contains(err.Error(), "unknown SMTP security") {
+		t.Errorf("Expected security error, got %v", err)
+	}
+}
+
+func TestSmtpRejected(t *testing.T) {
+	if err := rejected(&textproto.Error{Code: 550, Msg: "No such user"}); !errors.Is(err, ErrRejected) {
+		t.Errorf("Expected rejected error for 550, got %v", err)
+	}
+	if err := rejected(&textproto.Error{Code: 451, Msg: "Try again later"}); errors.Is(err, ErrRejected) {
+		t.Errorf("Unexpected rejected error for 451: %v", err)
+	}
+}
@@ -0,0 +1,245 @@
+package mails
+
+// Implements a persistent queue of outgoing emails.
+//
+// Rendered emails are saved in the store and their ids are added to the emails
+// stream. A separate loop reads the stream and delivers the emails, retrying them
+// with backoff if the mail provider fails. The delivery status of each email is
+// kept in the store so failures can be diagnosed, and can be checked with the
+// email-status command.
+//
+// Emails of an event are keyed by the event id and the recipient, so when an event is
+// retried after some of its emails were queued, these are not queued again.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/komunitin/komunitin/notifications/config"
+	"github.com/komunitin/komunitin/notifications/store"
+	"github.com/rs/xid"
+)
+
+// Email delivery status
+const (
+	EmailQueued = "queued"
+	EmailSent   = "sent"
+	EmailFailed = "failed"
+)
+
+const (
+	OutboxStreamName = "emails"
+	outboxClass      = "emails"
+)
+
+// Email delivery record as saved in the store.
+type OutboxEmail struct {
+	Id     string `json:"id"`
+	Email  Email  `json:"email"`
+	Status string `json:"status"`
+	// Number of delivery attempts so far.
+	Attempts int `json:"attempts"`
+	// Message id assigned by the mail provider once sent.
+	MessageId string `json:"messageId"`
+	// Error of the last failed attempt.
+	Error   string    `json:"error"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// Queue of outgoing emails.
+type EmailQueue interface {
+	// Add the email to the queue and return its id. If key is not empty and an email
+	// with the same key has already been queued, it is not queued again and the id of
+	// the existing one is returned.
+	Enqueue(ctx context.Context, key string, message Email) (string, error)
+}
+
+// Queue that sends emails immediately using the mail sender. It is used when
+// the outbox is not running, for example in tests.
+type directQueue struct{}
+
+func (directQueue) Enqueue(ctx context.Context, key string, message Email) (string, error) {
+	return mailSender.SendMail(ctx, message)
+}
+
+var emailQueue EmailQueue = directQueue{}
+
+type Outbox struct {
+	store  store.Store
+	stream store.Stream
+}
+
+func NewOutbox(ctx context.Context) (*Outbox, error) {
+	s, err := store.NewStore()
+	if err != nil {
+		return nil, err
+	}
+	stream, err := store.NewStream(ctx, OutboxStreamName, "sender", store.StreamOptions{
+		MaxAttempts:   config.EmailsMaxAttempts,
+		RetryDelay:    config.EmailsRetryDelay,
+		MaxRetryDelay: config.EmailsMaxRetryDelay,
+		ClaimIdle:     config.EventsClaimIdle,
+		ClaimInterval: config.EventsClaimInterval,
+		MaxLen:        int64(config.EmailsStreamMaxLen),
+		MaxAge:        config.EmailsStreamMaxAge,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Outbox{store: s, stream: stream}, nil
+}
+
+func (outbox *Outbox) Enqueue(ctx context.Context, key string, message Email) (string, error) {
+	now := time.Now()
+	email := &OutboxEmail{
+		Id:      xid.New().String(),
+		Email:   message,
+		Status:  EmailQueued,
+		Created: now,
+		Updated: now,
+	}
+	if key == "" {
+		if err := outbox.save(ctx, email); err != nil {
+			return "", err
+		}
+	} else {
+		hash := sha256.Sum256([]byte(key))
+		email.Id = hex.EncodeToString(hash[:16])
+		created, err := outbox.store.SetIfAbsent(ctx, outboxClass, email.Id, email, config.EmailsRetention)
+		if err != nil {
+			return "", err
+		}
+		if !created {
+			existing, err := outbox.Get(ctx, email.Id)
+			if err != nil {
+				return "", err
+			}
+			if existing.Status != EmailQueued {
+				log.Printf("Email %s to %s already %s.\n", email.Id, recipients(message), existing.Status)
+				return email.Id, nil
+			}
+			// The previous attempt may have saved the record but failed adding it to
+			// the stream. Deliver skips records that aren't queued, so adding it twice
+			// is harmless.
+		}
+	}
+	_, err := outbox.stream.Add(ctx, map[string]interface{}{"id": email.Id})
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Email %s to %s queued.\n", email.Id, recipients(message))
+	return email.Id, nil
+}
+
+func recipients(message Email) string {
+	addresses := make([]string, len(message.To))
+	for i, to := range message.To {
+		addresses[i] = to.Email
+	}
+	return strings.Join(addresses, ", ")
+}
+
+// Get the delivery record of the given email.
+func (outbox *Outbox) Get(ctx context.Context, id string) (*OutboxEmail, error) {
+	email := new(OutboxEmail)
+	err := outbox.store.Get(ctx, outboxClass, id, email)
+	if err != nil {
+		return nil, err
+	}
+	return email, nil
+}
+
+// Deliver queued emails. This function blocks until the context is done or
+// there is an unexpected error reading the queue.
+func (outbox *Outbox) Run(ctx context.Context) error {
+	go store.RunTrimmer(ctx, outbox.stream, config.StreamTrimInterval)
+	failures := 0
+	for {
+		messageId, value, err := outbox.stream.Get(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			failures++
+			log.Printf("Error reading %s stream: %v\n", OutboxStreamName, err)
+			if err := store.WaitReadRetry(ctx, failures); err != nil {
+				return err
+			}
+			continue
+		}
+		failures = 0
+		id, _ := value["id"].(string)
+		err = outbox.deliver(ctx, id)
+		if err == nil {
+			err = outbox.stream.Ack(ctx, messageId)
+		} else if errors.Is(err, ErrRejected) {
+			// Retrying won't help.
+			log.Printf("Email %s rejected: %v\n", id, err)
+			outbox.setStatus(ctx, id, EmailFailed)
+			err = outbox.stream.Ack(ctx, messageId)
+		} else {
+			log.Printf("Error sending email %s: %v\n", id, err)
+			var dead bool
+			dead, err = outbox.stream.Fail(ctx, messageId, err)
+			if dead {
+				outbox.setStatus(ctx, id, EmailFailed)
+				log.Printf("Email %s moved to %s stream after too many attempts.\n", id, OutboxStreamName+store.DeadStreamSuffix)
+			}
+		}
+		if err != nil {
+			log.Printf("Error acknowledging email %s: %v\n", id, err)
+		}
+	}
+}
+
+// Send the given email and update its delivery record.
+func (outbox *Outbox) deliver(ctx context.Context, id string) error {
+	email, err := outbox.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if email.Status != EmailQueued {
+		// Already handled, for example if the item is delivered twice by the stream.
+		return nil
+	}
+	messageId, sendErr := mailSender.SendMail(ctx, email.Email)
+	email.Attempts++
+	email.Updated = time.Now()
+	if sendErr != nil {
+		email.Error = sendErr.Error()
+	} else {
+		email.Status = EmailSent
+		email.MessageId = messageId
+		email.Error = ""
+	}
+	if err := outbox.save(ctx, email); err != nil {
+		return err
+	}
+	if sendErr == nil {
+		log.Printf("Email %s sent with message id %s after %d attempts.\n", id, messageId, email.Attempts)
+	}
+	return sendErr
+}
+
+func (outbox *Outbox) setStatus(ctx context.Context, id string, status string) {
+	email, err := outbox.Get(ctx, id)
+	if err != nil {
+		log.Printf("Error getting email %s: %v\n", id, err)
+		return
+	}
+	email.Status = status
+	email.Updated = time.Now()
+	if err := outbox.save(ctx, email); err != nil {
+		log.Printf("Error saving email %s: %v\n", id, err)
+	}
+}
+
+func (outbox *Outbox) save(ctx context.Context, email *OutboxEmail) error {
+	return outbox.store.Set(ctx, outboxClass, email.Id, email, nil, config.EmailsRetention)
+}
@@ -0,0 +1,230 @@
+package mails
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/komunitin/komunitin/notifications/config"
+	"github.com/komunitin/komunitin/notifications/store"
+)
+
+// Mail sender that returns the given errors in order and then succeeds.
+type scriptedMailSender struct {
+	mu     sync.Mutex
+	errors []error
+	calls  int
+}
+
+func (s *scriptedMailSender) SendMail(ctx context.Context, message Email) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if len(s.errors) > 0 {
+		err := s.errors[0]
+		s.errors = s.errors[1:]
+		return "", err
+	}
+	return fmt.Sprintf("message-%d", s.calls), nil
+}
+
+func (s *scriptedMailSender) Calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+func newTestOutbox(t *testing.T, ctx context.Context) *Outbox {
+	config.StoreBackend = store.MemoryBackend
+	store.ResetMemory()
+	maxAttempts, retryDelay, maxRetryDelay := config.EmailsMaxAttempts, config.EmailsRetryDelay, config.EmailsMaxRetryDelay
+	t.Cleanup(func() {
+		config.EmailsMaxAttempts, config.EmailsRetryDelay, config.EmailsMaxRetryDelay = maxAttempts, retryDelay, maxRetryDelay
+		mailSender = nil
+	})
+	config.EmailsMaxAttempts = 3
+	config.EmailsRetryDelay = time.Millisecond
+	config.EmailsMaxRetryDelay = time.Millisecond
+	outbox, err := NewOutbox(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return outbox
+}
+
+// Wait until the email has the given status.
+func waitStatus(t *testing.T, ctx context.Context, outbox *Outbox, id string, status string) *OutboxEmail {
+	t.Helper()
+	for {
+		email, err := outbox.Get(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if email.Status == status {
+			return email
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("Expected email %s to be %s, got %s", id, status, email.Status)
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+func TestOutboxEnqueue(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	outbox := newTestOutbox(t, ctx)
+
+	id, err := outbox.Enqueue(ctx, "event\npayee@example.com", testEmail())
+	if err != nil {
+		t.Fatal(err)
+	}
+	email, err := outbox.Get(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if email.Status != EmailQueued || email.Attempts != 0 || email.Email.To[0].Email != "payee@example.com" {
+		t.Errorf("Unexpected email %+v", email)
+	}
+
+	// Emails with the same key are not saved again. While still queued, they are
+	// added to the stream again in case the previous attempt failed doing so.
+	again, err := outbox.Enqueue(ctx, "event\npayee@example.com", testEmail())
+	if err != nil || again != id {
+		t.Errorf("Expected id %s, got %s, %v", id, again, err)
+	}
+	other, err := outbox.Enqueue(ctx, "other\npayee@example.com", testEmail())
+	if err != nil || other == id {
+		t.Errorf("Expected a new id, got %s, %v", other, err)
+	}
+	unkeyed, err := outbox.Enqueue(ctx, "", testEmail())
+	if err != nil || unkeyed == id || unkeyed == other {
+		t.Errorf("Expected a new id, got %s, %v", unkeyed, err)
+	}
+	items, err := outbox.stream.Range(ctx, "-", "+", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 4 {
+		t.Errorf("Expected 4 stream items, got %d", len(items))
+	}
+
+	// Sent emails are not added to the stream again.
+	email.Status = EmailSent
+	if err := outbox.save(ctx, email); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := outbox.Enqueue(ctx, "event\npayee@example.com", testEmail()); err != nil {
+		t.Fatal(err)
+	}
+	items, err = outbox.stream.Range(ctx, "-", "+", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 4 {
+		t.Errorf("Expected 4 stream items, got %d", len(items))
+	}
+}
+
+// Stream that fails adding the first item.
+type failingAddStream struct {
+	store.Stream
+	failed bool
+}
+
+func (s *failingAddStream) Add(ctx context.Context, value map[string]interface{}) (string, error) {
+	if !s.failed {
+		s.failed = true
+		return "", errors.New("connection reset")
+	}
+	return s.Stream.Add(ctx, value)
+}
+
+func TestOutboxEnqueueRetry(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	outbox := newTestOutbox(t, ctx)
+	outbox.stream = &failingAddStream{Stream: outbox.stream}
+	mailSender = &scriptedMailSender{}
+	done := make(chan error)
+	go func() { done <- outbox.Run(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	if _, err := outbox.Enqueue(ctx, "event\npayee@example.com", testEmail()); err == nil {
+		t.Fatal("Expected error adding the email to the stream")
+	}
+	// The event is retried and the saved email is queued again.
+	id, err := outbox.Enqueue(ctx, "event\npayee@example.com", testEmail())
+	if err != nil {
+		t.Fatal(err)
+	}
+	email := waitStatus(t, ctx, outbox, id, EmailSent)
+	if email.Attempts != 1 {
+		t.Errorf("Unexpected email %+v", email)
+	}
+}
+
+func TestOutboxRun(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	outbox := newTestOutbox(t, ctx)
+	sender := &scriptedMailSender{errors: []error{errors.New("503 Service Unavailable")}}
+	mailSender = sender
+	done := make(chan error)
+	go func() { done <- outbox.Run(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// Delivered at the second attempt.
+	id, err := outbox.Enqueue(ctx, "retried", testEmail())
+	if err != nil {
+		t.Fatal(err)
+	}
+	email := waitStatus(t, ctx, outbox, id, EmailSent)
+	if email.Attempts != 2 || email.MessageId != "message-2" || email.Error != "" {
+		t.Errorf("Unexpected email %+v", email)
+	}
+
+	// Failed after the last attempt.
+	sender.mu.Lock()
+	sender.errors = []error{errors.New("timeout"), errors.New("timeout"), errors.New("421 Try again later")}
+	sender.mu.Unlock()
+	id, err = outbox.Enqueue(ctx, "failed", testEmail())
+	if err != nil {
+		t.Fatal(err)
+	}
+	email = waitStatus(t, ctx, outbox, id, EmailFailed)
+	if email.Attempts != 3 || email.Error != "421 Try again later" {
+		t.Errorf("Unexpected email %+v", email)
+	}
+	dead, err := store.NewMemoryStream(OutboxStreamName+store.DeadStreamSuffix, "", store.StreamOptions{}).Range(ctx, "-", "+", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 {
+		t.Errorf("Expected 1 dead email, got %d", len(dead))
+	}
+
+	// Rejected emails are not retried.
+	sender.mu.Lock()
+	sender.errors = []error{fmt.Errorf("%w: 550 No such user", ErrRejected)}
+	sender.mu.Unlock()
+	calls := sender.Calls()
+	id, err = outbox.Enqueue(ctx, "rejected", testEmail())
+	if err != nil {
+		t.Fatal(err)
+	}
+	email = waitStatus(t, ctx, outbox, id, EmailFailed)
+	if email.Attempts != 1 || sender.Calls() != calls+1 {
+		t.Errorf("Expected a single attempt, got %+v", email)
+	}
+}
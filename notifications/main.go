@@ -4,6 +4,7 @@ import (
 	"context"
 	"log"
 	"net/http"
+	"os"
 
 	"github.com/gorilla/handlers"
 	"github.com/komunitin/komunitin/notifications/events"
@@ -12,16 +13,30 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		if err := runCommand(context.Background(), os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	log.Println("Starting notifications app...")
 
 	events.InitService()
 	notifications.InitService()
+	http.HandleFunc("/health", healthHandler)
 
+	// The services only stop on unrecoverable errors, so exit and let the
+	// container be restarted instead of running without them.
 	log.Println("Starting mailer service...")
-	go mails.Mailer(context.Background())
+	go func() {
+		log.Fatalf("Mailer service stopped: %v\n", mails.Mailer(context.Background()))
+	}()
 
 	log.Println("Starting notifier service...")
-	go notifications.Notifier(context.Background())
+	go func() {
+		log.Fatalf("Notifier service stopped: %v\n", notifications.Notifier(context.Background()))
+	}()
 
 	// Setup CORS middleware.
 	allowedOrigins := handlers.AllowedOrigins([]string{
@@ -43,8 +58,8 @@ func main() {
 	allowedCredentials := handlers.AllowCredentials()
 	corsHandler := handlers.CORS(allowedOrigins, allowedHeaders, allowedMethods, allowedCredentials)(http.DefaultServeMux)
 
-	// Setup LOG middleware.
-	logHandler := handlers.CombinedLoggingHandler(log.Writer(), corsHandler)
+	// Setup LOG middleware, with the live notifications access token removed from the URL.
+	logHandler := notifications.LiveTokenHandler(handlers.CombinedLoggingHandler(log.Writer(), corsHandler))
 
 	log.Println("Starting web service...")
 	go http.ListenAndServe(":2028", logHandler)
@@ -0,0 +1,126 @@
+package notifications
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/komunitin/jsonapi"
+	"github.com/komunitin/komunitin/notifications/api/apitest"
+	"github.com/komunitin/komunitin/notifications/config"
+	"github.com/komunitin/komunitin/notifications/events"
+	"github.com/komunitin/komunitin/notifications/store"
+)
+
+// Subscribe devices with the /subscriptions endpoint, post events to the /events
+// endpoint and check the push notifications sent by the notifier, with the resources
+// served by the fake Komunitin API.
+func TestNotifierEndToEnd(t *testing.T) {
+	config.StoreBackend = store.MemoryBackend
+	config.NotificationsEventsUsername = "events"
+	config.NotificationsEventsPassword = "secret"
+	store.ResetMemory()
+	server := apitest.NewServer(nil)
+	defer server.Close()
+	defer server.Configure()()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Create the notifier consumer group before posting the events.
+	if _, err := events.NewEventsStream(ctx, events.NotifierConsumer); err != nil {
+		t.Fatal(err)
+	}
+	events.InitService()
+	InitService()
+	sender := NewMockPushSender()
+	done := make(chan error)
+	go func() { done <- runNotifier(ctx, sender) }()
+	defer func() {
+		cancel()
+		<-done
+		pushSender = nil
+	}()
+
+	request := func(body string, user string, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", jsonapi.MediaType)
+		if user != "" {
+			req.Header.Set("Authorization", "Bearer "+server.UserToken(user))
+		} else {
+			req.SetBasicAuth("events", "secret")
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		return res
+	}
+	subscribe := func(user string, member string, token string, newMembers bool) {
+		body := fmt.Sprintf(`{"data": {
+			"type": "subscriptions",
+			"attributes": {"token": %q, "settings": {"myAccount": true, "newMembers": %t}},
+			"relationships": {
+				"user": {"data": {"type": "users", "id": %q}},
+				"member": {"data": {"type": "members", "id": %q}}
+			}
+		}}`, token, newMembers, user, member)
+		if res := request(body, user, "/subscriptions"); res.Code != http.StatusCreated {
+			t.Fatalf("Expected 201 subscribing, got %d: %s", res.Code, res.Body)
+		}
+	}
+	post := func(name string, user string, data map[string]string) {
+		if res := request(server.Event(name, apitest.GroupCode, user, data), "", "/events"); res.Code != http.StatusCreated {
+			t.Fatalf("Expected 201 posting %s, got %d: %s", name, res.Code, res.Body)
+		}
+	}
+	// Wait until the given number of push messages have been sent.
+	wait := func(count int) []PushMessage {
+		for {
+			sent := sender.Sent()
+			if len(sent) >= count {
+				return sent
+			}
+			select {
+			case <-ctx.Done():
+				t.Fatalf("Expected %d push messages, got %d", count, len(sent))
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+
+	subscribe(apitest.AliceUser, apitest.AliceMember, "alice-device", true)
+	subscribe(apitest.BobUser, apitest.BobMember, "bob-device", false)
+	// Users can't subscribe to other users' members.
+	body := `{"data": {"type": "subscriptions", "attributes": {"token": "t", "settings": {}}, "relationships": {
+		"user": {"data": {"type": "users", "id": "` + apitest.AliceUser + `"}},
+		"member": {"data": {"type": "members", "id": "` + apitest.BobMember + `"}}}}}`
+	if res := request(body, apitest.AliceUser, "/subscriptions"); res.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 subscribing to another member, got %d", res.Code)
+	}
+
+	// Alice is not notified of her own payment.
+	post(events.TransferCommitted, apitest.AliceUser, map[string]string{
+		"transfer": apitest.TransferId,
+		"payer":    apitest.AliceAccount,
+		"payee":    apitest.BobAccount,
+	})
+	sent := wait(1)
+	if sent[0].Data["event"] != events.TransferCommitted || sent[0].Data["transfer"] != apitest.TransferId {
+		t.Errorf("Unexpected push message %v", sent[0].Data)
+	}
+	if subscriptions := sender.Subscriptions[0]; len(subscriptions) != 1 || subscriptions[0].Token != "bob-device" {
+		t.Errorf("Expected push to Bob's device, got %v", subscriptions)
+	}
+
+	// Only Alice wants to be notified of new members.
+	post(events.MemberJoined, apitest.AdminUser, map[string]string{"member": apitest.BobMember})
+	sent = wait(2)
+	if sent[1].Data["event"] != events.MemberJoined || sent[1].Data["member"] != apitest.BobMember {
+		t.Errorf("Unexpected push message %v", sent[1].Data)
+	}
+	if subscriptions := sender.Subscriptions[1]; len(subscriptions) != 1 || subscriptions[0].Token != "alice-device" {
+		t.Errorf("Expected push to Alice's device, got %v", subscriptions)
+	}
+}
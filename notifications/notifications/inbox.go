@@ -0,0 +1,251 @@
+package notifications
+
+// Implements the in-app notifications inbox.
+//
+// The notifier saves a notification record for each user affected by an event, and
+// users can list them and mark them as read through the /notifications endpoint.
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/komunitin/jsonapi"
+	"github.com/komunitin/komunitin/notifications/api"
+	"github.com/komunitin/komunitin/notifications/config"
+	"github.com/komunitin/komunitin/notifications/events"
+	"github.com/komunitin/komunitin/notifications/service"
+	"github.com/komunitin/komunitin/notifications/store"
+)
+
+const notificationsClass = "notifications"
+
+// Notification resource object.
+type Notification struct {
+	Id string `jsonapi:"primary,notifications" json:"id"`
+	// The event name, e.g. "TransferCommitted".
+	Name string `jsonapi:"attr,name" json:"name"`
+	// The group code.
+	Code string `jsonapi:"attr,code" json:"code"`
+	// The event data, see events.Event.
+	Data    map[string]interface{} `jsonapi:"attr,data" json:"data"`
+	Created time.Time              `jsonapi:"attr,created,iso8601" json:"created"`
+	Read    bool                   `jsonapi:"attr,read" json:"read"`
+	User    *api.ExternalUser      `jsonapi:"relation,user" json:"user"`
+	Member  *api.ExternalMember    `jsonapi:"relation,member" json:"member"`
+}
+
+// Attributes of a notification that can be changed with PATCH. Omitted attributes
+// are nil and left unchanged.
+type notificationPatch struct {
+	Id   string `jsonapi:"primary,notifications"`
+	Read *bool  `jsonapi:"attr,read"`
+}
+
+// Save a notification for each user of the given members, except for the user
+// that originated the event.
+func saveNotifications(ctx context.Context, store store.Store, memberIds []string, event *events.Event) error {
+	if len(memberIds) == 0 {
+		return nil
+	}
+	users, err := api.GetMembersUsers(ctx, memberIds)
+	if err != nil {
+		return err
+	}
+	members := make(map[string]bool, len(memberIds))
+	for _, id := range memberIds {
+		members[id] = true
+	}
+	// Replayed events overwrite the notifications of the original event.
+	eventId := event.Id
+	if event.ReplayOf != "" {
+		eventId = event.ReplayOf
+	}
+	data := make(map[string]interface{}, len(event.Data))
+	for k, v := range event.Data {
+		data[k] = v
+	}
+	for _, user := range users {
+		if user.Id == event.User {
+			continue
+		}
+		for _, member := range user.Members {
+			if !members[member.Id] {
+				continue
+			}
+			notification := &Notification{
+				// Use a deterministic id so retrying the event doesn't duplicate notifications.
+				Id:      eventId + "-" + user.Id + "-" + member.Id,
+				Name:    event.Name,
+				Code:    event.Code,
+				Data:    data,
+				Created: event.Time,
+				User:    &api.ExternalUser{Id: user.Id},
+				Member:  &api.ExternalMember{Id: member.Id},
+			}
+			err := store.Set(ctx, notificationsClass, notification.Id, notification, map[string]string{"user": user.Id}, config.NotificationsRetention)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Return the notifications of the given user, optionally filtered by member, newest first.
+func getUserNotifications(ctx context.Context, store store.Store, userId string, memberId string) ([]*Notification, error) {
+	res, err := store.GetByIndex(ctx, notificationsClass, reflect.TypeOf((*Notification)(nil)), "user", userId)
+	if err != nil {
+		return nil, err
+	}
+	notifications := make([]*Notification, 0, len(res))
+	for _, item := range res {
+		notification := item.(*Notification)
+		if memberId == "" || notification.Member.Id == memberId {
+			notifications = append(notifications, notification)
+		}
+	}
+	sort.Slice(notifications, func(i, j int) bool {
+		return notifications[i].Created.After(notifications[j].Created)
+	})
+	return notifications, nil
+}
+
+// Save the notification keeping its original expiration.
+func updateNotification(ctx context.Context, store store.Store, notification *Notification) error {
+	expire := max(config.NotificationsRetention-time.Since(notification.Created), time.Minute)
+	return store.Set(ctx, notificationsClass, notification.Id, notification, map[string]string{"user": notification.User.Id}, expire)
+}
+
+// Get the authenticated user and check the optional filter[member] parameter.
+// Returns the user and the member id filter.
+func authenticateWithMemberFilter(w http.ResponseWriter, r *http.Request) (*api.User, string, error) {
+	user, err := authenticate(w, r)
+	if err != nil {
+		return nil, "", err
+	}
+	memberId := r.URL.Query().Get("filter[member]")
+	if memberId != "" && !hasMember(user, memberId) {
+		msg := "the user doesn't have the required member"
+		http.Error(w, msg, http.StatusForbidden)
+		return nil, "", fmt.Errorf("%s", msg)
+	}
+	return user, memberId, nil
+}
+
+// Handler for GET /notifications. Returns the notifications of the authenticated
+// user, optionally filtered by filter[member] and filter[read].
+func notificationsHandler(store store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if service.ValidateGet(w, r) != nil {
+			return
+		}
+		user, memberId, err := authenticateWithMemberFilter(w, r)
+		if err != nil {
+			return
+		}
+		notifications, err := getUserNotifications(r.Context(), store, user.Id, memberId)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		if read := r.URL.Query().Get("filter[read]"); read != "" {
+			filtered := make([]*Notification, 0, len(notifications))
+			for _, notification := range notifications {
+				if fmt.Sprint(notification.Read) == read {
+					filtered = append(filtered, notification)
+				}
+			}
+			notifications = filtered
+		}
+
+		w.Header().Set(service.ContentType, jsonapi.MediaType)
+		w.WriteHeader(http.StatusOK)
+		err = jsonapi.MarshalPayload(w, notifications)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Handler for PATCH /notifications/{id}. Allows to mark a notification as read or
+// unread. Omitted attributes are left unchanged.
+func updateNotificationHandler(store store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if service.ValidatePatch(w, r) != nil {
+			return
+		}
+		id := mux.Vars(r)["id"]
+		patch := new(notificationPatch)
+		if service.ValidateJson(w, r, patch) != nil {
+			return
+		}
+		if patch.Id != id {
+			http.Error(w, "Resource id doesn't match the URL.", http.StatusConflict)
+			return
+		}
+		user, err := authenticate(w, r)
+		if err != nil {
+			return
+		}
+		notification := new(Notification)
+		err = store.Get(r.Context(), notificationsClass, id, notification)
+		// Don't reveal the existence of notifications of other users.
+		if err != nil || notification.User.Id != user.Id {
+			http.Error(w, "Notification not found.", http.StatusNotFound)
+			return
+		}
+		if patch.Read != nil && *patch.Read != notification.Read {
+			notification.Read = *patch.Read
+			err = updateNotification(r.Context(), store, notification)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+		}
+
+		w.Header().Set(service.ContentType, jsonapi.MediaType)
+		w.WriteHeader(http.StatusOK)
+		err = jsonapi.MarshalPayload(w, notification)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Handler for POST /notifications/mark-all-read. Marks all the notifications of the
+// authenticated user as read, optionally only those matching filter[member].
+func markAllReadHandler(store store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, memberId, err := authenticateWithMemberFilter(w, r)
+		if err != nil {
+			return
+		}
+		notifications, err := getUserNotifications(r.Context(), store, user.Id, memberId)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		for _, notification := range notifications {
+			if notification.Read {
+				continue
+			}
+			notification.Read = true
+			err = updateNotification(r.Context(), store, notification)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
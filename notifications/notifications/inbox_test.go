@@ -0,0 +1,147 @@
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/komunitin/jsonapi"
+	"github.com/komunitin/komunitin/notifications/api"
+	"github.com/komunitin/komunitin/notifications/api/apitest"
+	"github.com/komunitin/komunitin/notifications/config"
+	"github.com/komunitin/komunitin/notifications/store"
+)
+
+func TestInbox(t *testing.T) {
+	config.StoreBackend = store.MemoryBackend
+	store.ResetMemory()
+	server := apitest.NewServer(nil)
+	defer server.Close()
+	defer server.Configure()()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := store.NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Now().Add(-time.Hour)
+	for i, n := range []struct{ id, user, member string }{
+		{"1", apitest.AliceUser, apitest.AliceMember},
+		{"2", apitest.AliceUser, apitest.AliceMember},
+		{"3", apitest.BobUser, apitest.BobMember},
+	} {
+		notification := &Notification{
+			Id:      n.id,
+			Name:    "TransferCommitted",
+			Code:    apitest.GroupCode,
+			Data:    map[string]interface{}{"transfer": apitest.TransferId},
+			Created: created.Add(time.Duration(i) * time.Minute),
+			User:    &api.ExternalUser{Id: n.user},
+			Member:  &api.ExternalMember{Id: n.member},
+		}
+		if err := updateNotification(ctx, s, notification); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	router := mux.NewRouter()
+	router.Path("/notifications").Methods(http.MethodGet).HandlerFunc(notificationsHandler(s))
+	router.Path("/notifications/mark-all-read").Methods(http.MethodPost).HandlerFunc(markAllReadHandler(s))
+	router.Path("/notifications/{id}").Methods(http.MethodPatch).HandlerFunc(updateNotificationHandler(s))
+	request := func(method string, path string, user string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", jsonapi.MediaType)
+		}
+		req.Header.Set("Authorization", "Bearer "+server.UserToken(user))
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res
+	}
+	list := func(user string, query string) []string {
+		t.Helper()
+		res := request(http.MethodGet, "/notifications"+query, user, "")
+		if res.Code != http.StatusOK {
+			t.Fatalf("Expected 200 listing notifications, got %d: %s", res.Code, res.Body)
+		}
+		return ids(t, res)
+	}
+	patch := func(id string, user string, attributes string) *httptest.ResponseRecorder {
+		return request(http.MethodPatch, "/notifications/"+id, user,
+			`{"data": {"type": "notifications", "id": "`+id+`", "attributes": {`+attributes+`}}}`)
+	}
+
+	// Newest first, only own notifications.
+	if got := list(apitest.AliceUser, ""); strings.Join(got, ",") != "2,1" {
+		t.Errorf("Expected notifications 2,1, got %v", got)
+	}
+	if got := list(apitest.AliceUser, "?filter[member]="+apitest.AliceMember+"&filter[read]=false"); len(got) != 2 {
+		t.Errorf("Expected 2 unread notifications, got %v", got)
+	}
+	if res := request(http.MethodGet, "/notifications?filter[member]="+apitest.BobMember, apitest.AliceUser, ""); res.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 filtering by other member, got %d", res.Code)
+	}
+
+	// Mark as read, and omitted attributes are left unchanged.
+	if res := patch("1", apitest.AliceUser, `"read": true`); res.Code != http.StatusOK {
+		t.Fatalf("Expected 200 patching notification, got %d: %s", res.Code, res.Body)
+	}
+	if res := patch("1", apitest.AliceUser, ``); res.Code != http.StatusOK {
+		t.Fatalf("Expected 200 patching notification, got %d: %s", res.Code, res.Body)
+	}
+	if got := list(apitest.AliceUser, "?filter[read]=true"); strings.Join(got, ",") != "1" {
+		t.Errorf("Expected read notification 1, got %v", got)
+	}
+	if res := patch("1", apitest.AliceUser, `"read": false`); res.Code != http.StatusOK {
+		t.Fatalf("Expected 200 patching notification, got %d: %s", res.Code, res.Body)
+	}
+	if got := list(apitest.AliceUser, "?filter[read]=true"); len(got) != 0 {
+		t.Errorf("Expected no read notifications, got %v", got)
+	}
+
+	// Notifications of other users are not found.
+	if res := patch("3", apitest.AliceUser, `"read": true`); res.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 patching other user's notification, got %d", res.Code)
+	}
+	if res := patch("missing", apitest.AliceUser, `"read": true`); res.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 patching missing notification, got %d", res.Code)
+	}
+	if res := request(http.MethodPatch, "/notifications/2", apitest.AliceUser,
+		`{"data": {"type": "notifications", "id": "1", "attributes": {"read": true}}}`); res.Code != http.StatusConflict {
+		t.Errorf("Expected 409 patching with a mismatched id, got %d", res.Code)
+	}
+
+	if res := request(http.MethodPost, "/notifications/mark-all-read", apitest.AliceUser, ""); res.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 marking all as read, got %d: %s", res.Code, res.Body)
+	}
+	if got := list(apitest.AliceUser, "?filter[read]=false"); len(got) != 0 {
+		t.Errorf("Expected no unread notifications, got %v", got)
+	}
+	if got := list(apitest.BobUser, "?filter[read]=false"); strings.Join(got, ",") != "3" {
+		t.Errorf("Expected Bob's notification unread, got %v", got)
+	}
+}
+
+// Ids of the resources in the JSON:API document of the response.
+func ids(t *testing.T, res *httptest.ResponseRecorder) []string {
+	t.Helper()
+	var doc struct {
+		Data []struct {
+			Id string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, len(doc.Data))
+	for i, resource := range doc.Data {
+		ids[i] = resource.Id
+	}
+	return ids
+}
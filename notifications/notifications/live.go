@@ -0,0 +1,312 @@
+package notifications
+
+// Implements the /notifications/stream Server-Sent Events endpoint.
+//
+// The notifier publishes the handled events along with the affected members in the
+// live notifications stream. Each instance of the service reads this stream and
+// forwards the events to the connected clients of these members. Clients can resume
+// after a disconnection using the Last-Event-ID header.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/komunitin/komunitin/notifications/service"
+	"github.com/komunitin/komunitin/notifications/store"
+)
+
+const (
+	LiveStreamName = "notifications-live"
+	// Number of events kept in the live stream for resuming clients.
+	liveStreamMaxLen = 10000
+	// Time each read of the live stream waits for new events.
+	liveReadBlock = 5 * time.Second
+	// Clients not reading fast enough are disconnected when their buffer is full.
+	liveBufferSize = 64
+	// Comment lines are sent periodically so proxies don't close idle connections.
+	heartbeatInterval = 25 * time.Second
+)
+
+// Stream where the notifier publishes events. Nil if the notifier is not running.
+var liveStream store.Stream
+
+func newLiveStream(ctx context.Context) (store.Stream, error) {
+	// No consumer group: each instance reads the whole stream.
+	return store.NewStream(ctx, LiveStreamName, "", store.StreamOptions{MaxLen: liveStreamMaxLen})
+}
+
+// Publish the event data for the given members in the live stream.
+func publishLive(ctx context.Context, memberIds []string, data map[string]string) error {
+	if liveStream == nil || len(memberIds) == 0 {
+		return nil
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = liveStream.Add(ctx, map[string]interface{}{
+		"members": strings.Join(memberIds, ","),
+		"data":    string(encoded),
+	})
+	return err
+}
+
+// Event read from the live stream.
+type liveEvent struct {
+	Id      string
+	Name    string
+	User    string
+	Members []string
+	// JSON encoded flat event data, as sent in push messages.
+	Data string
+}
+
+func parseLiveEvent(item store.StreamItem) (*liveEvent, error) {
+	members, _ := item.Value["members"].(string)
+	data, _ := item.Value["data"].(string)
+	fields := map[string]string{}
+	if err := json.Unmarshal([]byte(data), &fields); err != nil {
+		return nil, fmt.Errorf("invalid live event %s: %v", item.Id, err)
+	}
+	return &liveEvent{
+		Id:      item.Id,
+		Name:    fields["event"],
+		User:    fields["user"],
+		Members: strings.Split(members, ","),
+		Data:    data,
+	}, nil
+}
+
+// Connected client listening to the events of some members.
+type liveClient struct {
+	user    string
+	members map[string]bool
+	events  chan *liveEvent
+}
+
+// Whether the event has to be sent to this client. Users are not notified of
+// their own actions.
+func (client *liveClient) matches(event *liveEvent) bool {
+	if event.User == client.user {
+		return false
+	}
+	for _, member := range event.Members {
+		if client.members[member] {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads the live stream and dispatches the events to the connected clients.
+type liveHub struct {
+	stream  store.Stream
+	mutex   sync.Mutex
+	clients map[*liveClient]bool
+}
+
+func newLiveHub(stream store.Stream) *liveHub {
+	return &liveHub{
+		stream:  stream,
+		clients: map[*liveClient]bool{},
+	}
+}
+
+// Read the live stream until the context is done.
+func (hub *liveHub) run(ctx context.Context) {
+	lastId := ""
+	for ctx.Err() == nil {
+		var err error
+		if lastId == "" {
+			// Start from the current end of the stream.
+			lastId, err = hub.stream.LastId(ctx)
+		}
+		var items []store.StreamItem
+		if err == nil {
+			items, err = hub.stream.ReadAfter(ctx, lastId, 100, liveReadBlock)
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Error reading live notifications: %v\n", err)
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+		for _, item := range items {
+			lastId = item.Id
+			event, err := parseLiveEvent(item)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			hub.broadcast(event)
+		}
+	}
+}
+
+func (hub *liveHub) broadcast(event *liveEvent) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	for client := range hub.clients {
+		if !client.matches(event) {
+			continue
+		}
+		select {
+		case client.events <- event:
+		default:
+			// Slow client. Disconnect it so it resumes with Last-Event-ID.
+			delete(hub.clients, client)
+			close(client.events)
+		}
+	}
+}
+
+func (hub *liveHub) subscribe(user string, members []string) *liveClient {
+	client := &liveClient{
+		user:    user,
+		members: make(map[string]bool, len(members)),
+		events:  make(chan *liveEvent, liveBufferSize),
+	}
+	for _, member := range members {
+		client.members[member] = true
+	}
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	hub.clients[client] = true
+	return client
+}
+
+func (hub *liveHub) unsubscribe(client *liveClient) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	if hub.clients[client] {
+		delete(hub.clients, client)
+		close(client.events)
+	}
+}
+
+// Write the events stored after the given id that match the client. Returns the
+// id of the last item read.
+func (hub *liveHub) replay(ctx context.Context, w io.Writer, client *liveClient, lastId string) (string, error) {
+	for {
+		items, err := hub.stream.ReadAfter(ctx, lastId, 100, -1)
+		if err != nil || len(items) == 0 {
+			return lastId, err
+		}
+		for _, item := range items {
+			lastId = item.Id
+			event, err := parseLiveEvent(item)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			if client.matches(event) {
+				if err := writeLiveEvent(w, event); err != nil {
+					return lastId, err
+				}
+			}
+		}
+	}
+}
+
+func writeLiveEvent(w io.Writer, event *liveEvent) error {
+	_, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.Id, event.Name, event.Data)
+	return err
+}
+
+// Middleware that moves the access_token query parameter of /notifications/stream
+// requests to the Authorization header, since browser EventSource API can't set
+// headers. It must wrap the logging handler so the token is not written to the logs.
+func LiveTokenHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.URL.Path == "/notifications/stream" && query.Has("access_token") {
+			if token := query.Get("access_token"); token != "" && r.Header.Get("Authorization") == "" {
+				r.Header.Set("Authorization", "Bearer "+token)
+			}
+			query.Del("access_token")
+			r.URL.RawQuery = query.Encode()
+			r.RequestURI = r.URL.RequestURI()
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Handler for GET /notifications/stream. Sends the events relevant to the members
+// of the authenticated user, or only to filter[member], as Server-Sent Events.
+func liveHandler(hub *liveHub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if service.ValidateGet(w, r) != nil {
+			return
+		}
+		user, memberId, err := authenticateWithMemberFilter(w, r)
+		if err != nil {
+			return
+		}
+		members := []string{memberId}
+		if memberId == "" {
+			members = make([]string, len(user.Members))
+			for i, member := range user.Members {
+				members[i] = member.Id
+			}
+		}
+
+		w.Header().Set(service.ContentType, "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		// Disable response buffering in nginx.
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		rc := http.NewResponseController(w)
+
+		// Subscribe before replaying so no event is lost in between.
+		client := hub.subscribe(user.Id, members)
+		defer hub.unsubscribe(client)
+
+		lastId := r.Header.Get("Last-Event-ID")
+		if lastId != "" {
+			lastId, err = hub.replay(r.Context(), w, client, lastId)
+			if err != nil {
+				log.Printf("Error replaying live notifications: %v\n", err)
+				return
+			}
+		}
+		if rc.Flush() != nil {
+			return
+		}
+
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case event, ok := <-client.events:
+				if !ok {
+					// Disconnected by the hub.
+					return
+				}
+				// Skip events already sent while replaying.
+				if lastId != "" && store.CompareIds(event.Id, lastId) <= 0 {
+					continue
+				}
+				lastId = event.Id
+				err = writeLiveEvent(w, event)
+			case <-heartbeat.C:
+				_, err = io.WriteString(w, ": heartbeat\n\n")
+			case <-r.Context().Done():
+				return
+			}
+			if err == nil {
+				err = rc.Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
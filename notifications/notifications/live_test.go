@@ -0,0 +1,149 @@
+package notifications
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/komunitin/komunitin/notifications/api/apitest"
+	"github.com/komunitin/komunitin/notifications/config"
+	"github.com/komunitin/komunitin/notifications/store"
+)
+
+func TestLiveHub(t *testing.T) {
+	hub := newLiveHub(nil)
+	client := hub.subscribe("user1", []string{"member1", "member2"})
+	other := hub.subscribe("user2", []string{"member3"})
+
+	item := func(id string, user string, members string) store.StreamItem {
+		return store.StreamItem{Id: id, Value: map[string]interface{}{
+			"members": members,
+			"data":    `{"event":"TransferCommitted","user":"` + user + `"}`,
+		}}
+	}
+	for _, i := range []store.StreamItem{
+		item("1-0", "user3", "member2,member3"),
+		// Own actions are not sent.
+		item("2-0", "user1", "member1"),
+		item("3-0", "user3", "member4"),
+	} {
+		event, err := parseLiveEvent(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hub.broadcast(event)
+	}
+	if len(client.events) != 1 || len(other.events) != 1 {
+		t.Fatalf("Unexpected number of events: %d, %d", len(client.events), len(other.events))
+	}
+	if event := <-client.events; event.Id != "1-0" || event.Name != "TransferCommitted" {
+		t.Errorf("Unexpected event %v", event)
+	}
+
+	// Slow clients are disconnected.
+	for i := 0; i <= liveBufferSize; i++ {
+		event, _ := parseLiveEvent(item("4-0", "user3", "member3"))
+		hub.broadcast(event)
+	}
+	if _, ok := hub.clients[other]; ok {
+		t.Error("Slow client not disconnected")
+	}
+	hub.unsubscribe(other)
+	hub.unsubscribe(client)
+	if _, ok := <-client.events; ok {
+		t.Error("Client channel not closed")
+	}
+}
+
+func TestLiveHandler(t *testing.T) {
+	config.StoreBackend = store.MemoryBackend
+	store.ResetMemory()
+	server := apitest.NewServer(nil)
+	defer server.Close()
+	defer server.Configure()()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := newLiveStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish := func(user string, member string) string {
+		id, err := stream.Add(ctx, map[string]interface{}{
+			"members": member,
+			"data":    `{"event":"TransferCommitted","user":"` + user + `"}`,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	first := publish(apitest.BobUser, apitest.AliceMember)
+	publish(apitest.AliceUser, apitest.BobMember)
+	missed := publish(apitest.BobUser, apitest.AliceMember)
+	hub := newLiveHub(stream)
+	go hub.run(ctx)
+
+	router := mux.NewRouter()
+	router.Path("/notifications/stream").Methods(http.MethodGet).HandlerFunc(liveHandler(hub))
+	var logged []string
+	web := httptest.NewServer(LiveTokenHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logged = append(logged, r.RequestURI)
+		router.ServeHTTP(w, r)
+	})))
+	defer web.Close()
+	connect := func(query string, header http.Header) *http.Response {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, web.URL+"/notifications/stream"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := connect("", nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without token, got %d", res.StatusCode)
+	}
+	res = connect("?filter[member]="+apitest.BobMember+"&access_token="+server.UserToken(apitest.AliceUser), nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 with other member filter, got %d", res.StatusCode)
+	}
+
+	// Resume after the first event with the token in the query.
+	res = connect("?access_token="+server.UserToken(apitest.AliceUser), http.Header{"Last-Event-ID": {first}})
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Unexpected response %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	for _, uri := range logged {
+		if strings.Contains(uri, "access_token") {
+			t.Errorf("Access token not removed from %s", uri)
+		}
+	}
+	live := publish(apitest.BobUser, apitest.AliceMember)
+	publish(apitest.AliceUser, apitest.AliceMember)
+	ids := []string{}
+	scanner := bufio.NewScanner(res.Body)
+	for len(ids) < 2 && scanner.Scan() {
+		if id, ok := strings.CutPrefix(scanner.Text(), "id: "); ok {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) != 2 || ids[0] != missed || ids[1] != live {
+		t.Errorf("Expected events %s and %s, got %v", missed, live, ids)
+	}
+}
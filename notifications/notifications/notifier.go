@@ -4,15 +4,13 @@ package notifications
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"log"
 	"maps"
 	"reflect"
 
-	firebase "firebase.google.com/go/v4"
-	"firebase.google.com/go/v4/messaging"
-
 	"github.com/komunitin/komunitin/notifications/api"
+	"github.com/komunitin/komunitin/notifications/config"
 	"github.com/komunitin/komunitin/notifications/events"
 	"github.com/komunitin/komunitin/notifications/store"
 )
@@ -25,6 +23,8 @@ const (
 	NewMembers = "newMembers"
 )
 
+var pushSender PushSender
+
 type TransferEventDestination int
 
 const (
@@ -34,44 +34,84 @@ const (
 )
 
 // Wait for data in events stream and perform notifications as needed.
+// Events are read by this goroutine and handled by a pool of workers.
 func Notifier(ctx context.Context) error {
-	// TODO: Better error handling. Need to be studied carefully, but:
-	//  - error at reading could be reattempted after X seconds
-	//  - erroneous events/notifications could be moved to a seaparate stream
-
-	// TODO: For far greather throughtput we can decouple reading events from
-	// sending notifications by reading events into a channel and then having
-	// different goroutines consuming the channel and performing the notifications.
+	sender, err := newPushSender()
+	if err != nil {
+		return err
+	}
+	return runNotifier(ctx, sender)
+}
 
-	stream, err := events.NewEventsStream(ctx, "notifier")
+// Handle the events of the notifier consumer, sending the push notifications with the
+// given sender.
+func runNotifier(ctx context.Context, sender PushSender) error {
+	stream, err := events.NewEventsStream(ctx, events.NotifierConsumer)
 	if err != nil {
 		return err
 	}
+	// Stream of handled events for the connected clients.
+	liveStream, err = newLiveStream(ctx)
+	if err != nil {
+		return err
+	}
+	go store.RunTrimmer(ctx, liveStream, config.StreamTrimInterval)
+
 	// Create a single connection to the DB.
 	store, err := store.NewStore()
 	if err != nil {
 		return err
 	}
 
+	pushSender = sender
+
+	pool := newWorkerPool(config.NotifierWorkers, func(event *events.Event) {
+		err := handleEvent(ctx, event, store)
+		if errors.Is(err, api.ErrNotFound) {
+			// The resources of the event have been deleted, so retrying won't help.
+			log.Printf("Skipping event %s (%s): %v\n", event.Id, event.Name, err)
+			err = nil
+		} else if err != nil {
+			// Error handling event. The event will be retried later.
+			log.Printf("Error handling event: %v\n", err)
+		}
+		// Acknowledge event handled or schedule it for retry.
+		if err = stream.Done(ctx, event, err); err != nil {
+			log.Printf("Error acknowledging event: %v\n", err)
+		}
+	})
+	// Let the workers finish the queued events before returning.
+	defer pool.close()
+
 	// Infinite loop
 	for {
 		// Blocking call to get next event in stream
 		event, err := stream.Get(ctx)
 		if err != nil {
-			// Unexpected error, terminating.
+			// The context is done.
 			return err
 		}
-		err = handleEvent(ctx, event, store)
+		err = pool.dispatch(ctx, event)
 		if err != nil {
-			// Error handling event. Just print and ignore event.
-			log.Printf("Error handling event: %v\n", err)
+			return err
 		}
-		// Acknowledge event handled
-		stream.Ack(ctx, event.Id)
 	}
 }
 
-func handleEvent(ctx context.Context, event *events.Event, store *store.Store) error {
+// Create the push sender for FCM and, if VAPID keys are configured, Web Push subscriptions.
+func newPushSender() (PushSender, error) {
+	var webPush PushSender
+	if config.VapidPrivateKey != "" {
+		sender, err := NewWebPushSender(config.VapidPrivateKey, config.VapidSubject)
+		if err != nil {
+			return nil, err
+		}
+		webPush = sender
+	}
+	return NewPushRouter(NewFcmSender(), webPush), nil
+}
+
+func handleEvent(ctx context.Context, event *events.Event, store store.Store) error {
 
 	switch event.Name {
 	case events.TransferCommitted:
@@ -96,7 +136,7 @@ func handleEvent(ctx context.Context, event *events.Event, store *store.Store) e
 	}
 }
 
-func handleMemberEvent(ctx context.Context, event *events.Event, store *store.Store) error {
+func handleMemberEvent(ctx context.Context, event *events.Event, store store.Store) error {
 	members := []string{event.Data["member"]}
 	// Note that OfferExpired and NeedExpired are usually sent by the system cron,
 	// so the user is always the system user and in particular the affected user
@@ -104,7 +144,7 @@ func handleMemberEvent(ctx context.Context, event *events.Event, store *store.St
 	return notifyMembers(ctx, store, members, event, MyAccount)
 }
 
-func handleTransferEvent(ctx context.Context, event *events.Event, store *store.Store, dest TransferEventDestination) error {
+func handleTransferEvent(ctx context.Context, event *events.Event, store store.Store, dest TransferEventDestination) error {
 	accounts := make([]string, 0, 2)
 	if dest == Both || dest == Payer {
 		accounts = append(accounts, event.Data["payer"])
@@ -127,7 +167,7 @@ func handleTransferEvent(ctx context.Context, event *events.Event, store *store.
 	return notifyMembers(ctx, store, memberIds, event, MyAccount)
 }
 
-func handleGroupEvent(ctx context.Context, event *events.Event, store *store.Store, eventType string) error {
+func handleGroupEvent(ctx context.Context, event *events.Event, store store.Store, eventType string) error {
 
 	// Get group members
 	members, err := api.GetGroupMembers(ctx, event.Code)
@@ -143,80 +183,99 @@ func handleGroupEvent(ctx context.Context, event *events.Event, store *store.Sto
 	return notifyMembers(ctx, store, memberIds, event, eventType)
 }
 
-func notifyMembers(ctx context.Context, store *store.Store, memberIds []string, event *events.Event, eventType string) error {
-	// The array of tokens to send the message to.
-	tokens := []string{}
-	// A map to reverse from tokens to subscriptions in order to easily handle responses.
-	tokenMap := make(map[string]*Subscription)
+func notifyMembers(ctx context.Context, store store.Store, memberIds []string, event *events.Event, eventType string) error {
+	if event.DryRun {
+		return logDryRun(ctx, store, memberIds, event, eventType)
+	}
+	// Keep the notification in the users inbox.
+	err := saveNotifications(ctx, store, memberIds, event)
+	if err != nil {
+		return err
+	}
+
+	// We send push and live messages with flat data.
+	messageData := maps.Clone(event.Data)
+	messageData["event"] = event.Name
+	messageData["code"] = event.Code
+	messageData["user"] = event.User
+
+	// The subscriptions to send the message to.
+	subscriptions := []*Subscription{}
 
 	for _, member := range memberIds {
-		subscriptions, err := getMemberSubscriptions(ctx, store, member, event.User)
+		memberSubscriptions, err := getMemberSubscriptions(ctx, store, member, event.User)
 		if err != nil {
 			return err
 		}
-		for _, sub := range subscriptions {
+		for _, sub := range memberSubscriptions {
 			// Check if user wants to receive notifications of this type.
 			if sub.Settings[eventType] == true {
-				tokens = append(tokens, sub.Token)
-				tokenMap[sub.Token] = &sub
+				subscriptions = append(subscriptions, &sub)
 			}
 		}
 	}
 
-	if len(tokens) == 0 {
-		return nil
+	if len(subscriptions) > 0 {
+		// Send notification
+		results, err := pushSender.SendPush(ctx, PushMessage{Data: messageData}, subscriptions)
+		if err != nil {
+			return err
+		}
+		// Handle responses
+		handleResponses(ctx, store, results, subscriptions)
 	}
 
-	// We send push messages with flat data.
-	messageData := maps.Clone(event.Data)
-	messageData["event"] = event.Name
-	messageData["code"] = event.Code
-	messageData["user"] = event.User
-
-	// Break tokens in groups of 500 and send the message because of firebase limitations.
-	for i := 0; i < len(tokens); i += 500 {
-		end := i + 500
-		if end > len(tokens) {
-			end = len(tokens)
-		}
+	// Forward the event to connected clients once the push messages are sent, so it is
+	// not published again if the event is retried. Failing here doesn't retry the event
+	// either, since that would send the push messages again and the clients still get
+	// the notification from the inbox.
+	if err := publishLive(ctx, memberIds, messageData); err != nil {
+		log.Printf("Error publishing event %s to live clients: %v\n", event.Id, err)
+	}
+	return nil
+}
 
-		// Send notification
-		message := &messaging.MulticastMessage{
-			Tokens: tokens[i:end],
-			Data:   messageData,
-		}
-		br, err := sendMessage(ctx, message)
+// Log the push notifications that would be sent for the event.
+func logDryRun(ctx context.Context, store store.Store, memberIds []string, event *events.Event, eventType string) error {
+	count := 0
+	for _, member := range memberIds {
+		subscriptions, err := getMemberSubscriptions(ctx, store, member, event.User)
 		if err != nil {
 			return err
 		}
-		// Handle responses
-		log.Printf("Sent %d notifications with %d successes and %d failures.\n", (end - i), br.SuccessCount, br.FailureCount)
-		handleResponses(ctx, store, br.Responses, tokens, tokenMap)
+		for _, sub := range subscriptions {
+			if sub.Settings[eventType] == true {
+				count++
+			}
+		}
 	}
+	log.Printf("Dry run: %s notification to %d subscriptions of members %v not sent.\n", event.Name, count, memberIds)
 	return nil
 }
 
-func handleResponses(ctx context.Context, store *store.Store, responses []*messaging.SendResponse, tokens []string, tokenMap map[string]*Subscription) {
-	// Responses order is the same as tokens order, as per Firebase documentation.
-	for i, r := range responses {
-		token := tokens[i]
-		sub := tokenMap[token]
-		if r.Success {
+func handleResponses(ctx context.Context, store store.Store, results []PushResult, subscriptions []*Subscription) {
+	failures := 0
+	// Results order is the same as subscriptions order.
+	for i, r := range results {
+		sub := subscriptions[i]
+		if r.Error == nil {
 			// Log success
 			log.Printf("Notification sent to member %s.\n", sub.Member.Id)
 		} else {
+			failures++
 			// Log error
 			log.Printf("Error sending notification to member %s: %v\n", sub.Member.Id, r.Error)
-			if messaging.IsRegistrationTokenNotRegistered(r.Error) {
+			if r.Expired {
 				store.Delete(ctx, "subscriptions", sub.Id)
 				log.Printf("Subscription deleted for member %s.\n", sub.Member.Id)
 			}
 		}
 	}
+	log.Printf("Sent %d notifications with %d successes and %d failures.\n", len(results), len(results)-failures, failures)
 }
 
 // Return the subscriptions of given member, excluding the ones related to the given user id.
-func getMemberSubscriptions(ctx context.Context, store *store.Store, memberId string, excludeUser string) ([]Subscription, error) {
+func getMemberSubscriptions(ctx context.Context, store store.Store, memberId string, excludeUser string) ([]Subscription, error) {
 	// Get subscriptions for this member.
 	res, err := store.GetByIndex(ctx, "subscriptions", reflect.TypeOf((*Subscription)(nil)), "member", memberId)
 	if err != nil {
@@ -234,20 +293,3 @@ func getMemberSubscriptions(ctx context.Context, store *store.Store, memberId st
 	}
 	return subscriptions, nil
 }
-
-func sendMessage(ctx context.Context, message *messaging.MulticastMessage) (*messaging.BatchResponse, error) {
-	// Credentials are implicitly loaded from a JSON file identifyed by the environment
-	// variable GOOGLE_APPLICATION_CREDENTIALS.
-	app, err := firebase.NewApp(ctx, nil)
-	if err != nil {
-		return nil, fmt.Errorf("error initializing firebase: %v", err)
-	}
-	client, err := app.Messaging(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("error getting firebase messaging client: %v", err)
-	}
-
-	// Send the message!
-	return client.SendEachForMulticast(ctx, message)
-
-}
@@ -0,0 +1,74 @@
+package notifications
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/komunitin/komunitin/notifications/api"
+	"github.com/komunitin/komunitin/notifications/api/apitest"
+	"github.com/komunitin/komunitin/notifications/config"
+	"github.com/komunitin/komunitin/notifications/events"
+	"github.com/komunitin/komunitin/notifications/store"
+)
+
+// Live messages are only published once the push messages have been sent, so
+// retrying an event whose push failed doesn't publish it twice.
+func TestNotifyMembersRetry(t *testing.T) {
+	config.StoreBackend = store.MemoryBackend
+	store.ResetMemory()
+	server := apitest.NewServer(nil)
+	defer server.Close()
+	defer server.Configure()()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer func() {
+		pushSender = nil
+		liveStream = nil
+	}()
+
+	s, err := store.NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	liveStream, err = newLiveStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscription := &Subscription{
+		Id:       "sub1",
+		Token:    "token1",
+		Settings: map[string]interface{}{"myAccount": true},
+		User:     &api.ExternalUser{Id: apitest.AliceUser},
+		Member:   &api.ExternalMember{Id: apitest.AliceMember},
+	}
+	if err := s.Set(ctx, "subscriptions", subscription.Id, subscription, map[string]string{"member": apitest.AliceMember}, 0); err != nil {
+		t.Fatal(err)
+	}
+	event := &events.Event{Id: "1-0", Name: events.TransferCommitted, Code: apitest.GroupCode, Time: time.Now(), Data: map[string]string{}, User: apitest.BobUser}
+	published := func() int {
+		t.Helper()
+		items, err := liveStream.Range(ctx, "-", "+", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(items)
+	}
+
+	pushSender = NewPushRouter(failingPushSender{}, nil)
+	if err := notifyMembers(ctx, s, []string{apitest.AliceMember}, event, "myAccount"); err == nil || err.Error() != "service unavailable" {
+		t.Fatalf("Expected error sending push, got %v", err)
+	}
+	if n := published(); n != 0 {
+		t.Errorf("Expected no live messages after failed push, got %d", n)
+	}
+
+	sender := NewMockPushSender()
+	pushSender = sender
+	if err := notifyMembers(ctx, s, []string{apitest.AliceMember}, event, "myAccount"); err != nil {
+		t.Fatal(err)
+	}
+	if n := published(); n != 1 || len(sender.Sent()) != 1 {
+		t.Errorf("Expected 1 live and 1 push message, got %d and %d", n, len(sender.Sent()))
+	}
+}
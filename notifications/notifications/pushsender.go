@@ -0,0 +1,97 @@
+package notifications
+
+import (
+	"context"
+	"errors"
+)
+
+// Push message with flat key-value data.
+type PushMessage struct {
+	Data map[string]string
+}
+
+// Result of sending a push message to a single subscription.
+type PushResult struct {
+	// Error sending the message, if any.
+	Error error
+	// Whether the subscription is no longer valid and should be deleted.
+	Expired bool
+}
+
+type PushSender interface {
+	// Send the message to the given subscriptions. The returned results have the same
+	// order as the subscriptions. The error is only set if the whole operation failed.
+	SendPush(ctx context.Context, message PushMessage, subscriptions []*Subscription) ([]PushResult, error)
+}
+
+// Push sender that sends FCM subscriptions through the fcm sender and Web Push
+// subscriptions through the webPush sender. Any of them may be nil if not configured.
+// If one of them fails as a whole, the error is set in the results of its subscriptions
+// and the other is still used. SendPush only fails if all the used senders failed.
+type PushRouter struct {
+	fcm     PushSender
+	webPush PushSender
+}
+
+func NewPushRouter(fcm PushSender, webPush PushSender) *PushRouter {
+	return &PushRouter{
+		fcm:     fcm,
+		webPush: webPush,
+	}
+}
+
+func (router *PushRouter) SendPush(ctx context.Context, message PushMessage, subscriptions []*Subscription) ([]PushResult, error) {
+	results := make([]PushResult, len(subscriptions))
+
+	// Split subscriptions by kind keeping track of their original position.
+	var fcmSubs, webPushSubs []*Subscription
+	var fcmIndexes, webPushIndexes []int
+	for i, sub := range subscriptions {
+		if sub.IsWebPush() {
+			webPushSubs = append(webPushSubs, sub)
+			webPushIndexes = append(webPushIndexes, i)
+		} else {
+			fcmSubs = append(fcmSubs, sub)
+			fcmIndexes = append(fcmIndexes, i)
+		}
+	}
+
+	used := 0
+	var errs []error
+	send := func(sender PushSender, subs []*Subscription, indexes []int, kind string) {
+		if len(subs) == 0 {
+			return
+		}
+		if sender == nil {
+			for _, i := range indexes {
+				results[i] = PushResult{Error: errNoPushSender(kind)}
+			}
+			return
+		}
+		used++
+		res, err := sender.SendPush(ctx, message, subs)
+		if err != nil {
+			for _, i := range indexes {
+				results[i] = PushResult{Error: err}
+			}
+			errs = append(errs, err)
+			return
+		}
+		for j, i := range indexes {
+			results[i] = res[j]
+		}
+	}
+
+	send(router.fcm, fcmSubs, fcmIndexes, "FCM")
+	send(router.webPush, webPushSubs, webPushIndexes, "Web Push")
+	if used > 0 && len(errs) == used {
+		return nil, errors.Join(errs...)
+	}
+	return results, nil
+}
+
+type errNoPushSender string
+
+func (kind errNoPushSender) Error() string {
+	return "no push sender configured for " + string(kind) + " subscriptions"
+}
@@ -0,0 +1,76 @@
+package notifications
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	firebase "firebase.google.com/go/v4"
+	"firebase.google.com/go/v4/messaging"
+)
+
+// Firebase limits the number of tokens in a multicast message.
+const fcmMaxTokens = 500
+
+// Sends push messages through Firebase Cloud Messaging.
+type FcmSender struct {
+	mu     sync.Mutex
+	client *messaging.Client
+}
+
+func NewFcmSender() *FcmSender {
+	return &FcmSender{}
+}
+
+// Return the messaging client, initializing it on first use.
+func (fcm *FcmSender) getClient(ctx context.Context) (*messaging.Client, error) {
+	fcm.mu.Lock()
+	defer fcm.mu.Unlock()
+	if fcm.client != nil {
+		return fcm.client, nil
+	}
+	// Credentials are implicitly loaded from a JSON file identifyed by the environment
+	// variable GOOGLE_APPLICATION_CREDENTIALS.
+	app, err := firebase.NewApp(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing firebase: %v", err)
+	}
+	client, err := app.Messaging(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting firebase messaging client: %v", err)
+	}
+	fcm.client = client
+	return client, nil
+}
+
+func (fcm *FcmSender) SendPush(ctx context.Context, message PushMessage, subscriptions []*Subscription) ([]PushResult, error) {
+	client, err := fcm.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]PushResult, 0, len(subscriptions))
+	// Break tokens in groups of 500 and send the message because of firebase limitations.
+	for i := 0; i < len(subscriptions); i += fcmMaxTokens {
+		end := min(i+fcmMaxTokens, len(subscriptions))
+		tokens := make([]string, 0, end-i)
+		for _, sub := range subscriptions[i:end] {
+			tokens = append(tokens, sub.Token)
+		}
+		// Send the message!
+		br, err := client.SendEachForMulticast(ctx, &messaging.MulticastMessage{
+			Tokens: tokens,
+			Data:   message.Data,
+		})
+		if err != nil {
+			return nil, err
+		}
+		// Responses order is the same as tokens order, as per Firebase documentation.
+		for _, r := range br.Responses {
+			results = append(results, PushResult{
+				Error:   r.Error,
+				Expired: !r.Success && messaging.IsRegistrationTokenNotRegistered(r.Error),
+			})
+		}
+	}
+	return results, nil
+}
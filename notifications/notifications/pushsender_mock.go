@@ -0,0 +1,38 @@
+package notifications
+
+import (
+	"context"
+	"log"
+	"slices"
+	"sync"
+)
+
+type PushSenderMock struct {
+	mu       sync.Mutex
+	Messages []PushMessage
+	// Subscriptions each message has been sent to.
+	Subscriptions [][]*Subscription
+}
+
+func NewMockPushSender() *PushSenderMock {
+	return &PushSenderMock{
+		Messages:      []PushMessage{},
+		Subscriptions: [][]*Subscription{},
+	}
+}
+
+func (ps *PushSenderMock) SendPush(ctx context.Context, message PushMessage, subscriptions []*Subscription) ([]PushResult, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.Messages = append(ps.Messages, message)
+	ps.Subscriptions = append(ps.Subscriptions, subscriptions)
+	log.Printf("==============PUSH============== %d subscriptions: %v\n", len(subscriptions), message.Data)
+	return make([]PushResult, len(subscriptions)), nil
+}
+
+// Return a copy of the messages sent so far, safe to call while sending.
+func (ps *PushSenderMock) Sent() []PushMessage {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return slices.Clone(ps.Messages)
+}
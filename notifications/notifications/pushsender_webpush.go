@@ -0,0 +1,244 @@
+package notifications
+
+// Implements the Web Push protocol (RFC 8030) with message encryption (RFC 8291)
+// and VAPID authentication (RFC 8292), so push messages can be sent to browsers
+// without depending on Firebase.
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// Size of the single encrypted record. Push services must accept at least 4096 bytes.
+	webPushRecordSize = 4096
+	// Time the push service keeps the message if the browser is offline.
+	webPushTTL = 24 * time.Hour
+	// Validity of the VAPID token. It must be less than 24 hours.
+	vapidExpiration = 12 * time.Hour
+)
+
+// Sends push messages using the Web Push protocol.
+type WebPushSender struct {
+	client     *http.Client
+	privateKey *ecdsa.PrivateKey
+	// Uncompressed public key, base64url encoded.
+	publicKey string
+	// Contact of the application server, a "mailto:" or "https:" URL.
+	subject string
+}
+
+// Create a Web Push sender with the VAPID private key encoded as raw base64url, as
+// generated by most web push libraries, and the subject contact URL.
+func NewWebPushSender(vapidPrivateKey string, subject string) (*WebPushSender, error) {
+	raw, err := decodeBase64Url(vapidPrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VAPID private key: %v", err)
+	}
+	key, err := ecdh.P256().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VAPID private key: %v", err)
+	}
+	public := key.PublicKey().Bytes()
+	privateKey := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(public[1:33]),
+			Y:     new(big.Int).SetBytes(public[33:]),
+		},
+		D: new(big.Int).SetBytes(raw),
+	}
+	return &WebPushSender{
+		client:     &http.Client{Timeout: 30 * time.Second},
+		privateKey: privateKey,
+		publicKey:  base64.RawURLEncoding.EncodeToString(public),
+		subject:    subject,
+	}, nil
+}
+
+// Return the VAPID public key to be used by browsers when subscribing.
+func (wp *WebPushSender) PublicKey() string {
+	return wp.publicKey
+}
+
+func (wp *WebPushSender) SendPush(ctx context.Context, message PushMessage, subscriptions []*Subscription) ([]PushResult, error) {
+	// Use the same payload structure as FCM data messages.
+	payload, err := json.Marshal(map[string]interface{}{"data": message.Data})
+	if err != nil {
+		return nil, err
+	}
+	results := make([]PushResult, len(subscriptions))
+	for i, sub := range subscriptions {
+		results[i] = wp.send(ctx, payload, sub)
+	}
+	return results, nil
+}
+
+func (wp *WebPushSender) send(ctx context.Context, payload []byte, sub *Subscription) PushResult {
+	p256dh, _ := sub.Keys["p256dh"].(string)
+	auth, _ := sub.Keys["auth"].(string)
+	body, err := encryptWebPush(payload, p256dh, auth)
+	if err != nil {
+		return PushResult{Error: err}
+	}
+	authorization, err := wp.vapidAuthorization(sub.Endpoint)
+	if err != nil {
+		return PushResult{Error: err}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return PushResult{Error: err}
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", fmt.Sprintf("%d", int(webPushTTL.Seconds())))
+	req.Header.Set("Urgency", "normal")
+	req.Header.Set("Authorization", authorization)
+
+	res, err := wp.client.Do(req)
+	if err != nil {
+		return PushResult{Error: err}
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return PushResult{}
+	case res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone:
+		// The subscription has expired or has been unsubscribed.
+		return PushResult{Error: fmt.Errorf("subscription expired: %s", res.Status), Expired: true}
+	default:
+		detail, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return PushResult{Error: fmt.Errorf("error sending web push: %s %s", res.Status, detail)}
+	}
+}
+
+// Build the VAPID Authorization header value for the given push service endpoint.
+func (wp *WebPushSender) vapidAuthorization(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(vapidExpiration).Unix(),
+		"sub": wp.subject,
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, wp.privateKey, hash[:])
+	if err != nil {
+		return "", err
+	}
+	// JWS ES256 signature is the concatenation of r and s as 32 byte big-endian integers.
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	token := unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+	return "vapid t=" + token + ", k=" + wp.publicKey, nil
+}
+
+// Encrypt the payload for the subscription with the given user agent public key and
+// authentication secret, using the aes128gcm content encoding (RFC 8188, RFC 8291).
+func encryptWebPush(payload []byte, p256dh string, auth string) ([]byte, error) {
+	uaPublicBytes, err := decodeBase64Url(p256dh)
+	if err != nil {
+		return nil, fmt.Errorf("invalid p256dh subscription key: %v", err)
+	}
+	uaPublic, err := ecdh.P256().NewPublicKey(uaPublicBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid p256dh subscription key: %v", err)
+	}
+	authSecret, err := decodeBase64Url(auth)
+	if err != nil || len(authSecret) == 0 {
+		return nil, errors.New("invalid auth subscription key")
+	}
+	// Payload plus padding delimiter plus AEAD tag must fit in a single record.
+	if len(payload)+1+16 > webPushRecordSize {
+		return nil, fmt.Errorf("web push payload too large: %d bytes", len(payload))
+	}
+
+	// Ephemeral application server key pair.
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asPrivate.PublicKey().Bytes()
+	ecdhSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	// Combine the ECDH secret with the authentication secret (RFC 8291 section 3.4).
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPublicBytes...), asPublic...)
+	ikm, err := hkdf.Key(sha256.New, ecdhSecret, authSecret, string(keyInfo), 32)
+	if err != nil {
+		return nil, err
+	}
+
+	// Derive content encryption key and nonce (RFC 8188 section 2.2).
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	cek, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// Single record with the last record padding delimiter.
+	plaintext := append(append([]byte{}, payload...), 0x02)
+	ciphertext := gcm.Seal(nil, nonce, plaintext, nil)
+
+	// Header: salt, record size, key id length and key id (the server public key).
+	body := make([]byte, 0, 16+4+1+len(asPublic)+len(ciphertext))
+	body = append(body, salt...)
+	body = binary.BigEndian.AppendUint32(body, webPushRecordSize)
+	body = append(body, byte(len(asPublic)))
+	body = append(body, asPublic...)
+	body = append(body, ciphertext...)
+	return body, nil
+}
+
+// Decode base64url strings with or without padding, as browsers are not consistent.
+func decodeBase64Url(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(trimPadding(s))
+}
+
+func trimPadding(s string) string {
+	for len(s) > 0 && s[len(s)-1] == '=' {
+		s = s[:len(s)-1]
+	}
+	return s
+}
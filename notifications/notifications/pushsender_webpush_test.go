@@ -0,0 +1,210 @@
+package notifications
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Decrypt a aes128gcm Web Push message body as a browser would do.
+func decryptWebPush(t *testing.T, body []byte, uaPrivate *ecdh.PrivateKey, authSecret []byte) []byte {
+	salt := body[:16]
+	rs := binary.BigEndian.Uint32(body[16:20])
+	if rs != webPushRecordSize {
+		t.Fatalf("Unexpected record size %d", rs)
+	}
+	idlen := int(body[20])
+	asPublicBytes := body[21 : 21+idlen]
+	ciphertext := body[21+idlen:]
+
+	asPublic, err := ecdh.P256().NewPublicKey(asPublicBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdhSecret, err := uaPrivate.ECDH(asPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPrivate.PublicKey().Bytes()...), asPublicBytes...)
+	ikm, _ := hkdf.Key(sha256.New, ecdhSecret, authSecret, string(keyInfo), 32)
+	cek, _ := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: aes128gcm\x00", 16)
+	nonce, _ := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: nonce\x00", 12)
+
+	block, _ := aes.NewCipher(cek)
+	gcm, _ := cipher.NewGCM(block)
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Remove padding delimiter.
+	if plaintext[len(plaintext)-1] != 0x02 {
+		t.Fatal("Missing padding delimiter")
+	}
+	return plaintext[:len(plaintext)-1]
+}
+
+// Verify the VAPID JWT signature and return its claims.
+func verifyVapid(t *testing.T, header string) map[string]interface{} {
+	if !strings.HasPrefix(header, "vapid t=") {
+		t.Fatalf("Unexpected Authorization header %s", header)
+	}
+	parts := strings.Split(strings.TrimPrefix(header, "vapid "), ", ")
+	token := strings.TrimPrefix(parts[0], "t=")
+	key, _ := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(parts[1], "k="))
+
+	segments := strings.Split(token, ".")
+	signature, _ := base64.RawURLEncoding.DecodeString(segments[2])
+	hash := sha256.Sum256([]byte(segments[0] + "." + segments[1]))
+	public := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(key[1:33]),
+		Y:     new(big.Int).SetBytes(key[33:]),
+	}
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(public, hash[:], r, s) {
+		t.Fatal("Invalid VAPID signature")
+	}
+	claimsJson, _ := base64.RawURLEncoding.DecodeString(segments[1])
+	claims := map[string]interface{}{}
+	json.Unmarshal(claimsJson, &claims)
+	return claims
+}
+
+func TestWebPushSender(t *testing.T) {
+	// Browser subscription keys.
+	uaPrivate, _ := ecdh.P256().GenerateKey(rand.Reader)
+	authSecret := make([]byte, 16)
+	rand.Read(authSecret)
+
+	// Application server VAPID key.
+	vapidKey, _ := ecdh.P256().GenerateKey(rand.Reader)
+	sender, err := NewWebPushSender(base64.RawURLEncoding.EncodeToString(vapidKey.Bytes()), "mailto:admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Push service stand-in.
+	var received []byte
+	var claims map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/expired" {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		if r.Header.Get("Content-Encoding") != "aes128gcm" {
+			t.Errorf("Unexpected Content-Encoding %s", r.Header.Get("Content-Encoding"))
+		}
+		if r.Header.Get("TTL") == "" {
+			t.Error("Missing TTL header")
+		}
+		claims = verifyVapid(t, r.Header.Get("Authorization"))
+		body, _ := io.ReadAll(r.Body)
+		received = decryptWebPush(t, body, uaPrivate, authSecret)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	keys := map[string]interface{}{
+		"p256dh": base64.RawURLEncoding.EncodeToString(uaPrivate.PublicKey().Bytes()),
+		"auth":   base64.URLEncoding.EncodeToString(authSecret),
+	}
+	subscriptions := []*Subscription{
+		{Endpoint: server.URL + "/push/1", Keys: keys},
+		{Endpoint: server.URL + "/expired", Keys: keys},
+	}
+	message := PushMessage{Data: map[string]string{"event": "TransferCommitted", "code": "GRP1"}}
+
+	results, err := sender.SendPush(context.Background(), message, subscriptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Error != nil {
+		t.Errorf("Unexpected error %v", results[0].Error)
+	}
+	if !results[1].Expired {
+		t.Error("Expected expired subscription")
+	}
+
+	payload := struct {
+		Data map[string]string `json:"data"`
+	}{}
+	if err := json.Unmarshal(received, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Data["event"] != "TransferCommitted" || payload.Data["code"] != "GRP1" {
+		t.Errorf("Unexpected payload %s", received)
+	}
+	if claims["aud"] != server.URL || claims["sub"] != "mailto:admin@example.com" {
+		t.Errorf("Unexpected VAPID claims %v", claims)
+	}
+}
+
+func TestPushRouter(t *testing.T) {
+	fcm := NewMockPushSender()
+	router := NewPushRouter(fcm, nil)
+	subscriptions := []*Subscription{
+		{Token: "token1"},
+		{Endpoint: "https://push.example.com/1"},
+		{Token: "token2"},
+	}
+	results, err := router.SendPush(context.Background(), PushMessage{}, subscriptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fcm.Subscriptions[0]) != 2 {
+		t.Errorf("Expected 2 FCM subscriptions, got %d", len(fcm.Subscriptions[0]))
+	}
+	if results[0].Error != nil || results[2].Error != nil {
+		t.Error("Unexpected error for FCM subscriptions")
+	}
+	if results[1].Error == nil {
+		t.Error("Expected error for Web Push subscription without sender")
+	}
+}
+
+// Push sender that fails as a whole.
+type failingPushSender struct{}
+
+func (failingPushSender) SendPush(ctx context.Context, message PushMessage, subscriptions []*Subscription) ([]PushResult, error) {
+	return nil, errors.New("service unavailable")
+}
+
+func TestPushRouterFailure(t *testing.T) {
+	webPush := NewMockPushSender()
+	subscriptions := []*Subscription{
+		{Token: "token1"},
+		{Endpoint: "https://push.example.com/1"},
+	}
+	// Web Push subscriptions are still sent when FCM fails.
+	results, err := NewPushRouter(failingPushSender{}, webPush).SendPush(context.Background(), PushMessage{}, subscriptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Error == nil || results[0].Expired {
+		t.Errorf("Expected error for FCM subscription, got %+v", results[0])
+	}
+	if results[1].Error != nil || len(webPush.Sent()) != 1 {
+		t.Errorf("Expected Web Push subscription sent, got %+v", results[1])
+	}
+	// Fails if all senders fail.
+	if _, err := NewPushRouter(failingPushSender{}, failingPushSender{}).SendPush(context.Background(), PushMessage{}, subscriptions); err == nil {
+		t.Error("Expected error when all senders fail")
+	}
+}
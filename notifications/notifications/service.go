@@ -3,10 +3,12 @@ package notifications
 // Implements the /subscriptions Notifications API endpoint.
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"reflect"
 	"strings"
 
@@ -18,31 +20,92 @@ import (
 	"github.com/rs/xid"
 )
 
-// Subscrption resource object
+// Subscrption resource object. Subscriptions are either for Firebase Cloud Messaging,
+// identified by a token, or for Web Push, identified by the push service endpoint and
+// the "p256dh" and "auth" keys of the browser PushSubscription.
 type Subscription struct {
-	Id    string `jsonapi:"primary,subscriptions" json:"id"`
-	Token string `jsonapi:"attr,token" json:"token"`
+	Id       string                 `jsonapi:"primary,subscriptions" json:"id"`
+	Token    string                 `jsonapi:"attr,token" json:"token"`
+	Endpoint string                 `jsonapi:"attr,endpoint,omitempty" json:"endpoint,omitempty"`
+	Keys     map[string]interface{} `jsonapi:"attr,keys,omitempty" json:"keys,omitempty"`
 	// jsonapi lib doesn't support typed embedded structs.
 	Settings map[string]interface{} `jsonapi:"attr,settings" json:"settings"`
 	User     *api.ExternalUser      `jsonapi:"relation,user" json:"user"`
 	Member   *api.ExternalMember    `jsonapi:"relation,member" json:"member"`
 }
 
-// Checks that the token present in Authorization header is valid and
-// matches the given user. Also checks that the member belongs to the
-// given user. Calls the social api to perform these checks.
-func validateAuthorization(w http.ResponseWriter, r *http.Request, user *api.ExternalUser, member *api.ExternalMember) error {
+// Whether this is a Web Push subscription instead of an FCM one.
+func (sub *Subscription) IsWebPush() bool {
+	return sub.Endpoint != ""
+}
+
+// Checks that the subscription has either an FCM token or a valid Web Push
+// endpoint and keys.
+func validateSubscriptionTarget(subscription *Subscription) error {
+	if !subscription.IsWebPush() {
+		if subscription.Token == "" {
+			return errors.New("missing token or endpoint attribute")
+		}
+		return nil
+	}
+	endpoint, err := url.Parse(subscription.Endpoint)
+	if err != nil || endpoint.Scheme != "https" || endpoint.Host == "" {
+		return errors.New("endpoint must be an https URL")
+	}
+	for _, key := range []string{"p256dh", "auth"} {
+		if value, ok := subscription.Keys[key].(string); !ok || value == "" {
+			return fmt.Errorf("missing %s key", key)
+		}
+	}
+	return nil
+}
+
+// Returns the user identified by the token present in Authorization header.
+// The token is validated locally as a JWT when possible, and the user and its
+// members are taken from the claims. Otherwise, or if the token doesn't have the
+// members claim, calls the social api to fetch the user.
+func authenticate(w http.ResponseWriter, r *http.Request) (*api.User, error) {
 	token := strings.Trim(r.Header.Get("Authorization"), " ")
 	prefix := "Bearer "
 	if !strings.HasPrefix(token, prefix) {
 		msg := http.StatusText(http.StatusUnauthorized)
 		http.Error(w, msg, http.StatusUnauthorized)
-		return errors.New(msg)
+		return nil, errors.New(msg)
 	}
 	token = strings.Trim(token[len(prefix):], " ")
+	claims, err := api.ValidateToken(token)
+	if err == nil && claims.Members != nil {
+		return claims.User(), nil
+	}
+	if err != nil && !errors.Is(err, api.ErrLocalValidationUnavailable) {
+		http.Error(w, "Invalid access token.", http.StatusUnauthorized)
+		return nil, err
+	}
 	fetchedUser, err := api.GetUserByToken(r.Context(), token)
 	if err != nil {
 		http.Error(w, "Error fetching the user resource with given token.", http.StatusUnauthorized)
+		return nil, err
+	}
+	return fetchedUser, nil
+}
+
+// Whether the given member belongs to the user.
+func hasMember(user *api.User, memberId string) bool {
+	for _, m := range user.Members {
+		if m.Id == memberId {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks that the token present in Authorization header is valid and
+// matches the given user. Also checks that the member belongs to the
+// given user. Calls the social api to perform these checks if the token
+// claims are not enough.
+func validateAuthorization(w http.ResponseWriter, r *http.Request, user *api.ExternalUser, member *api.ExternalMember) error {
+	fetchedUser, err := authenticate(w, r)
+	if err != nil {
 		return err
 	}
 	// check that the fetched user is the one that should.
@@ -52,13 +115,7 @@ func validateAuthorization(w http.ResponseWriter, r *http.Request, user *api.Ext
 		return fmt.Errorf("%s", msg)
 
 	}
-	found := false
-	for _, m := range fetchedUser.Members {
-		if m.Id == member.Id {
-			found = true
-		}
-	}
-	if !found {
+	if !hasMember(fetchedUser, member.Id) {
 		msg := "the user doesn't have the required member"
 		http.Error(w, msg, http.StatusForbidden)
 		return fmt.Errorf("%s", msg)
@@ -66,7 +123,60 @@ func validateAuthorization(w http.ResponseWriter, r *http.Request, user *api.Ext
 	return nil
 }
 
-func subscriptionsHandler(store *store.Store) http.HandlerFunc {
+// Handler for /subscriptions, either listing (GET) or creating (POST) subscriptions.
+func subscriptionsHandler(store store.Store) http.HandlerFunc {
+	list := listSubscriptionsHandler(store)
+	create := createSubscriptionHandler(store)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			list(w, r)
+		} else {
+			create(w, r)
+		}
+	}
+}
+
+// Handler for GET /subscriptions. Returns the subscriptions of the authenticated
+// user, optionally only those of filter[member].
+func listSubscriptionsHandler(store store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, memberId, err := authenticateWithMemberFilter(w, r)
+		if err != nil {
+			return
+		}
+		memberIds := []string{memberId}
+		if memberId == "" {
+			memberIds = make([]string, len(user.Members))
+			for i, member := range user.Members {
+				memberIds[i] = member.Id
+			}
+		}
+		subscriptions := []*Subscription{}
+		for _, id := range memberIds {
+			res, err := store.GetByIndex(r.Context(), "subscriptions", reflect.TypeOf((*Subscription)(nil)), "member", id)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+			for _, item := range res {
+				// Members may have several users, only show the own devices.
+				if sub := item.(*Subscription); sub.User.Id == user.Id {
+					subscriptions = append(subscriptions, sub)
+				}
+			}
+		}
+
+		w.Header().Set(service.ContentType, jsonapi.MediaType)
+		w.WriteHeader(http.StatusOK)
+		err = service.MarshalSparsePayload(w, r, subscriptions)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func createSubscriptionHandler(store store.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Validate request and get subscription.
 		err := service.ValidatePost(w, r)
@@ -85,6 +195,10 @@ func subscriptionsHandler(store *store.Store) http.HandlerFunc {
 			http.Error(w, "Missing member and/or user relationships.", http.StatusBadRequest)
 			return
 		}
+		if err := validateSubscriptionTarget(subscription); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		if validateAuthorization(w, r, subscription.User, subscription.Member) != nil {
 			return
 		}
@@ -101,6 +215,7 @@ func subscriptionsHandler(store *store.Store) http.HandlerFunc {
 		for _, current := range existing {
 			sub := current.(*Subscription)
 			if sub.Token == subscription.Token &&
+				sub.Endpoint == subscription.Endpoint &&
 				sub.Member.Id == subscription.Member.Id &&
 				sub.User.Id == subscription.User.Id {
 				// Set the subscription id to the matching id so the subscription will ve overwritten.
@@ -135,7 +250,100 @@ func subscriptionsHandler(store *store.Store) http.HandlerFunc {
 	}
 }
 
-func deleteSubscriptionHandler(store *store.Store) http.HandlerFunc {
+// Get the subscription with the id in the URL and check that it belongs to the
+// authenticated user. Writes the http error and returns nil otherwise.
+func getAuthorizedSubscription(w http.ResponseWriter, r *http.Request, store store.Store) *Subscription {
+	id := mux.Vars(r)["id"]
+	subscription := new(Subscription)
+	err := store.Get(r.Context(), "subscriptions", id, subscription)
+	if err != nil {
+		http.Error(w, "Subscription not found.", http.StatusNotFound)
+		return nil
+	}
+	if validateAuthorization(w, r, subscription.User, subscription.Member) != nil {
+		return nil
+	}
+	return subscription
+}
+
+// Handler for GET /subscriptions/{id}.
+func getSubscriptionHandler(store store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if service.ValidateGet(w, r) != nil {
+			return
+		}
+		subscription := getAuthorizedSubscription(w, r, store)
+		if subscription == nil {
+			return
+		}
+		w.Header().Set(service.ContentType, jsonapi.MediaType)
+		w.WriteHeader(http.StatusOK)
+		err := service.MarshalSparsePayload(w, r, subscription)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Handler for PATCH /subscriptions/{id}. Allows to update the settings and the
+// push target of the subscription. Omitted attributes are left unchanged.
+func updateSubscriptionHandler(store store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if service.ValidatePatch(w, r) != nil {
+			return
+		}
+		patch := new(Subscription)
+		if service.ValidateJson(w, r, patch) != nil {
+			return
+		}
+		if patch.Id != mux.Vars(r)["id"] {
+			http.Error(w, "Resource id doesn't match the URL.", http.StatusConflict)
+			return
+		}
+		subscription := getAuthorizedSubscription(w, r, store)
+		if subscription == nil {
+			return
+		}
+		if (patch.User != nil && patch.User.Id != subscription.User.Id) ||
+			(patch.Member != nil && patch.Member.Id != subscription.Member.Id) {
+			http.Error(w, "Subscription user and member can't be changed.", http.StatusForbidden)
+			return
+		}
+		if patch.Settings != nil {
+			subscription.Settings = patch.Settings
+		}
+		if patch.Token != "" {
+			subscription.Token = patch.Token
+		}
+		if patch.Endpoint != "" {
+			subscription.Endpoint = patch.Endpoint
+		}
+		if patch.Keys != nil {
+			subscription.Keys = patch.Keys
+		}
+		if err := validateSubscriptionTarget(subscription); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err := store.Set(r.Context(), "subscriptions", subscription.Id, subscription, map[string]string{"member": subscription.Member.Id}, 0)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		log.Printf("Updated subscription %s.\n", subscription.Id)
+
+		w.Header().Set(service.ContentType, jsonapi.MediaType)
+		w.WriteHeader(http.StatusOK)
+		err = service.MarshalSparsePayload(w, r, subscription)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func deleteSubscriptionHandler(store store.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		err := service.ValidateDelete(w, r)
 		if err != nil {
@@ -182,14 +390,29 @@ func InitService() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	// Set handler for create subscription at /subscriptions
+	// Set handler for list and create subscriptions at /subscriptions
 	// We don't use gorilla mux here because the server issues a 301 redirect from /subscriptions
 	// to /subscriptions/ which is not what we want.
 	http.HandleFunc("/subscriptions", subscriptionsHandler(store))
 
-	// Set handler for delete subscription at /subscriptions/{id}
+	// Set handlers for get, update and delete subscription at /subscriptions/{id}
 	// We use gorilla mux here for convenient handling of path parameters.
 	r := mux.NewRouter()
+	r.Path("/subscriptions/{id}").Methods(http.MethodGet).HandlerFunc(getSubscriptionHandler(store))
+	r.Path("/subscriptions/{id}").Methods(http.MethodPatch).HandlerFunc(updateSubscriptionHandler(store))
 	r.Path("/subscriptions/{id}").Methods(http.MethodDelete).HandlerFunc(deleteSubscriptionHandler(store))
 	http.Handle("/subscriptions/", r)
+
+	// Set handlers for the notifications inbox.
+	http.HandleFunc("/notifications", notificationsHandler(store))
+	live, err := newLiveStream(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	hub := newLiveHub(live)
+	go hub.run(context.Background())
+	r.Path("/notifications/stream").Methods(http.MethodGet).HandlerFunc(liveHandler(hub))
+	r.Path("/notifications/mark-all-read").Methods(http.MethodPost).HandlerFunc(markAllReadHandler(store))
+	r.Path("/notifications/{id}").Methods(http.MethodPatch).HandlerFunc(updateNotificationHandler(store))
+	http.Handle("/notifications/", r)
 }
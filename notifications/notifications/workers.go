@@ -0,0 +1,96 @@
+package notifications
+
+// Pool of goroutines that handle events concurrently.
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+
+	"github.com/komunitin/komunitin/notifications/events"
+)
+
+// Number of events that can be queued for each worker before the reader blocks.
+const workerQueueSize = 16
+
+// Transfer events of the same group are always handled by the same worker in the
+// order they are read from the stream, so users get the notifications of their
+// payments in order. Other events are handled by the first free worker of a
+// separate set, so a slow group event doesn't delay transfer notifications.
+// Note that failed events are retried later, possibly after newer events.
+type workerPool struct {
+	// Queues for events that need to be handled in order, one for each worker.
+	ordered []chan *events.Event
+	// Queue for events that can be handled in any order, shared by all workers.
+	unordered chan *events.Event
+	wg        sync.WaitGroup
+}
+
+// Start size workers for ordered events plus size workers for the rest of events,
+// all of them calling handler for each event.
+func newWorkerPool(size int, handler func(event *events.Event)) *workerPool {
+	if size < 1 {
+		size = 1
+	}
+	pool := &workerPool{
+		ordered:   make([]chan *events.Event, size),
+		unordered: make(chan *events.Event, workerQueueSize),
+	}
+	for i := range pool.ordered {
+		pool.ordered[i] = make(chan *events.Event, workerQueueSize)
+		pool.start(pool.ordered[i], handler)
+	}
+	for i := 0; i < size; i++ {
+		pool.start(pool.unordered, handler)
+	}
+	return pool
+}
+
+func (pool *workerPool) start(queue chan *events.Event, handler func(event *events.Event)) {
+	pool.wg.Add(1)
+	go func() {
+		defer pool.wg.Done()
+		for event := range queue {
+			handler(event)
+		}
+	}()
+}
+
+// Queue the event to be handled by a worker. It blocks while the worker queue is
+// full, unless the context is done.
+func (pool *workerPool) dispatch(ctx context.Context, event *events.Event) error {
+	queue := pool.unordered
+	if isOrdered(event) {
+		queue = pool.ordered[partition(event.Code, len(pool.ordered))]
+	}
+	select {
+	case queue <- event:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stop accepting events and wait until all queued events are handled.
+func (pool *workerPool) close() {
+	for _, queue := range pool.ordered {
+		close(queue)
+	}
+	close(pool.unordered)
+	pool.wg.Wait()
+}
+
+// Whether the event must be handled after the previous events of the same group.
+func isOrdered(event *events.Event) bool {
+	switch event.Name {
+	case events.TransferCommitted, events.TransferPending, events.TransferRejected:
+		return true
+	}
+	return false
+}
+
+func partition(code string, size int) int {
+	h := fnv.New32a()
+	h.Write([]byte(code))
+	return int(h.Sum32() % uint32(size))
+}
@@ -0,0 +1,77 @@
+package notifications
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/komunitin/komunitin/notifications/events"
+)
+
+func TestWorkerPoolOrder(t *testing.T) {
+	var mu sync.Mutex
+	handled := map[string][]string{}
+
+	pool := newWorkerPool(4, func(event *events.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		handled[event.Code] = append(handled[event.Code], event.Id)
+	})
+	codes := []string{"GRP1", "GRP2", "GRP3"}
+	for i := 0; i < 30; i++ {
+		event := &events.Event{
+			Id:   strconv.Itoa(i),
+			Name: events.TransferCommitted,
+			Code: codes[i%len(codes)],
+		}
+		if err := pool.dispatch(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pool.close()
+
+	for _, code := range codes {
+		ids := handled[code]
+		if len(ids) != 10 {
+			t.Fatalf("Expected 10 events for %s, got %d", code, len(ids))
+		}
+		for i := 1; i < len(ids); i++ {
+			prev, _ := strconv.Atoi(ids[i-1])
+			cur, _ := strconv.Atoi(ids[i])
+			if cur < prev {
+				t.Errorf("Events of %s handled out of order: %v", code, ids)
+			}
+		}
+	}
+}
+
+func TestWorkerPoolSlowEvent(t *testing.T) {
+	release := make(chan bool)
+	done := make(chan string, 1)
+
+	pool := newWorkerPool(1, func(event *events.Event) {
+		if event.Name == events.MemberJoined {
+			<-release
+		} else {
+			done <- event.Id
+		}
+	})
+	defer pool.close()
+
+	ctx := context.Background()
+	pool.dispatch(ctx, &events.Event{Id: "1", Name: events.MemberJoined, Code: "GRP1"})
+	pool.dispatch(ctx, &events.Event{Id: "2", Name: events.TransferCommitted, Code: "GRP1"})
+
+	// The transfer event must not wait for the slow group event.
+	select {
+	case id := <-done:
+		if id != "2" {
+			t.Errorf("Expected event 2, got %s", id)
+		}
+	case <-time.After(time.Second):
+		t.Error("Transfer event blocked by slow group event")
+	}
+	close(release)
+}
@@ -9,6 +9,9 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
 
 	"github.com/komunitin/jsonapi"
 )
@@ -17,6 +20,40 @@ const (
 	ContentType = "Content-Type"
 )
 
+// JSON:API error object (https://jsonapi.org/format/#error-objects) for a request
+// that is well-formed but has invalid values.
+type ValidationError struct {
+	Status string       `json:"status"`
+	Title  string       `json:"title"`
+	Detail string       `json:"detail,omitempty"`
+	Source *ErrorSource `json:"source,omitempty"`
+}
+
+type ErrorSource struct {
+	// JSON pointer to the invalid value in the request document, as "/data/attributes/name".
+	Pointer string `json:"pointer"`
+}
+
+// Returns a validation error for the value at the given JSON pointer.
+func NewValidationError(pointer string, title string, detail string) *ValidationError {
+	return &ValidationError{
+		Status: strconv.Itoa(http.StatusUnprocessableEntity),
+		Title:  title,
+		Detail: detail,
+		Source: &ErrorSource{Pointer: pointer},
+	}
+}
+
+// Writes a 422 Unprocessable Entity response with the given errors.
+func WriteValidationErrors(w http.ResponseWriter, errs []*ValidationError) {
+	w.Header().Set(ContentType, jsonapi.MediaType)
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	err := json.NewEncoder(w).Encode(map[string]interface{}{"errors": errs})
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
 // Validates the request is POST and JSON:API content type.
 func ValidatePost(w http.ResponseWriter, r *http.Request) error {
 	// Validate HTTP POST Method.
@@ -35,6 +72,35 @@ func ValidatePost(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// Validates the request is PATCH and JSON:API content type.
+func ValidatePatch(w http.ResponseWriter, r *http.Request) error {
+	// Validate HTTP PATCH Method.
+	if r.Method != http.MethodPatch {
+		msg := http.StatusText(http.StatusMethodNotAllowed)
+		http.Error(w, msg, http.StatusMethodNotAllowed)
+		return errors.New(msg)
+	}
+	// Validate "application/vnd.api+json" Content-Type
+	contentType := r.Header.Get(ContentType)
+	if contentType != jsonapi.MediaType {
+		msg := http.StatusText(http.StatusUnsupportedMediaType)
+		http.Error(w, msg, http.StatusUnsupportedMediaType)
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// Validates the request is GET.
+func ValidateGet(w http.ResponseWriter, r *http.Request) error {
+	// Validate HTTP GET Method.
+	if r.Method != http.MethodGet {
+		msg := http.StatusText(http.StatusMethodNotAllowed)
+		http.Error(w, msg, http.StatusMethodNotAllowed)
+		return errors.New(msg)
+	}
+	return nil
+}
+
 // Validates the request is DELETE.
 func ValidateDelete(w http.ResponseWriter, r *http.Request) error {
 	// Validate HTTP DELETE Method.
@@ -46,14 +112,68 @@ func ValidateDelete(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// Writes the models as a JSON:API document, keeping only the fields requested with
+// the fields[TYPE] query parameters (https://jsonapi.org/format/#fetching-sparse-fieldsets).
+func MarshalSparsePayload(w io.Writer, r *http.Request, models interface{}) error {
+	payload, err := jsonapi.Marshal(models)
+	if err != nil {
+		return err
+	}
+	var nodes []*jsonapi.Node
+	switch p := payload.(type) {
+	case *jsonapi.OnePayload:
+		nodes = append([]*jsonapi.Node{p.Data}, p.Included...)
+	case *jsonapi.ManyPayload:
+		nodes = append(p.Data, p.Included...)
+	}
+	query := r.URL.Query()
+	for _, node := range nodes {
+		if node == nil || !query.Has("fields["+node.Type+"]") {
+			continue
+		}
+		fields := map[string]bool{}
+		for _, field := range strings.Split(query.Get("fields["+node.Type+"]"), ",") {
+			fields[strings.TrimSpace(field)] = true
+		}
+		for name := range node.Attributes {
+			if !fields[name] {
+				delete(node.Attributes, name)
+			}
+		}
+		for name := range node.Relationships {
+			if !fields[name] {
+				delete(node.Relationships, name)
+			}
+		}
+	}
+	return json.NewEncoder(w).Encode(payload)
+}
+
 // Decodes the request body into JSON and reports any encoding error.
 func ValidateJson(w http.ResponseWriter, r *http.Request, res interface{}) error {
-	// Use http.MaxBytesReader to enforce a maximum read of 16KB from the
+	return decodeJson(w, r, 16*1024, func(body io.Reader) error {
+		return jsonapi.UnmarshalPayload(body, res)
+	})
+}
+
+// Decodes the request body into a list of resources of the given type (a pointer to
+// a struct) and reports any encoding error. Bodies of up to 1MB are accepted.
+func ValidateJsonMany(w http.ResponseWriter, r *http.Request, t reflect.Type) ([]interface{}, error) {
+	var res []interface{}
+	err := decodeJson(w, r, 1024*1024, func(body io.Reader) error {
+		var err error
+		res, _, err = jsonapi.UnmarshalManyPayload(body, t)
+		return err
+	})
+	return res, err
+}
+
+func decodeJson(w http.ResponseWriter, r *http.Request, maxBytes int64, unmarshal func(body io.Reader) error) error {
+	// Use http.MaxBytesReader to enforce a maximum read of maxBytes from the
 	// response body. A request body larger than that will now result in
 	// Decode() returning a "http: request body too large" error.
-	body := http.MaxBytesReader(w, r.Body, 16*1024)
-	err := jsonapi.UnmarshalPayload(body, res)
-
+	body := http.MaxBytesReader(w, r.Body, maxBytes)
+	err := unmarshal(body)
 	// Error validation code from https://www.alexedwards.net/blog/how-to-properly-parse-a-json-request-body.
 	if err != nil {
 		var syntaxError *json.SyntaxError
@@ -94,7 +214,7 @@ func ValidateJson(w http.ResponseWriter, r *http.Request, res interface{}) error
 		// there is an open issue regarding turning this into a sentinel
 		// error at https://github.com/golang/go/issues/30715.
 		case err.Error() == "http: request body too large":
-			msg = "Request body must not be larger than 16KB"
+			msg = fmt.Sprintf("Request body must not be larger than %dKB", maxBytes/1024)
 			http.Error(w, msg, http.StatusRequestEntityTooLarge)
 
 		// Catch errors from jsonapi module
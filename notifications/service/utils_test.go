@@ -0,0 +1,38 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+type testResource struct {
+	Id    string `jsonapi:"primary,things"`
+	Name  string `jsonapi:"attr,name"`
+	Color string `jsonapi:"attr,color"`
+}
+
+func TestMarshalSparsePayload(t *testing.T) {
+	r := httptest.NewRequest("GET", "/things?fields[things]=name", nil)
+	var buf bytes.Buffer
+	err := MarshalSparsePayload(&buf, r, []*testResource{{Id: "1", Name: "one", Color: "red"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Data []struct {
+			Id         string                 `json:"id"`
+			Attributes map[string]interface{} `json:"attributes"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Data) != 1 || doc.Data[0].Id != "1" {
+		t.Fatalf("Unexpected document %s", buf.String())
+	}
+	if len(doc.Data[0].Attributes) != 1 || doc.Data[0].Attributes["name"] != "one" {
+		t.Errorf("Unexpected attributes %v", doc.Data[0].Attributes)
+	}
+}
@@ -0,0 +1,209 @@
+package store
+
+// In-memory implementation of Store, with the same semantics as the Redis one.
+//
+// All the in-memory stores and streams of the process share the same data, so the
+// service can run in a single node without Redis and handlers can be tested without
+// a Redis server.
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryObject struct {
+	value string
+	// Zero if the object doesn't expire.
+	expires time.Time
+}
+
+type memoryDB struct {
+	mutex   sync.Mutex
+	objects map[string]*memoryObject
+	// Index sets by index key.
+	indexes map[string]map[string]bool
+	// Indexes of each object by object key.
+	tracked map[string]map[string]string
+	streams map[string]*memoryStreamData
+}
+
+var memory = newMemoryDB()
+
+func newMemoryDB() *memoryDB {
+	return &memoryDB{
+		objects: map[string]*memoryObject{},
+		indexes: map[string]map[string]bool{},
+		tracked: map[string]map[string]string{},
+		streams: map[string]*memoryStreamData{},
+	}
+}
+
+// Remove all the data of the in-memory backend. Intended for tests.
+func ResetMemory() {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	fresh := newMemoryDB()
+	memory.objects = fresh.objects
+	memory.indexes = fresh.indexes
+	memory.tracked = fresh.tracked
+	memory.streams = fresh.streams
+}
+
+// Return the object or nil if it doesn't exist. Expired objects are removed but,
+// as in Redis, they are left in the index sets until RepairIndexes is called.
+func (db *memoryDB) object(class string, id string) *memoryObject {
+	k := key(class, id)
+	obj := db.objects[k]
+	if obj != nil && !obj.expires.IsZero() && !time.Now().Before(obj.expires) {
+		delete(db.objects, k)
+		delete(db.tracked, objectIndexesKey(class, id))
+		return nil
+	}
+	return obj
+}
+
+func (db *memoryDB) addToIndex(class string, index string, indexId string, id string) {
+	k := indexKey(class, index, indexId)
+	if db.indexes[k] == nil {
+		db.indexes[k] = map[string]bool{}
+	}
+	db.indexes[k][id] = true
+}
+
+func (db *memoryDB) removeFromIndex(class string, index string, indexId string, id string) {
+	k := indexKey(class, index, indexId)
+	delete(db.indexes[k], id)
+	// Redis removes empty sets.
+	if len(db.indexes[k]) == 0 {
+		delete(db.indexes, k)
+	}
+}
+
+// Store implementation keeping the data in the process memory.
+type MemoryStore struct {
+	db *memoryDB
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{db: memory}
+}
+
+func (store *MemoryStore) Set(ctx context.Context, class string, id string, value interface{}, indexes map[string]string, expire time.Duration) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	db := store.db
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	obj := &memoryObject{value: string(encoded)}
+	if expire > 0 {
+		obj.expires = time.Now().Add(expire)
+	}
+	db.objects[key(class, id)] = obj
+
+	tracked := objectIndexesKey(class, id)
+	for index, indexId := range db.tracked[tracked] {
+		if indexes[index] != indexId {
+			db.removeFromIndex(class, index, indexId, id)
+		}
+	}
+	delete(db.tracked, tracked)
+	if len(indexes) > 0 {
+		db.tracked[tracked] = make(map[string]string, len(indexes))
+		for index, indexId := range indexes {
+			db.addToIndex(class, index, indexId, id)
+			db.tracked[tracked][index] = indexId
+		}
+	}
+	return nil
+}
+
+func (store *MemoryStore) SetIfAbsent(ctx context.Context, class string, id string, value interface{}, expire time.Duration) (bool, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return false, err
+	}
+	db := store.db
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.object(class, id) != nil {
+		return false, nil
+	}
+	obj := &memoryObject{value: string(encoded)}
+	if expire > 0 {
+		obj.expires = time.Now().Add(expire)
+	}
+	db.objects[key(class, id)] = obj
+	return true, nil
+}
+
+func (store *MemoryStore) Get(ctx context.Context, class string, id string, v interface{}) error {
+	store.db.mutex.Lock()
+	obj := store.db.object(class, id)
+	store.db.mutex.Unlock()
+	if obj == nil {
+		return ErrNotFound
+	}
+	return json.Unmarshal([]byte(obj.value), v)
+}
+
+func (store *MemoryStore) Delete(ctx context.Context, class string, id string) error {
+	db := store.db
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	tracked := objectIndexesKey(class, id)
+	for index, indexId := range db.tracked[tracked] {
+		db.removeFromIndex(class, index, indexId, id)
+	}
+	delete(db.tracked, tracked)
+	delete(db.objects, key(class, id))
+	return nil
+}
+
+func (store *MemoryStore) GetByIndex(ctx context.Context, class string, t reflect.Type, index string, id string) ([]interface{}, error) {
+	db := store.db
+	db.mutex.Lock()
+	encoded := []string{}
+	for objectId := range db.indexes[indexKey(class, index, id)] {
+		if obj := db.object(class, objectId); obj != nil {
+			encoded = append(encoded, obj.value)
+		}
+	}
+	db.mutex.Unlock()
+
+	values := []interface{}{}
+	for _, v := range encoded {
+		item := reflect.New(t.Elem()).Interface()
+		err := json.Unmarshal([]byte(v), item)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, item)
+	}
+	return values, nil
+}
+
+func (store *MemoryStore) RepairIndexes(ctx context.Context) (int, error) {
+	db := store.db
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	pruned := 0
+	for k, ids := range db.indexes {
+		parts := strings.SplitN(k, ":", 4)
+		class, index, indexId := parts[1], parts[2], parts[3]
+		for id := range ids {
+			if db.object(class, id) != nil && db.tracked[objectIndexesKey(class, id)][index] == indexId {
+				continue
+			}
+			db.removeFromIndex(class, index, indexId, id)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
@@ -0,0 +1,370 @@
+package store
+
+// In-memory implementation of Stream, with the same semantics as the Redis one:
+// consumer groups, pending lists, retries with backoff and dead-letter streams.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+type memoryPending struct {
+	consumer  string
+	delivered time.Time
+}
+
+type memoryGroup struct {
+	// Id of the last item delivered to the group.
+	lastDelivered string
+	pending       map[string]*memoryPending
+	// Time each failed item has to be retried.
+	retries map[string]time.Time
+	// Number of failed attempts of each item.
+	attempts map[string]int64
+	// Consumers of the group. Groups without consumers don't prevent trimming.
+	consumers map[string]bool
+}
+
+type memoryStreamData struct {
+	items []StreamItem
+	// Last generated id, which may no longer be in items.
+	lastId string
+	groups map[string]*memoryGroup
+	// Closed when an item is added, to wake up blocked readers.
+	added chan struct{}
+}
+
+// Return the stream data with the given name, creating it if it doesn't exist.
+func (db *memoryDB) stream(name string) *memoryStreamData {
+	data := db.streams[name]
+	if data == nil {
+		data = &memoryStreamData{
+			lastId: "0-0",
+			groups: map[string]*memoryGroup{},
+			added:  make(chan struct{}),
+		}
+		db.streams[name] = data
+	}
+	return data
+}
+
+// Return the group with the given name, creating it at the end of the stream if it
+// doesn't exist.
+func (data *memoryStreamData) group(name string) *memoryGroup {
+	group := data.groups[name]
+	if group == nil {
+		group = &memoryGroup{
+			lastDelivered: data.lastId,
+			pending:       map[string]*memoryPending{},
+			retries:       map[string]time.Time{},
+			attempts:      map[string]int64{},
+			consumers:     map[string]bool{},
+		}
+		data.groups[name] = group
+	}
+	return group
+}
+
+func (data *memoryStreamData) find(id string) *StreamItem {
+	for i := range data.items {
+		if data.items[i].Id == id {
+			return &data.items[i]
+		}
+	}
+	return nil
+}
+
+func (db *memoryDB) add(name string, value map[string]interface{}) string {
+	data := db.stream(name)
+	lastMs, lastSeq := splitId(data.lastId)
+	ms := uint64(time.Now().UnixMilli())
+	if ms > lastMs {
+		data.lastId = strconv.FormatUint(ms, 10) + "-0"
+	} else {
+		data.lastId = strconv.FormatUint(lastMs, 10) + "-" + strconv.FormatUint(lastSeq+1, 10)
+	}
+	// Redis returns all values as strings.
+	values := make(map[string]interface{}, len(value))
+	for k, v := range value {
+		switch v := v.(type) {
+		case string:
+			values[k] = v
+		case []byte:
+			values[k] = string(v)
+		default:
+			values[k] = fmt.Sprint(v)
+		}
+	}
+	data.items = append(data.items, StreamItem{Id: data.lastId, Value: values})
+	close(data.added)
+	data.added = make(chan struct{})
+	return data.lastId
+}
+
+// Stream implementation keeping the data in the process memory.
+type MemoryStream struct {
+	db         *memoryDB
+	name       string
+	groupId    string
+	consumerId string
+	options    StreamOptions
+}
+
+func NewMemoryStream(name string, consumer string, options StreamOptions) *MemoryStream {
+	stream := &MemoryStream{
+		db:         memory,
+		name:       name,
+		groupId:    consumer,
+		consumerId: xid.New().String(),
+		options:    options,
+	}
+	stream.db.mutex.Lock()
+	defer stream.db.mutex.Unlock()
+	data := stream.db.stream(name)
+	if consumer != "" {
+		data.group(consumer).consumers[stream.consumerId] = true
+	}
+	return stream
+}
+
+func (stream *MemoryStream) Add(ctx context.Context, value map[string]interface{}) (string, error) {
+	stream.db.mutex.Lock()
+	defer stream.db.mutex.Unlock()
+	return stream.db.add(stream.name, value), nil
+}
+
+func (stream *MemoryStream) AddAll(ctx context.Context, values []map[string]interface{}) ([]string, error) {
+	stream.db.mutex.Lock()
+	defer stream.db.mutex.Unlock()
+	ids := make([]string, len(values))
+	for i, value := range values {
+		ids[i] = stream.db.add(stream.name, value)
+	}
+	return ids, nil
+}
+
+func (stream *MemoryStream) ReadAfter(ctx context.Context, id string, count int64, block time.Duration) ([]StreamItem, error) {
+	var timeout <-chan time.Time
+	if block > 0 {
+		timer := time.NewTimer(block)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		stream.db.mutex.Lock()
+		data := stream.db.stream(stream.name)
+		if id == "$" {
+			id = data.lastId
+		}
+		items := []StreamItem{}
+		for _, item := range data.items {
+			if CompareIds(item.Id, id) > 0 && (count <= 0 || int64(len(items)) < count) {
+				items = append(items, item)
+			}
+		}
+		added := data.added
+		stream.db.mutex.Unlock()
+
+		if len(items) > 0 || block < 0 {
+			return items, nil
+		}
+		select {
+		case <-added:
+		case <-timeout:
+			return items, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (stream *MemoryStream) Range(ctx context.Context, start string, end string, count int64) ([]StreamItem, error) {
+	stream.db.mutex.Lock()
+	defer stream.db.mutex.Unlock()
+	items := []StreamItem{}
+	for _, item := range stream.db.stream(stream.name).items {
+		if (start == "-" || CompareIds(item.Id, start) >= 0) && (end == "+" || CompareIds(item.Id, end) <= 0) &&
+			(count <= 0 || int64(len(items)) < count) {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+func (stream *MemoryStream) LastId(ctx context.Context) (string, error) {
+	stream.db.mutex.Lock()
+	defer stream.db.mutex.Unlock()
+	data := stream.db.stream(stream.name)
+	if len(data.items) == 0 {
+		return "0-0", nil
+	}
+	return data.items[len(data.items)-1].Id, nil
+}
+
+func (stream *MemoryStream) Get(ctx context.Context) (string, map[string]interface{}, error) {
+	if stream.groupId == "" {
+		return "", nil, errors.New("stream has no consumer group")
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return "", nil, err
+		}
+		stream.db.mutex.Lock()
+		item := stream.next()
+		added := stream.db.stream(stream.name).added
+		stream.db.mutex.Unlock()
+		if item != nil {
+			return item.Id, item.Value, nil
+		}
+		select {
+		case <-added:
+		case <-time.After(pollInterval):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// Return the next item for this consumer, or nil if there is none. Items claimed
+// from idle consumers and failed items have priority over new ones.
+func (stream *MemoryStream) next() *StreamItem {
+	data := stream.db.stream(stream.name)
+	group := data.group(stream.groupId)
+	now := time.Now()
+
+	// Claim the oldest item pending for too long, except those waiting to be retried.
+	claimId := ""
+	for id, p := range group.pending {
+		_, scheduled := group.retries[id]
+		if p.consumer != stream.consumerId && !scheduled && now.Sub(p.delivered) >= stream.options.ClaimIdle &&
+			(claimId == "" || CompareIds(id, claimId) < 0) {
+			claimId = id
+		}
+	}
+	// Retry the failed item with the earliest due time.
+	retryId := ""
+	for id, due := range group.retries {
+		if !due.After(now) && (retryId == "" || due.Before(group.retries[retryId])) {
+			retryId = id
+		}
+	}
+	for _, id := range []string{claimId, retryId} {
+		if id == "" {
+			continue
+		}
+		delete(group.retries, id)
+		item := data.find(id)
+		if item == nil || group.pending[id] == nil {
+			// The item has been deleted from the stream or is no longer pending.
+			delete(group.pending, id)
+			delete(group.attempts, id)
+			continue
+		}
+		if id == claimId {
+			// The consumer may have crashed handling the item, so it counts as an attempt.
+			group.attempts[id]++
+			if group.attempts[id] >= int64(stream.options.MaxAttempts) {
+				stream.moveToDead(data, group, id, errAbandoned)
+				continue
+			}
+		}
+		group.pending[id] = &memoryPending{consumer: stream.consumerId, delivered: now}
+		return item
+	}
+
+	// Deliver a new item.
+	for i := range data.items {
+		item := &data.items[i]
+		if CompareIds(item.Id, group.lastDelivered) > 0 {
+			group.lastDelivered = item.Id
+			group.pending[item.Id] = &memoryPending{consumer: stream.consumerId, delivered: now}
+			return item
+		}
+	}
+	return nil
+}
+
+func (stream *MemoryStream) Ack(ctx context.Context, messageId string) error {
+	stream.db.mutex.Lock()
+	defer stream.db.mutex.Unlock()
+	group := stream.db.stream(stream.name).group(stream.groupId)
+	delete(group.pending, messageId)
+	delete(group.attempts, messageId)
+	delete(group.retries, messageId)
+	return nil
+}
+
+func (stream *MemoryStream) Fail(ctx context.Context, messageId string, cause error) (bool, error) {
+	stream.db.mutex.Lock()
+	defer stream.db.mutex.Unlock()
+	data := stream.db.stream(stream.name)
+	group := data.group(stream.groupId)
+	group.attempts[messageId]++
+	attempts := group.attempts[messageId]
+	if attempts < int64(stream.options.MaxAttempts) {
+		group.retries[messageId] = time.Now().Add(stream.options.retryDelay(attempts))
+		return false, nil
+	}
+	stream.moveToDead(data, group, messageId, cause)
+	return true, nil
+}
+
+// Move the item to the dead-letter stream and remove it from the group.
+func (stream *MemoryStream) moveToDead(data *memoryStreamData, group *memoryGroup, messageId string, cause error) {
+	value := map[string]interface{}{}
+	if item := data.find(messageId); item != nil {
+		for k, v := range item.Value {
+			value[k] = v
+		}
+	}
+	value["error"] = cause.Error()
+	value["stream"] = stream.name
+	value["group"] = stream.groupId
+	value["id"] = messageId
+	value["attempts"] = group.attempts[messageId]
+	stream.db.add(stream.name+DeadStreamSuffix, value)
+	delete(group.pending, messageId)
+	delete(group.attempts, messageId)
+}
+
+func (stream *MemoryStream) Trim(ctx context.Context) (int64, error) {
+	stream.db.mutex.Lock()
+	defer stream.db.mutex.Unlock()
+	trimmed := stream.trim(stream.db.stream(stream.name))
+	// Dead-letter items have no consumer groups and are only kept for inspection.
+	trimmed += stream.trim(stream.db.stream(stream.name + DeadStreamSuffix))
+	return trimmed, nil
+}
+
+func (stream *MemoryStream) trim(data *memoryStreamData) int64 {
+	threshold := stream.options.ageMinId()
+	if excess := int64(len(data.items)) - stream.options.MaxLen; stream.options.MaxLen > 0 && excess > 0 {
+		threshold = maxId(threshold, NextId(data.items[min(excess, trimCount)-1].Id))
+	}
+	if threshold == "" {
+		return 0
+	}
+	floor := ""
+	for _, group := range data.groups {
+		for id := range group.pending {
+			floor = minId(floor, id)
+		}
+		// Like in Redis, groups without consumers are not waiting for new items.
+		if len(group.consumers) > 0 {
+			floor = minId(floor, NextId(group.lastDelivered))
+		}
+	}
+	if floor != "" && CompareIds(floor, threshold) < 0 {
+		threshold = floor
+	}
+	trimmed := 0
+	for trimmed < len(data.items) && CompareIds(data.items[trimmed].Id, threshold) < 0 {
+		trimmed++
+	}
+	data.items = data.items[trimmed:]
+	return int64(trimmed)
+}
@@ -0,0 +1,206 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryStreamGroups(t *testing.T) {
+	ResetMemory()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	options := StreamOptions{MaxAttempts: 2, ClaimIdle: time.Hour}
+	consumer1 := NewMemoryStream("test", "group", options)
+	consumer2 := NewMemoryStream("test", "group", options)
+	other := NewMemoryStream("test", "other", options)
+
+	id1, _ := consumer1.Add(ctx, map[string]interface{}{"n": 1, "data": []byte("one")})
+	id2, _ := consumer1.Add(ctx, map[string]interface{}{"n": 2})
+	if CompareIds(id2, id1) <= 0 {
+		t.Fatalf("Ids not increasing: %s %s", id1, id2)
+	}
+
+	// Each item is delivered to a single consumer of each group.
+	id, value, err := consumer1.Get(ctx)
+	if err != nil || id != id1 || value["n"] != "1" || value["data"] != "one" {
+		t.Fatalf("Unexpected item %s %v %v", id, value, err)
+	}
+	id, _, _ = consumer2.Get(ctx)
+	if id != id2 {
+		t.Fatalf("Expected %s, got %s", id2, id)
+	}
+	id, _, _ = other.Get(ctx)
+	if id != id1 {
+		t.Fatalf("Expected %s in other group, got %s", id1, id)
+	}
+
+	consumer1.Ack(ctx, id1)
+	group := memory.streams["test"].groups["group"]
+	if len(group.pending) != 1 || group.pending[id2] == nil {
+		t.Errorf("Unexpected pending list %v", group.pending)
+	}
+
+	// Blocked Get returns when a new item is added.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		consumer2.Add(ctx, map[string]interface{}{"n": 3})
+	}()
+	_, value, _ = consumer1.Get(ctx)
+	if value["n"] != "3" {
+		t.Errorf("Expected item 3, got %v", value)
+	}
+}
+
+func TestMemoryStreamFail(t *testing.T) {
+	ResetMemory()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream := NewMemoryStream("test", "group", StreamOptions{MaxAttempts: 2, RetryDelay: time.Millisecond, MaxRetryDelay: time.Millisecond})
+	stream.Add(ctx, map[string]interface{}{"n": 1})
+
+	id, _, _ := stream.Get(ctx)
+	dead, _ := stream.Fail(ctx, id, errors.New("first"))
+	if dead {
+		t.Fatal("Item moved to dead stream after first attempt")
+	}
+	// The failed item is retried.
+	retried, _, _ := stream.Get(ctx)
+	if retried != id {
+		t.Fatalf("Expected retry of %s, got %s", id, retried)
+	}
+	dead, _ = stream.Fail(ctx, id, errors.New("second"))
+	if !dead {
+		t.Fatal("Item not moved to dead stream")
+	}
+	items, _ := NewMemoryStream("test"+DeadStreamSuffix, "", StreamOptions{}).ReadAfter(ctx, "0-0", 10, -1)
+	if len(items) != 1 || items[0].Value["n"] != "1" || items[0].Value["error"] != "second" || items[0].Value["attempts"] != "2" {
+		t.Errorf("Unexpected dead stream %v", items)
+	}
+	if len(memory.streams["test"].groups["group"].pending) != 0 {
+		t.Error("Dead item still pending")
+	}
+}
+
+func TestMemoryStreamClaim(t *testing.T) {
+	ResetMemory()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	options := StreamOptions{MaxAttempts: 2, ClaimIdle: 10 * time.Millisecond}
+	crashed := NewMemoryStream("test", "group", options)
+	crashed.Add(ctx, map[string]interface{}{"n": 1})
+	id, _, _ := crashed.Get(ctx)
+
+	time.Sleep(20 * time.Millisecond)
+	claimed, _, _ := NewMemoryStream("test", "group", options).Get(ctx)
+	if claimed != id {
+		t.Errorf("Expected claimed item %s, got %s", id, claimed)
+	}
+
+	// Claims count as attempts, so an item that keeps crashing the consumers is
+	// eventually moved to the dead-letter stream.
+	time.Sleep(20 * time.Millisecond)
+	other := NewMemoryStream("test", "group", options)
+	other.Add(ctx, map[string]interface{}{"n": 2})
+	next, _, _ := other.Get(ctx)
+	if next == id {
+		t.Errorf("Expected item %s moved to the dead stream", id)
+	}
+	items, _ := NewMemoryStream("test"+DeadStreamSuffix, "", StreamOptions{}).ReadAfter(ctx, "0-0", 10, -1)
+	if len(items) != 1 || items[0].Value["id"] != id || items[0].Value["attempts"] != "2" {
+		t.Errorf("Unexpected dead stream %v", items)
+	}
+}
+
+func TestMemoryStreamReadAfter(t *testing.T) {
+	ResetMemory()
+	ctx := context.Background()
+	stream := NewMemoryStream("test", "", StreamOptions{})
+	for i := 0; i < 3; i++ {
+		stream.Add(ctx, map[string]interface{}{"n": i})
+	}
+	all, _ := stream.ReadAfter(ctx, "0-0", 0, -1)
+	first := all[0]
+	items, _ := stream.ReadAfter(ctx, first.Id, 10, -1)
+	if len(items) != 2 || items[0].Value["n"] != "1" {
+		t.Fatalf("Unexpected items %v", items)
+	}
+	last, _ := stream.LastId(ctx)
+	if last != items[1].Id {
+		t.Errorf("Expected last id %s, got %s", items[1].Id, last)
+	}
+	items, _ = stream.ReadAfter(ctx, "$", 10, 10*time.Millisecond)
+	if len(items) != 0 {
+		t.Errorf("Expected no new items, got %v", items)
+	}
+}
+
+func TestMemoryStreamTrim(t *testing.T) {
+	ResetMemory()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	options := StreamOptions{MaxLen: 2, ClaimIdle: time.Hour}
+	producer := NewMemoryStream("test", "", options)
+	consumer := NewMemoryStream("test", "group", options)
+	for i := 0; i < 5; i++ {
+		producer.Add(ctx, map[string]interface{}{"n": i})
+	}
+
+	// Items not yet delivered to the group are kept.
+	if trimmed, _ := producer.Trim(ctx); trimmed != 0 {
+		t.Errorf("Expected no trimmed items, got %d", trimmed)
+	}
+	// Item 0 is acknowledged and item 1 is pending.
+	id, _, _ := consumer.Get(ctx)
+	consumer.Ack(ctx, id)
+	consumer.Get(ctx)
+	for i := 2; i < 5; i++ {
+		id, _, _ = consumer.Get(ctx)
+		consumer.Ack(ctx, id)
+	}
+	if trimmed, _ := producer.Trim(ctx); trimmed != 1 {
+		t.Errorf("Expected 1 trimmed item, got %d", trimmed)
+	}
+	items, _ := producer.ReadAfter(ctx, "0-0", 0, -1)
+	if len(items) != 4 || items[0].Value["n"] != "1" {
+		t.Errorf("Unexpected items after trimming %v", items)
+	}
+
+	// Groups without consumers, like those no longer used, don't keep items.
+	ResetMemory()
+	memory.stream("test").group("unused")
+	producer = NewMemoryStream("test", "", options)
+	for i := 0; i < 3; i++ {
+		producer.Add(ctx, map[string]interface{}{"n": i})
+	}
+	if trimmed, _ := producer.Trim(ctx); trimmed != 1 {
+		t.Errorf("Expected 1 trimmed item, got %d", trimmed)
+	}
+
+	// Dead-letter items are trimmed with the same policy.
+	ResetMemory()
+	consumer = NewMemoryStream("test", "group", StreamOptions{MaxLen: 2, MaxAttempts: 1})
+	for i := 0; i < 3; i++ {
+		consumer.Add(ctx, map[string]interface{}{"n": i})
+		id, _, _ := consumer.Get(ctx)
+		consumer.Fail(ctx, id, errors.New("failed"))
+	}
+	if trimmed, _ := consumer.Trim(ctx); trimmed != 2 {
+		t.Errorf("Expected 2 trimmed items, got %d", trimmed)
+	}
+	dead, _ := NewMemoryStream("test"+DeadStreamSuffix, "", options).ReadAfter(ctx, "0-0", 0, -1)
+	if len(dead) != 2 || dead[0].Value["n"] != "1" {
+		t.Errorf("Unexpected dead items after trimming %v", dead)
+	}
+
+	// Age policy.
+	ResetMemory()
+	stream := NewMemoryStream("test", "", StreamOptions{MaxAge: 10 * time.Millisecond})
+	stream.Add(ctx, map[string]interface{}{"n": 0})
+	time.Sleep(20 * time.Millisecond)
+	stream.Add(ctx, map[string]interface{}{"n": 1})
+	if trimmed, _ := stream.Trim(ctx); trimmed != 1 {
+		t.Errorf("Expected 1 trimmed item, got %d", trimmed)
+	}
+}
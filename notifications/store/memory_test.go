@@ -0,0 +1,73 @@
+package store
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testObject struct {
+	Id    string `json:"id"`
+	Owner string `json:"owner"`
+}
+
+var testObjectType = reflect.TypeOf((*testObject)(nil))
+
+func TestMemoryStoreIndexes(t *testing.T) {
+	ResetMemory()
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	store.Set(ctx, "things", "1", &testObject{Id: "1", Owner: "a"}, map[string]string{"owner": "a"}, 0)
+	store.Set(ctx, "things", "2", &testObject{Id: "2", Owner: "a"}, map[string]string{"owner": "a"}, 0)
+	// Changing the indexed value moves the object to the new index.
+	store.Set(ctx, "things", "2", &testObject{Id: "2", Owner: "b"}, map[string]string{"owner": "b"}, 0)
+
+	values, _ := store.GetByIndex(ctx, "things", testObjectType, "owner", "a")
+	if len(values) != 1 || values[0].(*testObject).Id != "1" {
+		t.Errorf("Unexpected index a %v", values)
+	}
+	values, _ = store.GetByIndex(ctx, "things", testObjectType, "owner", "b")
+	if len(values) != 1 || values[0].(*testObject).Id != "2" {
+		t.Errorf("Unexpected index b %v", values)
+	}
+
+	store.Delete(ctx, "things", "1")
+	if err := store.Get(ctx, "things", "1", new(testObject)); err != ErrNotFound {
+		t.Errorf("Expected not found error, got %v", err)
+	}
+	if len(store.db.indexes[indexKey("things", "owner", "a")]) != 0 {
+		t.Error("Deleted object left in index")
+	}
+}
+
+func TestMemoryStoreExpiration(t *testing.T) {
+	ResetMemory()
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	store.Set(ctx, "things", "1", &testObject{Id: "1"}, map[string]string{"owner": "a"}, time.Millisecond)
+	store.Set(ctx, "things", "2", &testObject{Id: "2"}, map[string]string{"owner": "a"}, time.Hour)
+	time.Sleep(5 * time.Millisecond)
+
+	obj := new(testObject)
+	if err := store.Get(ctx, "things", "1", obj); err != ErrNotFound {
+		t.Errorf("Expected expired object, got %v", obj)
+	}
+	if err := store.Get(ctx, "things", "2", obj); err != nil || obj.Id != "2" {
+		t.Errorf("Expected object 2, got %v %v", obj, err)
+	}
+	values, _ := store.GetByIndex(ctx, "things", testObjectType, "owner", "a")
+	if len(values) != 1 {
+		t.Errorf("Expected 1 value, got %d", len(values))
+	}
+	// Expired objects are left in the index until repaired.
+	pruned, _ := store.RepairIndexes(ctx)
+	if pruned != 1 {
+		t.Errorf("Expected 1 pruned index member, got %d", pruned)
+	}
+	if ids := store.db.indexes[indexKey("things", "owner", "a")]; len(ids) != 1 || !ids["2"] {
+		t.Errorf("Unexpected index after repair %v", ids)
+	}
+}
@@ -0,0 +1,134 @@
+package store
+
+// Shared Redis client used by all the Redis stores and streams of the process.
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/komunitin/komunitin/notifications/config"
+)
+
+var (
+	sharedClient    redis.UniversalClient
+	sharedClientErr error
+	sharedClientMu  sync.Mutex
+	// Whether the client is connected to a Redis Cluster.
+	clusterMode bool
+)
+
+// Return the Redis client, creating it from the configuration on the first call.
+func redisClient() (redis.UniversalClient, error) {
+	sharedClientMu.Lock()
+	defer sharedClientMu.Unlock()
+	if sharedClient == nil && sharedClientErr == nil {
+		sharedClient, sharedClientErr = newRedisClient()
+	}
+	return sharedClient, sharedClientErr
+}
+
+func newRedisClient() (redis.UniversalClient, error) {
+	url, err := redis.ParseURL(config.RedisUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %v", err)
+	}
+	options := &redis.UniversalOptions{
+		Addrs:            []string{url.Addr},
+		DB:               url.DB,
+		Username:         url.Username,
+		Password:         url.Password,
+		SentinelPassword: config.RedisSentinelPassword,
+		TLSConfig:        url.TLSConfig,
+		PoolSize:         config.RedisPoolSize,
+		MinIdleConns:     config.RedisMinIdleConns,
+		DialTimeout:      config.RedisDialTimeout,
+		ReadTimeout:      config.RedisReadTimeout,
+		WriteTimeout:     config.RedisWriteTimeout,
+	}
+	if config.RedisUsername != "" {
+		options.Username = config.RedisUsername
+	}
+	if config.RedisPassword != "" {
+		options.Password = config.RedisPassword
+	}
+	if config.RedisTlsCaFile != "" {
+		pem, err := os.ReadFile(config.RedisTlsCaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.RedisTlsCaFile)
+		}
+		if options.TLSConfig == nil {
+			options.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		options.TLSConfig.RootCAs = pool
+	}
+
+	switch {
+	case config.RedisSentinelMaster != "":
+		options.Addrs = splitAddrs(config.RedisSentinelAddrs)
+		options.MasterName = config.RedisSentinelMaster
+		return redis.NewFailoverClient(options.Failover()), nil
+	case config.RedisClusterAddrs != "":
+		options.Addrs = splitAddrs(config.RedisClusterAddrs)
+		// The TLS server name is set for each node by the cluster client.
+		if options.TLSConfig != nil {
+			options.TLSConfig.ServerName = ""
+		}
+		clusterMode = true
+		return redis.NewClusterClient(options.Cluster()), nil
+	default:
+		return redis.NewClient(options.Simple()), nil
+	}
+}
+
+func splitAddrs(addrs string) []string {
+	list := []string{}
+	for _, addr := range strings.Split(addrs, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			list = append(list, addr)
+		}
+	}
+	return list
+}
+
+// Return the given key part as a hash tag in cluster mode, so all the keys that
+// contain it are in the same slot and can be used in the same transaction.
+func hashTag(s string) string {
+	if clusterMode {
+		return "{" + s + "}"
+	}
+	return s
+}
+
+// Call fn for each key matching the pattern in all the master nodes. Calls to fn
+// are serialized.
+func scanKeys(ctx context.Context, client redis.UniversalClient, match string, fn func(key string) error) error {
+	var mutex sync.Mutex
+	scan := func(ctx context.Context, client redis.Cmdable) error {
+		iter := client.Scan(ctx, 0, match, 100).Iterator()
+		for iter.Next(ctx) {
+			mutex.Lock()
+			err := fn(iter.Val())
+			mutex.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+		return iter.Err()
+	}
+	if cluster, ok := client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			return scan(ctx, node)
+		})
+	}
+	return scan(ctx, client)
+}
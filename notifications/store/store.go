@@ -1,77 +1,235 @@
 package store
 
 // Implements a key-value store with indexing.
-// This is an interface for the REDIS database.
+// The default implementation uses the REDIS database.
 
 import (
 	"context"
 	"encoding/json"
 	"reflect"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/komunitin/komunitin/notifications/config"
 )
 
-type Store struct {
-	client redis.Client
+// Storage backends
+const (
+	RedisBackend  = "redis"
+	MemoryBackend = "memory"
+)
+
+// Returned by Get if the object doesn't exist.
+var ErrNotFound = redis.Nil
+
+// Key-value store of JSON encoded objects grouped in classes, with secondary indexes.
+type Store interface {
+	// Save the object and add it to the given indexes, removing it from the indexes it
+	// was previously in but no longer is. Indexes expire along with the object.
+	Set(ctx context.Context, class string, id string, value interface{}, indexes map[string]string, expire time.Duration) error
+	// Save the object only if there is no object with the same id, without indexes.
+	// Returns whether the object has been saved.
+	SetIfAbsent(ctx context.Context, class string, id string, value interface{}, expire time.Duration) (bool, error)
+	// Get the given object from the store.
+	Get(ctx context.Context, class string, id string, v interface{}) error
+	// Delete the given object and remove it from its indexes.
+	Delete(ctx context.Context, class string, id string) error
+	// Return the values of given store class that match the given index. Values are unmarshaled using the provided struct pointer type
+	// with json annotations.
+	// t = reflect.TypeOf((*Model)(nil))
+	GetByIndex(ctx context.Context, class string, t reflect.Type, index string, id string) ([]interface{}, error)
+	// Remove the index members that point to objects that no longer exist. Returns the
+	// number of pruned members.
+	RepairIndexes(ctx context.Context) (int, error)
+}
+
+// Create a new store using the configured backend.
+func NewStore() (Store, error) {
+	if config.StoreBackend == MemoryBackend {
+		return NewMemoryStore(), nil
+	}
+	return NewRedisStore()
+}
+
+// Store implementation using Redis.
+type RedisStore struct {
+	client redis.UniversalClient
 }
 
-// Create a new store.
-func NewStore() (*Store, error) {
-	store := &Store{
-		// Store and Stream are using the same Redis instance. That's fine but incidental.
-		// They could perfectly use different instances if needed for scalability.
-		client: *redis.NewClient(&redis.Options{
-			Addr:     "redis:6379",
-			Password: "", // no password set
-			DB:       0,  // use default database
-		}),
+func NewRedisStore() (*RedisStore, error) {
+	// Store and Stream are using the same Redis client. That's fine but incidental.
+	// They could perfectly use different instances if needed for scalability.
+	client, err := redisClient()
+	if err != nil {
+		return nil, err
 	}
-	return store, nil
+	return &RedisStore{client: client}, nil
 }
-func (store *Store) Set(ctx context.Context, class string, id string, value interface{}, indexes map[string]string, expire time.Duration) error {
+
+// Maximum number of attempts of optimistic transactions when the watched keys are
+// concurrently modified.
+const maxTxAttempts = 10
+
+// Save the object and add it to the given indexes, removing it from the indexes it
+// was previously in but no longer is. Indexes expire along with the object, and index
+// sets expire when their last expiring object does, so indexes of objects that are
+// never deleted don't grow forever. Objects without expiration make the index sets
+// permanent, so a class shouldn't mix both kinds of objects in the same index.
+func (store *RedisStore) Set(ctx context.Context, class string, id string, value interface{}, indexes map[string]string, expire time.Duration) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	tracked := objectIndexesKey(class, id)
 	// Set value and indexes in a single transaction.
-	_, err := store.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-		// Set value
-		encoded, err := json.Marshal(value)
+	return store.transaction(ctx, func(tx *redis.Tx) error {
+		previous, err := tx.HGetAll(ctx, tracked).Result()
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			// Set value
+			pipe.Set(ctx, key(class, id), string(encoded), expire)
+			// Remove stale indexes
+			for index, indexId := range previous {
+				if indexes[index] != indexId {
+					pipe.SRem(ctx, indexKey(class, index, indexId), id)
+				}
+			}
+			pipe.Del(ctx, tracked)
+			// Add indexes
+			for index, indexId := range indexes {
+				k := indexKey(class, index, indexId)
+				pipe.SAdd(ctx, k, id)
+				pipe.HSet(ctx, tracked, index, indexId)
+				if expire > 0 {
+					// Set the expiration of new sets and only extend existing ones.
+					pipe.ExpireNX(ctx, k, expire)
+					pipe.ExpireGT(ctx, k, expire)
+				} else {
+					pipe.Persist(ctx, k)
+				}
+			}
+			if len(indexes) > 0 && expire > 0 {
+				pipe.Expire(ctx, tracked, expire)
+			}
+			return nil
+		})
+		return err
+	}, tracked)
+}
+
+func (store *RedisStore) SetIfAbsent(ctx context.Context, class string, id string, value interface{}, expire time.Duration) (bool, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return false, err
+	}
+	return store.client.SetNX(ctx, key(class, id), string(encoded), expire).Result()
+}
+
+// Get the given object from the store.
+func (store *RedisStore) Get(ctx context.Context, class string, id string, v interface{}) error {
+	encoded, err := store.client.Get(ctx, key(class, id)).Result()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(encoded), v)
+}
+
+// Delete the given object and remove it from its indexes.
+func (store *RedisStore) Delete(ctx context.Context, class string, id string) error {
+	tracked := objectIndexesKey(class, id)
+	return store.transaction(ctx, func(tx *redis.Tx) error {
+		indexes, err := tx.HGetAll(ctx, tracked).Result()
 		if err != nil {
 			return err
 		}
-		err = pipe.Set(ctx, key(class, id), string(encoded), expire).Err()
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key(class, id), tracked)
+			for index, indexId := range indexes {
+				pipe.SRem(ctx, indexKey(class, index, indexId), id)
+			}
+			return nil
+		})
+		return err
+	}, tracked)
+}
+
+// Remove the index members that point to objects that no longer exist, for
+// example because they expired, or that are no longer indexed by that value.
+// Returns the number of pruned members.
+func (store *RedisStore) RepairIndexes(ctx context.Context) (int, error) {
+	pruned := 0
+	err := scanKeys(ctx, store.client, "index:*", func(k string) error {
+		parts := strings.SplitN(k, ":", 4)
+		if len(parts) != 4 {
+			return nil
+		}
+		class, index, indexId := strings.Trim(parts[1], "{}"), parts[2], parts[3]
+		ids, err := store.client.SMembers(ctx, k).Result()
 		if err != nil {
 			return err
 		}
-		// Add indexes
-		for index, indexId := range indexes {
-			err = pipe.SAdd(ctx, indexKey(class, index, indexId), id).Err()
+		for _, id := range ids {
+			removed, err := store.pruneIndexMember(ctx, class, index, indexId, id)
 			if err != nil {
 				return err
 			}
+			if removed {
+				pruned++
+			}
 		}
-
 		return nil
 	})
-	return err
+	return pruned, err
 }
 
-// Get the given object from the store.
-func (store *Store) Get(ctx context.Context, class string, id string, v interface{}) error {
-	encoded, err := store.client.Get(ctx, key(class, id)).Result()
-	if err != nil {
+// Remove the object from the index if it is orphaned. Returns whether it was removed.
+func (store *RedisStore) pruneIndexMember(ctx context.Context, class string, index string, indexId string, id string) (bool, error) {
+	removed := false
+	tracked := objectIndexesKey(class, id)
+	err := store.transaction(ctx, func(tx *redis.Tx) error {
+		removed = false
+		exists, err := tx.Exists(ctx, key(class, id)).Result()
+		if err != nil {
+			return err
+		}
+		indexes, err := tx.HGetAll(ctx, tracked).Result()
+		if err != nil {
+			return err
+		}
+		// Objects saved before indexes were tracked can't be checked further.
+		if exists > 0 && (len(indexes) == 0 || indexes[index] == indexId) {
+			return nil
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.SRem(ctx, indexKey(class, index, indexId), id)
+			return nil
+		})
+		removed = err == nil
 		return err
-	}
-	return json.Unmarshal([]byte(encoded), v)
+	}, key(class, id), tracked)
+	return removed, err
 }
 
-// Delete the given object from the store.
-func (store *Store) Delete(ctx context.Context, class string, id string) error {
-	return store.client.Del(ctx, key(class, id)).Err()
+// Run the function in a transaction watching the given keys, retrying it if
+// they are modified by another client meanwhile.
+func (store *RedisStore) transaction(ctx context.Context, fn func(tx *redis.Tx) error, keys ...string) error {
+	var err error
+	for attempt := 0; attempt < maxTxAttempts; attempt++ {
+		err = store.client.Watch(ctx, fn, keys...)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return err
 }
 
 // Return the values of given store class that match the given index. Values are unmarshaled using the provided struct pointer type
 // with json annotations.
 // t = reflect.TypeOf((*Model)(nil))
-func (store *Store) GetByIndex(ctx context.Context, class string, t reflect.Type, index string, id string) ([]interface{}, error) {
+func (store *RedisStore) GetByIndex(ctx context.Context, class string, t reflect.Type, index string, id string) ([]interface{}, error) {
 	// Get data keys using the index.
 	ids, err := store.client.SMembers(ctx, indexKey(class, index, id)).Result()
 	if err != nil {
@@ -110,8 +268,13 @@ func (store *Store) GetByIndex(ctx context.Context, class string, t reflect.Type
 }
 
 func key(class string, id string) string {
-	return "object" + ":" + class + ":" + id
+	return "object" + ":" + hashTag(class) + ":" + id
 }
 func indexKey(class string, index string, id string) string {
-	return "index" + ":" + class + ":" + index + ":" + id
+	return "index" + ":" + hashTag(class) + ":" + index + ":" + id
+}
+
+// Key of the hash with the indexes the object belongs to.
+func objectIndexesKey(class string, id string) string {
+	return "indexes" + ":" + hashTag(class) + ":" + id
 }
@@ -1,79 +1,709 @@
 package store
 
 // Implements a queue or stream of objects using the readis STREAM data type.
+//
+// Items that fail to be processed are retried with exponential backoff and, after
+// too many attempts, moved to a dead-letter stream named after the original stream
+// with the "-dead" suffix.
+//
+// Each process uses a new random consumer id, so items read but not acknowledged by
+// a consumer that crashed would stay in its pending list forever. To avoid that, the
+// stream periodically claims items that have been pending for too long. Claimed items
+// count as failed attempts, so items that crash the consumers also end up in the
+// dead-letter stream.
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/komunitin/komunitin/notifications/config"
 	"github.com/rs/xid"
 )
 
-type Stream struct {
-	client     *redis.Client
-	name       string
+// Retry policy for stream items that fail to be processed.
+type StreamOptions struct {
+	// Number of times an item is processed before moving it to the dead-letter stream.
+	MaxAttempts int
+	// Delay before the first retry. It doubles at each attempt up to MaxRetryDelay.
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	// Items pending for longer than ClaimIdle are claimed by this consumer. It must be
+	// well above the time needed to process an item.
+	ClaimIdle time.Duration
+	// Interval between scans of the pending items list.
+	ClaimInterval time.Duration
+	// Retention policy applied by Trim: maximum number of items and maximum age of the
+	// items kept in the stream. Zero means no limit.
+	MaxLen int64
+	MaxAge time.Duration
+}
+
+// Item of a stream.
+type StreamItem struct {
+	Id    string
+	Value map[string]interface{}
+}
+
+// Stream of items read by groups of consumers. Each item is delivered to a single
+// consumer of each group and it stays in the group pending list until acknowledged.
+type Stream interface {
+	// Add an item to the stream and return its id.
+	Add(ctx context.Context, value map[string]interface{}) (string, error)
+	// Add several items to the stream in a single round trip and return their ids. If
+	// some items can't be added, their ids are empty and the first error is returned.
+	AddAll(ctx context.Context, values []map[string]interface{}) ([]string, error)
+	// Return the items with id greater than the given one, up to count items. The special
+	// id "$" stands for the last item in the stream. If there are no such items, it
+	// waits up to block for new items (forever if zero, not at all if negative) and
+	// returns an empty list if none arrives.
+	// This function doesn't use the consumer group, so all readers get all items.
+	ReadAfter(ctx context.Context, id string, count int64, block time.Duration) ([]StreamItem, error)
+	// Return up to count items with ids between start and end, both included. The
+	// special ids "-" and "+" stand for the first and last items in the stream.
+	Range(ctx context.Context, start string, end string, count int64) ([]StreamItem, error)
+	// Return the id of the last item in the stream, or "0-0" if the stream is empty.
+	LastId(ctx context.Context) (string, error)
+	// Get the next item for this consumer. This function blocks until there's new data in
+	// the stream or a previously failed item is due to be retried.
+	// Returns (message id, value map, error).
+	Get(ctx context.Context) (string, map[string]interface{}, error)
+	// Acknowledge that a stream item has been processed.
+	Ack(ctx context.Context, messageId string) error
+	// Report that the processing of a stream item failed with the given cause. The item
+	// is scheduled to be delivered again after a backoff delay, unless it has already
+	// been attempted MaxAttempts times. In this case it is moved to the dead-letter
+	// stream together with the error and this function returns true.
+	Fail(ctx context.Context, messageId string, cause error) (bool, error)
+	// Remove the items exceeding the MaxLen and MaxAge options, except those that are
+	// pending or not yet delivered in any consumer group. Groups without consumers are
+	// considered unused and only keep their pending items. The same policy is applied
+	// to the dead-letter stream. Returns the number of removed items.
+	Trim(ctx context.Context) (int64, error)
+}
+
+// Create a new stream using the configured backend. Note that the name of the stream is
+// what actually identifies the stream, so if you create two streams with the same name,
+// they will be the same stream.
+// The consumer is the name of the consumer group used by Get. It can be empty if
+// the stream is only read with ReadAfter.
+func NewStream(ctx context.Context, name string, consumer string, options StreamOptions) (Stream, error) {
+	if config.StoreBackend == MemoryBackend {
+		return NewMemoryStream(name, consumer, options), nil
+	}
+	return NewRedisStream(ctx, name, consumer, options)
+}
+
+// Stream implementation using the Redis STREAM data type.
+type RedisStream struct {
+	client redis.UniversalClient
+	name   string
+	// Redis key of the stream.
+	key        string
 	groupId    string
 	consumerId string
+	options    StreamOptions
+	// Items claimed from other consumers waiting to be returned by Get.
+	claimed []redis.XMessage
+	// Last time the pending items list was scanned.
+	lastClaim time.Time
 }
 
-// Create a new stream. Note that the name of the stream is what actually identifies the stream,
-// so if you create two streams with the same name, they will be the same stream.
-func NewStream(ctx context.Context, name string, consumer string) (*Stream, error) {
-	// Create Stream data and Redis client.
-	stream := &Stream{
-		name: name,
-		client: redis.NewClient(&redis.Options{
-			Addr:     "redis:6379",
-			Password: "", // no password set
-			DB:       0,  // use default database
-		}),
+const (
+	// Suffix added to the stream name to build the dead-letter stream name.
+	DeadStreamSuffix = "-dead"
+	// Maximum time that Get blocks waiting for new items before checking for retries.
+	pollInterval = time.Second
+	// Maximum number of pending items claimed in a single scan.
+	claimCount = 100
+	// Maximum number of items removed by MaxLen in a single Trim call.
+	trimCount = 10000
+)
+
+// Error saved in the dead-letter stream for items whose last attempt was claimed
+// from an idle consumer.
+var errAbandoned = errors.New("consumer stopped handling the item")
+
+// Periodically trim the stream until the context is done.
+func RunTrimmer(ctx context.Context, stream Stream, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := stream.Trim(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Error trimming stream: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func NewRedisStream(ctx context.Context, name string, consumer string, options StreamOptions) (*RedisStream, error) {
+	client, err := redisClient()
+	if err != nil {
+		return nil, err
+	}
+	stream := &RedisStream{
+		name:       name,
+		key:        hashTag(name),
+		client:     client,
 		consumerId: xid.New().String(),
 		groupId:    consumer,
+		options:    options,
+	}
+	if consumer == "" {
+		return stream, nil
 	}
 	// Create read group if not exists.
-	err := stream.client.XGroupCreateMkStream(ctx, stream.name, stream.groupId, "$").Err()
+	err = stream.client.XGroupCreateMkStream(ctx, stream.key, stream.groupId, "$").Err()
 	if err != nil && strings.Contains(err.Error(), "BUSYGROUP") {
 		// Ignore "Consumer Group name already exists" error.
 		err = nil
 	}
+	if err != nil {
+		return nil, err
+	}
+	// Register the consumer right away so Trim doesn't take the group as unused
+	// before the first read.
+	err = stream.client.XGroupCreateConsumer(ctx, stream.key, stream.groupId, stream.consumerId).Err()
 	return stream, err
 }
 
 // Add an item to the stream.
-func (stream *Stream) Add(ctx context.Context, value map[string]interface{}) (string, error) {
+func (stream *RedisStream) Add(ctx context.Context, value map[string]interface{}) (string, error) {
 	return stream.client.XAdd(ctx, &redis.XAddArgs{
-		Stream: stream.name,
+		Stream: stream.key,
 		Values: value,
 	}).Result()
 }
 
-// Get the next item of a stream. This function blocks until there's new data in the stream.
+func (stream *RedisStream) AddAll(ctx context.Context, values []map[string]interface{}) ([]string, error) {
+	pipe := stream.client.Pipeline()
+	cmds := make([]*redis.StringCmd, len(values))
+	for i, value := range values {
+		cmds[i] = pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: stream.key,
+			Values: value,
+		})
+	}
+	// The error of each command is checked below.
+	_, _ = pipe.Exec(ctx)
+	ids := make([]string, len(values))
+	var err error
+	for i, cmd := range cmds {
+		id, cmdErr := cmd.Result()
+		if cmdErr != nil && err == nil {
+			err = cmdErr
+		}
+		ids[i] = id
+	}
+	return ids, err
+}
+
+// Return the items with id greater than the given one, up to count items. The special
+// id "$" stands for the last item in the stream. If there are no such items, it
+// waits up to block for new items (forever if zero, not at all if negative) and
+// returns an empty list if none arrives.
+// This function doesn't use the consumer group, so all readers get all items.
+func (stream *RedisStream) ReadAfter(ctx context.Context, id string, count int64, block time.Duration) ([]StreamItem, error) {
+	entries, err := stream.client.XRead(ctx, &redis.XReadArgs{
+		Streams: []string{stream.key, id},
+		Count:   count,
+		Block:   block,
+	}).Result()
+	if err == redis.Nil {
+		return []StreamItem{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	items := []StreamItem{}
+	for _, entry := range entries {
+		for _, message := range entry.Messages {
+			items = append(items, StreamItem{Id: message.ID, Value: message.Values})
+		}
+	}
+	return items, nil
+}
+
+// Get the next item of a stream. This function blocks until there's new data in the stream
+// or a previously failed item is due to be retried.
 // Returns (message id, value map, error).
-func (stream *Stream) Get(ctx context.Context) (string, map[string]interface{}, error) {
-	entries, err := stream.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+func (stream *RedisStream) Get(ctx context.Context) (string, map[string]interface{}, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return "", nil, err
+		}
+		// Items claimed from crashed consumers and failed items have priority over new ones.
+		if id, value, err := stream.getClaimed(ctx); err != nil || id != "" {
+			return id, value, err
+		}
+		id, value, err := stream.getRetry(ctx)
+		if err != nil {
+			return "", nil, err
+		}
+		if id != "" {
+			return id, value, nil
+		}
+
+		entries, err := stream.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    stream.groupId,
+			Consumer: stream.consumerId,
+			Streams:  []string{stream.key, ">"},
+			Count:    1,
+			Block:    pollInterval,
+			NoAck:    false,
+		}).Result()
+		if err == redis.Nil {
+			// Timeout without new items.
+			continue
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if len(entries) != 1 {
+			return "", nil, fmt.Errorf("expected 1 entry in stream read operation, got %d", len(entries))
+		}
+		if len(entries[0].Messages) != 1 {
+			return "", nil, fmt.Errorf("expected 1 message in stream read operation, got %d", len(entries[0].Messages))
+		}
+		message := entries[0].Messages[0]
+		return message.ID, message.Values, nil
+	}
+}
+
+// Get the next failed item whose retry time has come, if any. It returns an empty
+// id if there are no items to retry.
+func (stream *RedisStream) getRetry(ctx context.Context) (string, map[string]interface{}, error) {
+	ids, err := stream.client.ZRangeByScore(ctx, stream.retryKey(), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(time.Now().UnixMilli(), 10),
+		Count: 1,
+	}).Result()
+	if err != nil || len(ids) == 0 {
+		return "", nil, err
+	}
+	id := ids[0]
+	// Removing the item from the retry set guarantees that only one consumer gets it.
+	removed, err := stream.client.ZRem(ctx, stream.retryKey(), id).Result()
+	if err != nil || removed == 0 {
+		return "", nil, err
+	}
+	// The pending item may belong to another consumer of the group, so claim it.
+	messages, err := stream.client.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   stream.key,
 		Group:    stream.groupId,
 		Consumer: stream.consumerId,
-		Streams:  []string{stream.name, ">"},
-		Count:    1,
-		Block:    0, // Block until new
-		NoAck:    false,
+		MinIdle:  0,
+		Messages: []string{id},
 	}).Result()
 	if err != nil {
 		return "", nil, err
 	}
-	if len(entries) != 1 {
-		return "", nil, fmt.Errorf("expected 1 entry in stream read operation, got %d", len(entries))
+	if len(messages) == 0 {
+		// The item is no longer pending or has been deleted from the stream.
+		return "", nil, stream.client.HDel(ctx, stream.attemptsKey(), id).Err()
 	}
-	if len(entries[0].Messages) != 1 {
-		return "", nil, fmt.Errorf("expected 1 message in stream read operation, got %d", len(entries[0].Messages))
+	return messages[0].ID, messages[0].Values, nil
+}
+
+// Get the next item claimed from other consumers, scanning the pending items list
+// if ClaimInterval has elapsed since the last scan. Returns an empty id if there
+// are no such items.
+func (stream *RedisStream) getClaimed(ctx context.Context) (string, map[string]interface{}, error) {
+	if len(stream.claimed) == 0 && time.Since(stream.lastClaim) >= stream.options.ClaimInterval {
+		stream.lastClaim = time.Now()
+		err := stream.claimIdle(ctx)
+		if err != nil {
+			return "", nil, err
+		}
 	}
-	message := entries[0].Messages[0]
+	if len(stream.claimed) == 0 {
+		return "", nil, nil
+	}
+	message := stream.claimed[0]
+	stream.claimed = stream.claimed[1:]
 	return message.ID, message.Values, nil
 }
 
+// Claim the items of the group that have been pending for longer than ClaimIdle,
+// except those that are waiting to be retried.
+func (stream *RedisStream) claimIdle(ctx context.Context) error {
+	pending, err := stream.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: stream.key,
+		Group:  stream.groupId,
+		Idle:   stream.options.ClaimIdle,
+		Start:  "-",
+		End:    "+",
+		Count:  claimCount,
+	}).Result()
+	if err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(pending))
+	for _, p := range pending {
+		if p.Consumer == stream.consumerId {
+			// Own items are only idle if they are waiting to be retried.
+			continue
+		}
+		scheduled, err := stream.isRetryScheduled(ctx, p.ID)
+		if err != nil {
+			return err
+		}
+		if !scheduled {
+			ids = append(ids, p.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return stream.deleteIdleConsumers(ctx)
+	}
+	// Claiming with MinIdle is atomic: if another consumer claims the same item
+	// before us, the item is not idle anymore and it is not returned.
+	messages, err := stream.client.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   stream.key,
+		Group:    stream.groupId,
+		Consumer: stream.consumerId,
+		MinIdle:  stream.options.ClaimIdle,
+		Messages: ids,
+	}).Result()
+	if err != nil {
+		return err
+	}
+	for _, message := range messages {
+		if message.Values == nil {
+			// The item has been deleted from the stream, just remove it from the pending list.
+			if err := stream.client.XAck(ctx, stream.key, stream.groupId, message.ID).Err(); err != nil {
+				return err
+			}
+			continue
+		}
+		// The consumer may have crashed handling the item, so it counts as an attempt
+		// and items that keep crashing consumers end up in the dead-letter stream.
+		attempts, err := stream.client.HIncrBy(ctx, stream.attemptsKey(), message.ID, 1).Result()
+		if err != nil {
+			return err
+		}
+		if attempts >= int64(stream.options.MaxAttempts) {
+			if err := stream.moveToDead(ctx, message.ID, errAbandoned, attempts); err != nil {
+				return err
+			}
+			continue
+		}
+		stream.claimed = append(stream.claimed, message)
+	}
+	return stream.deleteIdleConsumers(ctx)
+}
+
+// Check whether the given item is scheduled to be retried.
+func (stream *RedisStream) isRetryScheduled(ctx context.Context, messageId string) (bool, error) {
+	err := stream.client.ZScore(ctx, stream.retryKey(), messageId).Err()
+	if err == redis.Nil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Remove consumers of the group from previous processes that don't have pending
+// items and have been idle for longer than ClaimIdle, so the group doesn't
+// accumulate a consumer per restart.
+func (stream *RedisStream) deleteIdleConsumers(ctx context.Context) error {
+	consumers, err := stream.xinfo(ctx, "CONSUMERS", stream.key, stream.groupId)
+	if err != nil {
+		return err
+	}
+	for _, consumer := range consumers {
+		name, _ := consumer["name"].(string)
+		pending, _ := consumer["pending"].(int64)
+		idle, _ := consumer["idle"].(int64)
+		if name != stream.consumerId && pending == 0 && time.Duration(idle)*time.Millisecond > stream.options.ClaimIdle {
+			err := stream.client.XGroupDelConsumer(ctx, stream.key, stream.groupId, name).Err()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Run the given XINFO subcommand and return the list of key-value entries.
+// The typed XINFO commands of the redis client don't support the additional
+// fields returned by recent Redis versions.
+func (stream *RedisStream) xinfo(ctx context.Context, args ...interface{}) ([]map[string]interface{}, error) {
+	res, err := stream.client.Do(ctx, append([]interface{}{"XINFO"}, args...)...).Result()
+	if err != nil {
+		return nil, err
+	}
+	list, ok := res.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected XINFO reply %v", res)
+	}
+	entries := make([]map[string]interface{}, 0, len(list))
+	for _, item := range list {
+		fields, ok := item.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unexpected XINFO entry %v", item)
+		}
+		entry := make(map[string]interface{}, len(fields)/2)
+		for i := 0; i+1 < len(fields); i += 2 {
+			if key, ok := fields[i].(string); ok {
+				entry[key] = fields[i+1]
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
 // Acknowledge that a stream item has been processed.
-func (stream *Stream) Ack(ctx context.Context, messageId string) error {
-	return stream.client.XAck(ctx, stream.name, stream.groupId, messageId).Err()
+func (stream *RedisStream) Ack(ctx context.Context, messageId string) error {
+	_, err := stream.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAck(ctx, stream.key, stream.groupId, messageId)
+		pipe.HDel(ctx, stream.attemptsKey(), messageId)
+		return nil
+	})
+	return err
+}
+
+// Report that the processing of a stream item failed with the given cause. The item
+// is scheduled to be delivered again after a backoff delay, unless it has already
+// been attempted MaxAttempts times. In this case it is moved to the dead-letter
+// stream together with the error and this function returns true.
+func (stream *RedisStream) Fail(ctx context.Context, messageId string, cause error) (bool, error) {
+	attempts, err := stream.client.HIncrBy(ctx, stream.attemptsKey(), messageId, 1).Result()
+	if err != nil {
+		return false, err
+	}
+	if attempts >= int64(stream.options.MaxAttempts) {
+		return true, stream.moveToDead(ctx, messageId, cause, attempts)
+	}
+	retryTime := time.Now().Add(stream.options.retryDelay(attempts))
+	err = stream.client.ZAdd(ctx, stream.retryKey(), &redis.Z{
+		Score:  float64(retryTime.UnixMilli()),
+		Member: messageId,
+	}).Err()
+	return false, err
+}
+
+// Copy the item to the dead-letter stream along with the failure details and
+// acknowledge it in the original stream.
+func (stream *RedisStream) moveToDead(ctx context.Context, messageId string, cause error, attempts int64) error {
+	messages, err := stream.client.XRange(ctx, stream.key, messageId, messageId).Result()
+	if err != nil {
+		return err
+	}
+	value := map[string]interface{}{}
+	if len(messages) == 1 {
+		for k, v := range messages[0].Values {
+			value[k] = v
+		}
+	}
+	value["error"] = cause.Error()
+	value["stream"] = stream.name
+	value["group"] = stream.groupId
+	value["id"] = messageId
+	value["attempts"] = attempts
+
+	_, err = stream.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: stream.key + DeadStreamSuffix,
+			Values: value,
+		})
+		pipe.XAck(ctx, stream.key, stream.groupId, messageId)
+		pipe.HDel(ctx, stream.attemptsKey(), messageId)
+		return nil
+	})
+	return err
+}
+
+// Lowest id of the items that are not older than MaxAge, or an empty string if
+// there is no MaxAge.
+func (options StreamOptions) ageMinId() string {
+	if options.MaxAge <= 0 {
+		return ""
+	}
+	return strconv.FormatInt(time.Now().Add(-options.MaxAge).UnixMilli(), 10) + "-0"
+}
+
+// Delays before reading a stream again after consecutive read errors.
+const (
+	readRetryDelay    = time.Second
+	maxReadRetryDelay = time.Minute
+)
+
+// Wait before reading a stream again after the given number of consecutive read
+// errors (starting at 1). Returns the context error if it is done before.
+func WaitReadRetry(ctx context.Context, failures int) error {
+	options := StreamOptions{RetryDelay: readRetryDelay, MaxRetryDelay: maxReadRetryDelay}
+	select {
+	case <-time.After(options.retryDelay(int64(failures))):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Delay before the given retry attempt (starting at 1), doubling the
+// RetryDelay each time up to MaxRetryDelay.
+func (options StreamOptions) retryDelay(attempt int64) time.Duration {
+	delay := options.RetryDelay
+	for i := int64(1); i < attempt && delay < options.MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > options.MaxRetryDelay {
+		delay = options.MaxRetryDelay
+	}
+	return delay
+}
+
+func (stream *RedisStream) Range(ctx context.Context, start string, end string, count int64) ([]StreamItem, error) {
+	messages, err := stream.client.XRangeN(ctx, stream.key, start, end, count).Result()
+	if err != nil {
+		return nil, err
+	}
+	items := make([]StreamItem, len(messages))
+	for i, message := range messages {
+		items[i] = StreamItem{Id: message.ID, Value: message.Values}
+	}
+	return items, nil
+}
+
+// Return the id of the last item in the stream, or "0-0" if the stream is empty.
+func (stream *RedisStream) LastId(ctx context.Context) (string, error) {
+	messages, err := stream.client.XRevRangeN(ctx, stream.key, "+", "-", 1).Result()
+	if err != nil {
+		return "", err
+	}
+	if len(messages) == 0 {
+		return "0-0", nil
+	}
+	return messages[0].ID, nil
+}
+
+func (stream *RedisStream) Trim(ctx context.Context) (int64, error) {
+	trimmed, err := stream.trim(ctx, stream.key)
+	if err != nil {
+		return trimmed, err
+	}
+	// Dead-letter items have no consumer groups and are only kept for inspection.
+	dead, err := stream.trim(ctx, stream.key+DeadStreamSuffix)
+	return trimmed + dead, err
+}
+
+func (stream *RedisStream) trim(ctx context.Context, key string) (int64, error) {
+	length, err := stream.client.XLen(ctx, key).Result()
+	if err != nil || length == 0 {
+		return 0, err
+	}
+	threshold := stream.options.ageMinId()
+	if excess := length - stream.options.MaxLen; stream.options.MaxLen > 0 && excess > 0 {
+		messages, err := stream.client.XRangeN(ctx, key, "-", "+", min(excess, trimCount)).Result()
+		if err != nil {
+			return 0, err
+		}
+		if len(messages) > 0 {
+			threshold = maxId(threshold, NextId(messages[len(messages)-1].ID))
+		}
+	}
+	if threshold == "" {
+		return 0, nil
+	}
+	floor, err := stream.trimFloor(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	if floor != "" && CompareIds(floor, threshold) < 0 {
+		threshold = floor
+	}
+	return stream.client.XTrimMinID(ctx, key, threshold).Result()
+}
+
+// Return the lowest id that can't be trimmed because it is pending in some consumer
+// group or it has not been delivered yet to a group in use. Returns an empty string
+// if there is no such id.
+func (stream *RedisStream) trimFloor(ctx context.Context, key string) (string, error) {
+	groups, err := stream.xinfo(ctx, "GROUPS", key)
+	if err != nil {
+		return "", err
+	}
+	floor := ""
+	for _, group := range groups {
+		name, _ := group["name"].(string)
+		pending, _ := group["pending"].(int64)
+		consumers, _ := group["consumers"].(int64)
+		lastDelivered, _ := group["last-delivered-id"].(string)
+		if pending > 0 {
+			summary, err := stream.client.XPending(ctx, key, name).Result()
+			if err != nil {
+				return "", err
+			}
+			floor = minId(floor, summary.Lower)
+		}
+		// Groups without consumers are no longer used, since consumers are registered
+		// when the stream is created and removed when idle, so they are not waiting
+		// for new items. The memory backend follows the same rule.
+		if consumers > 0 {
+			floor = minId(floor, NextId(lastDelivered))
+		}
+	}
+	return floor, nil
+}
+
+// Compare two stream ids of the form "<milliseconds>-<sequence>". Returns -1, 0 or 1
+// if a is less, equal or greater than b.
+func CompareIds(a string, b string) int {
+	aMs, aSeq := splitId(a)
+	bMs, bSeq := splitId(b)
+	switch {
+	case aMs < bMs || (aMs == bMs && aSeq < bSeq):
+		return -1
+	case aMs == bMs && aSeq == bSeq:
+		return 0
+	}
+	return 1
+}
+
+// Return the lowest of the ids, ignoring empty ones.
+func minId(a string, b string) string {
+	if a == "" || (b != "" && CompareIds(b, a) < 0) {
+		return b
+	}
+	return a
+}
+
+// Return the highest of the ids, ignoring empty ones.
+func maxId(a string, b string) string {
+	if a == "" || (b != "" && CompareIds(b, a) > 0) {
+		return b
+	}
+	return a
+}
+
+// Return the stream id that immediately follows the given one.
+func NextId(id string) string {
+	ms, seq := splitId(id)
+	return strconv.FormatUint(ms, 10) + "-" + strconv.FormatUint(seq+1, 10)
+}
+
+func splitId(id string) (uint64, uint64) {
+	ms, seq, _ := strings.Cut(id, "-")
+	m, _ := strconv.ParseUint(ms, 10, 64)
+	s, _ := strconv.ParseUint(seq, 10, 64)
+	return m, s
+}
+
+// Sorted set of failed item ids scored by the time they have to be retried.
+func (stream *RedisStream) retryKey() string {
+	return "stream:" + stream.key + ":" + stream.groupId + ":retry"
+}
+
+// Hash with the number of failed attempts for each item id.
+func (stream *RedisStream) attemptsKey() string {
+	return "stream:" + stream.key + ":" + stream.groupId + ":attempts"
 }
@@ -0,0 +1,20 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	options := StreamOptions{
+		MaxAttempts:   10,
+		RetryDelay:    30 * time.Second,
+		MaxRetryDelay: 5 * time.Minute,
+	}
+	expected := []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute}
+	for i, delay := range expected {
+		if d := options.retryDelay(int64(i + 1)); d != delay {
+			t.Errorf("Expected delay %v for attempt %d, got %v", delay, i+1, d)
+		}
+	}
+}